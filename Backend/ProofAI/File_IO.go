@@ -7,25 +7,26 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
 )
 
 /*
 ReadAndWriteMemoryTransaction is a function to read and write the memory transactions
 main logic:
- 1. Create a file with the name Transaction_<powLenght>_<blockLength>.json
+ 1. Create a file with the name Transaction_<chainID>.json in the data directory, chains without an ID use <powLenght>_<blockLength>
  2. If the file does not exist, create a new file
  3. Read the blocks from the file
  4. Append the blocks to the ledger
 */
-func ReadAndWriteMemoryTransaction() {
+func (bf *ProofAIFactory) ReadAndWriteMemoryTransaction() {
 
-	blockLengthStr := strconv.Itoa(ProofAI.selfMiningDetail.blockLength)
-	powStr := strconv.Itoa(ProofAI.selfMiningDetail.powLenght)
-	file := "Transaction_" + powStr + "_" + blockLengthStr + ".json"
-	ProofAI.selfMiningDetail.LedgerFile = file
+	file := nodeConfig.dataPath("Transaction_" + bf.selfMiningDetail.getChainID() + ".json")
+
+	bf.ledger.mu.Lock()
+	defer bf.ledger.mu.Unlock()
+	bf.ledger.file = file
 
 	if _, err := os.Stat(file); os.IsNotExist(err) {
 		f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0666)
@@ -36,7 +37,7 @@ func ReadAndWriteMemoryTransaction() {
 		return
 	}
 
-	ProofAI.selfMiningDetail.transactionFile = file
+	bf.selfMiningDetail.transactionFile = file
 
 	blocks, err := ReadBlocksFromLedgerFile(file)
 	if err != nil {
@@ -44,16 +45,15 @@ func ReadAndWriteMemoryTransaction() {
 	}
 
 	for _, block := range blocks {
-		ProofAI.ledger.blocks = append(ProofAI.ledger.blocks, *block)
+		bf.ledger.blocks = append(bf.ledger.blocks, *block)
 	}
 }
 
 /*
 InsertBlockInLedgerFile is a function to insert the block in the ledger file
+The caller must hold the ledger lock
 */
-func InsertBlockInLedgerFile(block *Block) error {
-
-	filePath := ProofAI.selfMiningDetail.LedgerFile
+func InsertBlockInLedgerFile(filePath string, block *Block) error {
 
 	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
@@ -112,37 +112,34 @@ func ReadBlocksFromLedgerFile(filename string) ([]*Block, error) {
 }
 
 /*
-getPubKeyofIP is a function to get the public key of the IP address from the server URL provided
+getPubKeyOfAddress is a function to get the public key of the miner registered with the address ip:port on the service machine
+The key is nil if no miner is registered with the address, the handshake then proves the key of the miner
+Several miners may share an IP address, so the port must match too
 */
-func getPubKeyofIP(serverURL string, IP string) (*ecdsa.PublicKey, error) {
+func getPubKeyOfAddress(serverURL string, address string) (*ecdsa.PublicKey, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
 
 	resp, err := http.Get(serverURL + "/machines")
 	if err != nil {
-		return nil, nil
+		return nil, fmt.Errorf("failed to fetch miners: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, nil
+		return nil, fmt.Errorf("server returned status: %d", resp.StatusCode)
 	}
 
 	var machines []MachineDetail
 	if err := json.NewDecoder(resp.Body).Decode(&machines); err != nil {
-		return nil, nil
-	}
-
-	if len(machines) == 0 {
-		return nil, nil
+		return nil, fmt.Errorf("failed to decode response: %v", err)
 	}
 
 	for _, machine := range machines {
-		if machine.IP == IP {
-			fmt.Println(machine.IP)
-			pubKey, err := hexToPublicKey(machine.PubKey)
-			if err != nil {
-				return nil, err
-			}
-			return pubKey, err
+		if machine.IP == host && machine.Port == port {
+			return hexToPublicKey(machine.PubKey)
 		}
 	}
 	return nil, nil
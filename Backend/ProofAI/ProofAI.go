@@ -1,17 +1,41 @@
 package main
 
 //			Starting point of the application
-//			1. Create a new ProofAIFactory object
+//			1. Load the node configuration (config file, environment, flags) and create the environment and content caches
 //			2. Start the server and listen for incoming requests
 
-// ProofAI is a global variable for session management
-var ProofAI *ProofAIFactory
+import (
+	"log"
+	"os"
+)
+
+// ProofAI is a global variable for session management, created once and reset on every login and logout
+var ProofAI = NewProofAIFactory()
 
 // serviceMachineAdd is the address of the service machine , set before session creating
 var serviceMachineAdd string
 
 // createServerAndListen creates a new ProofAIFactory object and starts the server
 func main() {
+	config, err := loadNodeConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+	nodeConfig = config
+	if config.Executor == "venv" {
+		log.Printf("WARNING: transactions are executed with the venv executor, without sandbox: the model code of other users runs on this host with the rights of the node. Use -executor container on chains with untrusted users.")
+	}
+
+	envCache, err = newEnvCache(config)
+	if err != nil {
+		log.Fatalf("Error creating environment cache: %v", err)
+	}
+
+	contentCache, err = newContentCache(config)
+	if err != nil {
+		log.Fatalf("Error creating content cache: %v", err)
+	}
+
 	// Start the external world server
 	go createServerAndListenExternelWorld()
 
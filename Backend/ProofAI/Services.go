@@ -4,6 +4,8 @@ package main
 	In this we create two  Server to listen for incoming requests from the external world and run background services to communicate with frontend and backend services.
 	1-	createServerAndListenExternelWorld creates a new ProofAI object and starts the server to listen for incoming requests from the external world.
 	2-	createServerAndListen creates a new ProofAI object and starts the server to listen for incoming requests from the frontend.
+	Each server has its own mux (externalWorldMux, localAPIMux): the peers only reach the peer routes, and the local API, which logs in,
+	signs and pins with the key of the node, only listens on localAPIAddress.
 	3-	handleGetLatestBlock gets the latest block.
 	4-	handlegetServiceMachineIP gets the IP address of the service machine.
 	5-	handlegetPubkey gets the public key of the miner.
@@ -18,7 +20,8 @@ package main
 	14-	handleNewTransaction creates a new transaction.
 	15-	handleLoginVerification verifies the login of the miner.
 	16-	successfulllogin is called when the login is successful.
-	17-	sendServiceLogout sends a logout request to the service machine where the miner is connected to.
+	17-	sendServiceLogout sends a logout request to the service machine of a chain.
+	Handlers working on chain data take an optional chainId query parameter, the default chain is used without it.
 */
 
 import (
@@ -26,12 +29,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 
 	"github.com/gorilla/handlers"
 )
 
+// localAPIAddress is the address of the API used by the frontend, only reachable from the node itself
+const localAPIAddress = "127.0.0.1:8080"
+
 /*
 createServerAndListenExternelWorld creates a new ProofAI object and starts the server to listen for incoming requests
 REST API is used to communicate with the service machine
@@ -39,20 +46,30 @@ REST API is used to communicate with the service machine
 func createServerAndListenExternelWorld() {
 	fmt.Println("Server Starting for External World...")
 
-	http.HandleFunc("/api/latestBlock", handleGetLatestBlock)     // get latest block
 	cors := handlers.CORS(handlers.AllowedOrigins([]string{"*"})) // allow all origins
 
-	ip, err := getRadminIPv4()
+	ip := bindAddress()
 	fmt.Println("IP : ", ip)
-	address := ip + ":8079" // bind to all interfaces on port 8079
+	address := net.JoinHostPort(ip, "8079") // bind to the configured address on port 8079
 	fmt.Printf("Listening on %s\n", address)
 
-	err = http.ListenAndServe(address, cors(http.DefaultServeMux))
+	err := http.ListenAndServe(address, cors(externalWorldMux()))
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
 }
 
+/*
+externalWorldMux creates the mux of the routes used by the other miners and the service machine
+*/
+func externalWorldMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/latestBlock", handleGetLatestBlock) // get latest block
+	mux.HandleFunc("/api/content", handleGetContent)         // send a cached dataset or model to a miner
+	mux.HandleFunc("/api/contentRefs", handleGetContentRefs) // CIDs used by the chain, kept by the service machine
+	return mux
+}
+
 /*
 handleGetLatestBlock gets the latest block
 Output parameter : response
@@ -68,14 +85,20 @@ func handleGetLatestBlock(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	if len(ProofAI.ledger.blocks) == 0 {
+	latest, ok := chain.ledger.latest()
+	if !ok {
 		response := map[string]interface{}{"block": "null"}
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	response := map[string]interface{}{"block": ProofAI.ledger.blocks[len(ProofAI.ledger.blocks)-1]}
+	response := map[string]interface{}{"block": latest}
 	json.NewEncoder(w).Encode(response)
 
 }
@@ -86,26 +109,50 @@ func handleGetLatestBlock(w http.ResponseWriter, r *http.Request) {
 */
 func createServerAndListen() {
 
-	http.HandleFunc("/api/login", handleLoginVerification)                         // login verification
-	http.HandleFunc("/api/getRole", handleGetRole)                                 // get role of the miner
-	http.HandleFunc("/api/GetServiceMachineIP", handlegetServiceMachineIP)         // get public key of the miner
-	http.HandleFunc("/api/Pubkey", handlegetPubkey)                                // get public key of the miner
-	http.HandleFunc("/api/logout", handleLogout)                                   // logout the miner
-	http.HandleFunc("/api/setRole", handleSetRole)                                 // set role of the miner
-	http.HandleFunc("/api/ServiceMachineIP", handleServiceMachineIP)               // set service machine IP
-	http.HandleFunc("/api/generateKeys", handleGenerateKey)                        // generate keys for the miner
-	http.HandleFunc("/api/newTransaction", handleNewTransaction)                   // create new transaction
-	http.HandleFunc("/api/getMinedBlocks", handleGetMinedBlocks)                   // get mined blocks
-	http.HandleFunc("/api/getCurrentlyMinBlock", handleGetCurrentlyMiningBlock)    // get currently mining block
-	http.HandleFunc("/api/transactionConfirmation", handleTransactionConfirmation) // transaction confirmation
-
-	cors := handlers.CORS(handlers.AllowedOrigins([]string{"*"}))   // allow all origins
-	err := http.ListenAndServe(":8080", cors(http.DefaultServeMux)) // listen on port 8080
+	cors := handlers.CORS(handlers.AllowedOrigins([]string{"*"}))    // allow all origins
+	err := http.ListenAndServe(localAPIAddress, cors(localAPIMux())) // listen on port 8080 of the loopback interface
 	if err != nil {
 		fmt.Println("Error starting server: ", err)
 	}
 }
 
+/*
+localAPIMux creates the mux of the routes used by the frontend
+*/
+func localAPIMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/login", handleLoginVerification)                         // login verification
+	mux.HandleFunc("/api/getRole", handleGetRole)                                 // get role of the miner
+	mux.HandleFunc("/api/GetServiceMachineIP", handlegetServiceMachineIP)         // get public key of the miner
+	mux.HandleFunc("/api/Pubkey", handlegetPubkey)                                // get public key of the miner
+	mux.HandleFunc("/api/logout", handleLogout)                                   // logout the miner
+	mux.HandleFunc("/api/setRole", handleSetRole)                                 // set role of the miner
+	mux.HandleFunc("/api/ServiceMachineIP", handleServiceMachineIP)               // set service machine IP
+	mux.HandleFunc("/api/generateKeys", handleGenerateKey)                        // generate keys for the miner
+	mux.HandleFunc("/api/newTransaction", handleNewTransaction)                   // create new transaction
+	mux.HandleFunc("/api/getMinedBlocks", handleGetMinedBlocks)                   // get mined blocks
+	mux.HandleFunc("/api/getCurrentlyMinBlock", handleGetCurrentlyMiningBlock)    // get currently mining block
+	mux.HandleFunc("/api/transactionConfirmation", handleTransactionConfirmation) // transaction confirmation
+	mux.HandleFunc("/api/artifact", handleDownloadArtifact)                       // download an output of a transaction
+	mux.HandleFunc("/api/transactionLogs", handleTransactionLogs)                 // follow the log of a transaction being executed
+	mux.HandleFunc("/api/usage", handleGetUsage)                                  // resources used per miner and per submitter
+	mux.HandleFunc("/api/peers", handleGetPeers)                                  // list connected miners
+	mux.HandleFunc("/api/peers/connect", handleConnectPeer)                       // connect to a miner
+	mux.HandleFunc("/api/peers/disconnect", handleDisconnectPeer)                 // disconnect a miner
+	mux.HandleFunc("/api/peers/ban", handleBanPeer)                               // ban a public key
+	mux.HandleFunc("/api/peers/unban", handleUnbanPeer)                           // unban a public key
+	mux.HandleFunc("/api/peers/banned", handleGetBannedPeers)                     // list banned public keys
+	mux.HandleFunc("/api/chains", handleGetChains)                                // list joined chains
+	mux.HandleFunc("/api/chains/join", handleJoinChain)                           // join the chain of another service machine
+	mux.HandleFunc("/api/chains/leave", handleLeaveChain)                         // leave a joined chain
+	mux.HandleFunc("/api/registry", handleGetRegistry)                            // search the registry of datasets and models
+	mux.HandleFunc("/api/registry/publish", handlePublishRegistry)                // publish a dataset or model under a name
+	mux.HandleFunc("/api/pins", handleGetPins)                                    // list the content pinned by the node
+	mux.HandleFunc("/api/pins/claim", handleClaimUpload)                          // sign the claim of an upload session
+	mux.HandleFunc("/api/pins/unpin", handleUnpin)                                // unpin content owned by the node
+	return mux
+}
+
 /*
 handlegetServiceMachineIP gets the IP address of the service machine
 Output parameter : response
@@ -136,9 +183,15 @@ func handlegetPubkey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	response := map[string]string{"pubKey": ProofAI.selfMiningDetail.pubKeyStr}
+	pubKeyStr, _ := chain.selfMiningDetail.identity()
+	response := map[string]string{"pubKey": pubKeyStr}
 	json.NewEncoder(w).Encode(response)
 }
 
@@ -209,6 +262,11 @@ func handleSetRole(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
 	err := r.ParseForm()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -218,8 +276,8 @@ func handleSetRole(w http.ResponseWriter, r *http.Request) {
 	}
 
 	role := r.FormValue("role")
-	ProofAI.selfMiningDetail.role = role
-	fmt.Println("Role : ", ProofAI.selfMiningDetail.role)
+	chain.selfMiningDetail.setRole(role)
+	fmt.Println("Role : ", role)
 	w.WriteHeader(http.StatusOK)
 	response := map[string]string{"role": "Set"}
 	json.NewEncoder(w).Encode(response)
@@ -238,11 +296,17 @@ func handleGetRole(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	role := chain.selfMiningDetail.getRole()
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	response := map[string]string{"role": ProofAI.selfMiningDetail.role}
+	response := map[string]string{"role": role}
 	json.NewEncoder(w).Encode(response)
-	fmt.Println("Role : ", ProofAI.selfMiningDetail.role)
+	fmt.Println("Role : ", role)
 }
 
 /*
@@ -259,12 +323,17 @@ func handleGetCurrentlyMiningBlock(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	//fmt.Println("Currently Mining Block")
 
-	if ProofAI.currentlyMiningBlockForUser.Transactions != nil {
-		response := map[string]interface{}{"block": ProofAI.currentlyMiningBlockForUser}
+	if block := chain.miningBlockForUser(); block.Transactions != nil {
+		response := map[string]interface{}{"block": block}
 		//
 		//	fmt.Println("Response ", response)
 		json.NewEncoder(w).Encode(response)
@@ -289,17 +358,23 @@ func handleGetMinedBlocks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
 	// get params value
 	fiterValue := r.URL.Query().Get("filter")
 	//	fmt.Println("Filter value : ", fiterValue)
 	var response map[string]interface{}
 	if fiterValue == "Own Transactions" {
 
+		pubKeyStr, _ := chain.selfMiningDetail.identity()
 		var blocks []Block
-		for _, block := range ProofAI.ledger.blocks {
+		for _, block := range chain.ledger.snapshot() {
 			var transactionList []Transaction
 			for _, transaction := range block.Transactions {
-				if transaction.From == ProofAI.selfMiningDetail.pubKeyStr {
+				if transaction.From == pubKeyStr {
 					transactionList = append(transactionList, transaction)
 				}
 			}
@@ -318,11 +393,11 @@ func handleGetMinedBlocks(w http.ResponseWriter, r *http.Request) {
 
 	} else {
 
-		if len(ProofAI.ledger.blocks) == 0 {
+		if blocks := chain.ledger.snapshot(); len(blocks) == 0 {
 			response = map[string]interface{}{"blocks": "null"}
 		} else {
 
-			response = map[string]interface{}{"blocks": ProofAI.ledger.blocks}
+			response = map[string]interface{}{"blocks": blocks}
 		}
 	}
 
@@ -336,7 +411,7 @@ func handleGetMinedBlocks(w http.ResponseWriter, r *http.Request) {
     Input parameters : from address, nonce
     Output parameter : response
     logic : Check if the transaction is confirmed or not.
-    If the transaction is confirmed, then return "Confirmed".
+    If the transaction is confirmed, then return "Confirmed" with the execution status and the uploaded outputs.
     Else return "Pending".
 */
 func handleTransactionConfirmation(w http.ResponseWriter, r *http.Request) {
@@ -348,16 +423,21 @@ func handleTransactionConfirmation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
 	From := r.URL.Query().Get("from")
 	nonce := r.URL.Query().Get("nonce")
 
 	//fmt.Println(From, nonce)
 	// check if the transaction is confirmed
-	for _, block := range ProofAI.ledger.blocks {
+	for _, block := range chain.ledger.snapshot() {
 		for _, transaction := range block.Transactions {
 			if transaction.From == From && strconv.Itoa(transaction.Nonce) == nonce {
 				w.WriteHeader(http.StatusOK)
-				response := map[string]string{"transaction": "Confirmed"}
+				response := map[string]interface{}{"transaction": "Confirmed", "status": transaction.Status, "result": transaction.Result, "artifacts": transaction.Artifacts}
 				json.NewEncoder(w).Encode(response)
 				fmt.Println("Transaction Confirmed")
 				fmt.Println(From, nonce)
@@ -405,6 +485,7 @@ func handleGenerateKey(w http.ResponseWriter, r *http.Request) {
 /*
   - handleNewTransaction creates a new transaction
     Input parameters : model CID, dataset CID
+    logic : The job manifest (proofai.yaml) of the model is checked before the transaction is created.
     output parameters : response
 */
 func handleNewTransaction(w http.ResponseWriter, r *http.Request) {
@@ -418,6 +499,11 @@ func handleNewTransaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
 	err := r.ParseForm()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -426,9 +512,26 @@ func handleNewTransaction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	modelCID := r.FormValue("modelCID")
-	datasetCID := r.FormValue("datasetCID")
-	transaction, err := userTransaction(modelCID, datasetCID)
+	// modelCID and datasetCID may be registry references, the transaction records their CIDs
+	serviceMachineURL := chain.selfMiningDetail.serviceMachineURL()
+	modelCID, err := resolveContentRef(serviceMachineURL, r.FormValue("modelCID"))
+	var datasetCID string
+	if err == nil {
+		datasetCID, err = resolveContentRef(serviceMachineURL, r.FormValue("datasetCID"))
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := map[string]string{"error": err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if err := chain.validateModelManifest(modelCID); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := map[string]string{"error": "Invalid model: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	transaction, err := chain.userTransaction(modelCID, datasetCID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		response := map[string]string{"error": "Error creating transaction: " + err.Error()}
@@ -509,23 +612,25 @@ func handleLoginVerification(w http.ResponseWriter, r *http.Request) {
 */
 func successfulllogin(pubKey string, prvKey string, pubKeyDecoded *ecdsa.PublicKey, prvKeyDecoded *ecdsa.PrivateKey) {
 
-	StartNewSession()
-	ProofAI.selfMiningDetail.pubKey = pubKeyDecoded
-	ProofAI.selfMiningDetail.prvKey = prvKeyDecoded
-	ProofAI.selfMiningDetail.pubKeyStr = pubKey
-	ProofAI.selfMiningDetail.prvKeyStr = prvKey
-	go establishConnection(ProofAI.connectionPort) // establish connection with the service machine to get the latest block details and start mining process
+	StartNewSession(pubKey, prvKey, pubKeyDecoded, prvKeyDecoded)
+	go ProofAI.establishConnection(ProofAI.connectionPort) // establish connection with the service machine to get the latest block details and start mining process
 }
 
 /*
- sendServiceLogout sends a logout request to the service machine where the miner is connected to.
+sendServiceLogout sends a logout request to the service machine of the chain, signed with the key of the miner
 */
+func (bf *ProofAIFactory) sendServiceLogout(pubKeyStr string, prvKey *ecdsa.PrivateKey) {
 
-func sendServiceLogout() {
-
-	res, err := http.Post("http://"+serviceMachineAdd+"/logout", "application/json", nil)
+	serviceMachineURl := bf.selfMiningDetail.serviceMachineURL()
+	request, err := newMinerRequest(serviceMachineURl, pubKeyStr, prvKey, "logout", MachineDetail{})
+	if err != nil {
+		fmt.Println("Error in signing logout request to service machine", err.Error())
+		return
+	}
+	res, err := postMinerRequest(serviceMachineURl, "/logout", request)
 	if err != nil {
 		fmt.Println("Error in sending logout request to service machine", err.Error())
+		return
 	}
 	defer res.Body.Close()
 }
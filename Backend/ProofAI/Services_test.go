@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+TestExternalWorldMuxOnlyServesPeerRoutes checks that the peers cannot reach the local API that signs with the key of the node
+*/
+func TestExternalWorldMuxOnlyServesPeerRoutes(t *testing.T) {
+	external := externalWorldMux()
+	for _, path := range []string{"/api/latestBlock", "/api/content", "/api/contentRefs"} {
+		if _, pattern := external.Handler(httptest.NewRequest("GET", path, nil)); pattern != path {
+			t.Errorf("peer route %s is not served, pattern %q", path, pattern)
+		}
+	}
+
+	local := []string{"/api/login", "/api/logout", "/api/newTransaction", "/api/peers/connect", "/api/peers/ban", "/api/chains/join", "/api/chains/leave", "/api/registry/publish", "/api/pins/claim", "/api/pins/unpin"}
+	for _, path := range local {
+		if _, pattern := external.Handler(httptest.NewRequest("POST", path, nil)); pattern != "" {
+			t.Errorf("local route %s is served to the peers", path)
+		}
+		if _, pattern := localAPIMux().Handler(httptest.NewRequest("POST", path, nil)); pattern != path {
+			t.Errorf("local route %s is not served by the local API, pattern %q", path, pattern)
+		}
+	}
+}
@@ -2,46 +2,117 @@ package main
 
 /*
 	In this we create a new session of ProofAI when user login and close the current session when user logs out.
+	Every chain the node takes part in has its own ProofAIFactory (ledger, mempool, miners and mining loop), ProofAI is the default chain.
 	1-		StartNewSession is a function to start a new session of ProofAI.
-	2-		CloseSession is a function to close the current session of ProofAI.
+	2-		CloseSession is a function to close the sessions of all chains.
 	3-		ProofAIFactory is a struct to create a new ProofAI object.
 	4-		NewProofAIFactory is a function to create a new ProofAI object.
 	5-		Reset is a function to reset the ProofAI object.
+	6-		peers, addMiner and removeMiner manage the list of connected miners.
+	7-		markTransactionReceived and markBlockReceived record the gossip already seen.
+	8-		miningBlock and miningBlockForUser give access to the block currently being mined.
 */
 
 import (
 	"context"
-	"time"
+	"crypto/ecdsa"
+	"sync"
 )
 
 /*
 Starting point of the application
- 1. Create a new ProofAI object
- 2. Start the server and listen for incoming requests
+ 1. Start the session of the chain of the service machine set by the user
+ 2. Other chains are joined later through the chain API
 */
-func StartNewSession() {
-	ProofAI = NewProofAIFactory()
-	ctx, _ := context.WithCancel(context.Background())
-	go BlockMining(ctx)
+func StartNewSession(pubKey string, prvKey string, pubKeyDecoded *ecdsa.PublicKey, prvKeyDecoded *ecdsa.PrivateKey) {
+	ProofAI.startSession(serviceMachineAdd, pubKey, prvKey, pubKeyDecoded, prvKeyDecoded)
 }
 
 /*
 CloseSession closes the current session
 logic to close the session
- 1. Set connectionAlive to false
- 2. Close all the connections
- 3. Reset the ProofAI object
+ 1. Close the session of every joined chain
+ 2. Close the session of the default chain
 */
 func CloseSession() {
-	ProofAI.selfMiningDetail.connectionAlive = false
-	ProofAI.selfMiningDetail.connListen.Close()
-	time.Sleep(2 * time.Second)
-	ProofAI.Reset()
-	sendServiceLogout()
+	for _, chain := range joinedChains() {
+		if chain != ProofAI {
+			chain.closeSession()
+		}
+	}
+	ProofAI.closeSession()
+}
+
+/*
+startSession starts a session of the chain
+ 1. Reset the ProofAI object and set the keys of the logged in miner
+ 2. Start the mining loop and the heartbeats bound to the session context
+*/
+func (bf *ProofAIFactory) startSession(serviceMachineAddr string, pubKey string, prvKey string, pubKeyDecoded *ecdsa.PublicKey, prvKeyDecoded *ecdsa.PrivateKey) {
+	bf.Reset()
+
+	bf.selfMiningDetail.mu.Lock()
+	bf.selfMiningDetail.pubKey = pubKeyDecoded
+	bf.selfMiningDetail.prvKey = prvKeyDecoded
+	bf.selfMiningDetail.pubKeyStr = pubKey
+	bf.selfMiningDetail.prvKeyStr = prvKey
+	bf.selfMiningDetail.connectionAlive = true
+	bf.selfMiningDetail.serviceMachineAddr = serviceMachineAddr
+	bf.selfMiningDetail.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bf.sessionMu.Lock()
+	bf.sessionCancel = cancel
+	bf.sessionMu.Unlock()
+	go bf.BlockMining(ctx)
+	go bf.sendHeartbeats(ctx)
+}
+
+/*
+closeSession closes the session of the chain
+logic to close the session
+ 1. Set connectionAlive to false and stop the mining loop
+ 2. Close all the connections
+ 3. Wait for the running mining round to stop
+ 4. Remove the chain from the joined chains and reset the ProofAI object
+ 5. Logout from the service machine
+*/
+func (bf *ProofAIFactory) closeSession() {
+	bf.sessionMu.Lock()
+	cancel := bf.sessionCancel
+	bf.sessionCancel = nil
+	bf.sessionMu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+
+	bf.selfMiningDetail.mu.Lock()
+	bf.selfMiningDetail.connectionAlive = false
+	ln := bf.selfMiningDetail.connListen
+	bf.selfMiningDetail.mu.Unlock()
+	if ln != nil {
+		ln.Close()
+	}
+	for _, miner := range bf.peers() {
+		miner.disconnect()
+	}
+
+	bf.selfMiningDetail.interruptMining()
+	unregisterChain(bf)
+	pubKeyStr, prvKey := bf.selfMiningDetail.identity()
+	bf.Reset()
+	bf.selfMiningDetail.releaseMiningSlot()
+	bf.sendServiceLogout(pubKeyStr, prvKey)
 }
 
 /*
 ProofAIFactory is a struct to create a new ProofAI object
+  - minersMu guards Miners
+  - seenMu guards receivedTransaction and receivedBlock
+  - blockMu guards CurrentlyMineBlock and currentlyMiningBlockForUser
+  - sessionMu guards sessionCancel
+  - bannedMu guards banned, the banned public keys are kept across sessions
+  - portMu guards startPort, the next communication port
 */
 type ProofAIFactory struct {
 	startPort                   int
@@ -51,12 +122,20 @@ type ProofAIFactory struct {
 	IPTable                     string
 	selfMiningDetail            selfMiner
 	memPool                     MemPool
-	Miners                      []Miner
+	Miners                      []*Miner
+	minersMu                    sync.RWMutex
 	ledger                      Ledger
 	CurrentlyMineBlock          *Block
 	receivedTransaction         map[string]bool
 	receivedBlock               map[string]bool
+	seenMu                      sync.Mutex
 	currentlyMiningBlockForUser Block
+	blockMu                     sync.RWMutex
+	sessionCancel               context.CancelFunc
+	sessionMu                   sync.Mutex
+	banned                      map[string]bool
+	bannedMu                    sync.RWMutex
+	portMu                      sync.Mutex
 }
 
 /*
@@ -68,13 +147,14 @@ func NewProofAIFactory() *ProofAIFactory {
 		startPort:           8280,
 		connectionPort:      "8090",
 		modelExecutionDir:   "TransactonExecution",
-		selfMiningDetail:    selfMiner{nonce: 0, role: "Miner", connectionAlive: true, serviceMachineAddr: serviceMachineAdd, readLedger: false},
-		memPool:             MemPool{},
-		Miners:              []Miner{},
+		selfMiningDetail:    selfMiner{nonce: 0, role: "Miner", connectionAlive: true, serviceMachineAddr: serviceMachineAdd, readLedger: false, miningSlot: make(chan struct{}, 1)},
+		memPool:             newMemPool(),
+		Miners:              []*Miner{},
 		ledger:              Ledger{},
 		CurrentlyMineBlock:  nil,
 		receivedTransaction: make(map[string]bool),
 		receivedBlock:       make(map[string]bool),
+		banned:              make(map[string]bool),
 	}
 }
 
@@ -82,11 +162,124 @@ func NewProofAIFactory() *ProofAIFactory {
 Reset resets the ProofAI object, is used to reset the ProofAI object
 */
 func (bf *ProofAIFactory) Reset() {
-	bf.selfMiningDetail = selfMiner{nonce: 0, role: "Miner"}
-	bf.memPool = MemPool{}
-	bf.Miners = []Miner{}
-	bf.ledger = Ledger{}
-	bf.CurrentlyMineBlock = nil
+	bf.selfMiningDetail.mu.Lock()
+	bf.selfMiningDetail.pubKey = nil
+	bf.selfMiningDetail.prvKey = nil
+	bf.selfMiningDetail.pubKeyStr = ""
+	bf.selfMiningDetail.prvKeyStr = ""
+	bf.selfMiningDetail.nonce = 0
+	bf.selfMiningDetail.role = "Miner"
+	bf.selfMiningDetail.connListen = nil
+	bf.selfMiningDetail.readLedger = false
+	bf.selfMiningDetail.chainID = ""
+	bf.selfMiningDetail.chainConfig = ChainInfo{}
+	bf.selfMiningDetail.advertisedIP = ""
+	bf.selfMiningDetail.advertisedPort = ""
+	bf.selfMiningDetail.CurrentlyMineBlock = Block{}
+	bf.selfMiningDetail.mu.Unlock()
+
+	bf.memPool.reset()
+	bf.ledger.reset()
+
+	bf.minersMu.Lock()
+	bf.Miners = []*Miner{}
+	bf.minersMu.Unlock()
+
+	bf.seenMu.Lock()
 	bf.receivedTransaction = make(map[string]bool)
 	bf.receivedBlock = make(map[string]bool)
+	bf.seenMu.Unlock()
+
+	bf.BlockMiningEnd()
+}
+
+/*
+peers returns a snapshot of the connected miners
+*/
+func (bf *ProofAIFactory) peers() []*Miner {
+	bf.minersMu.RLock()
+	defer bf.minersMu.RUnlock()
+	miners := make([]*Miner, len(bf.Miners))
+	copy(miners, bf.Miners)
+	return miners
+}
+
+/*
+addMiner adds a connected miner to the list of miners and starts its writer goroutine
+*/
+func (bf *ProofAIFactory) addMiner(miner *Miner) {
+	miner.chain = bf
+	bf.minersMu.Lock()
+	bf.Miners = append(bf.Miners, miner)
+	bf.minersMu.Unlock()
+	go miner.writeLoop()
+}
+
+/*
+removeMiner removes a miner from the list of miners, returns false if it was not in the list
+*/
+func (bf *ProofAIFactory) removeMiner(miner *Miner) bool {
+	bf.minersMu.Lock()
+	defer bf.minersMu.Unlock()
+	for i, m := range bf.Miners {
+		if m == miner {
+			bf.Miners = append(bf.Miners[:i], bf.Miners[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+/*
+markTransactionReceived records the signature of a transaction, returns false if it was already received
+*/
+func (bf *ProofAIFactory) markTransactionReceived(signature string) bool {
+	bf.seenMu.Lock()
+	defer bf.seenMu.Unlock()
+	if bf.receivedTransaction[signature] {
+		return false
+	}
+	bf.receivedTransaction[signature] = true
+	return true
+}
+
+/*
+markBlockReceived records the transactions hash of a block, returns false if it was already received
+*/
+func (bf *ProofAIFactory) markBlockReceived(transactionsHash string) bool {
+	bf.seenMu.Lock()
+	defer bf.seenMu.Unlock()
+	if bf.receivedBlock[transactionsHash] {
+		return false
+	}
+	bf.receivedBlock[transactionsHash] = true
+	return true
+}
+
+/*
+miningBlock returns the block currently being mined, nil if no block is being mined
+*/
+func (bf *ProofAIFactory) miningBlock() *Block {
+	bf.blockMu.RLock()
+	defer bf.blockMu.RUnlock()
+	return bf.CurrentlyMineBlock
+}
+
+/*
+setMiningBlock sets the block currently being mined and the copy shown to the user
+*/
+func (bf *ProofAIFactory) setMiningBlock(block *Block, forUser Block) {
+	bf.blockMu.Lock()
+	bf.CurrentlyMineBlock = block
+	bf.currentlyMiningBlockForUser = forUser
+	bf.blockMu.Unlock()
+}
+
+/*
+miningBlockForUser returns the copy of the block currently being mined that is shown to the user
+*/
+func (bf *ProofAIFactory) miningBlockForUser() Block {
+	bf.blockMu.RLock()
+	defer bf.blockMu.RUnlock()
+	return bf.currentlyMiningBlockForUser
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+/*
+TestMarkReceivedOnce checks that concurrent readers of one transaction or block only handle it once
+*/
+func TestMarkReceivedOnce(t *testing.T) {
+	bf := NewProofAIFactory()
+
+	const readers, messages = 8, 100
+	var transactions, blocks atomic.Int64
+	var wg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < messages; i++ {
+				if bf.markTransactionReceived(fmt.Sprintf("signature-%d", i)) {
+					transactions.Add(1)
+				}
+				if bf.markBlockReceived(fmt.Sprintf("hash-%d", i)) {
+					blocks.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if transactions.Load() != messages {
+		t.Fatalf("%d transactions handled, want %d", transactions.Load(), messages)
+	}
+	if blocks.Load() != messages {
+		t.Fatalf("%d blocks handled, want %d", blocks.Load(), messages)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+/*
+	In this file we extract the tar archive the service machine (/fetch/archive) or a miner (/api/content) streams for
+	a CID, and write it for the other miners. Files are written to disk while they are read, so large datasets are
+	never held in memory. The archive ends with a PAX global header holding the SHA-256 hash of every file, the
+	extracted files must match it.
+	1-		extractArchive function which is used to extract and verify an archive.
+	2-		parseChecksums function which is used to read the hashes at the end of the archive.
+	3-		writeArchive function which is used to write the files of a directory as an archive.
+*/
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checksumRecord is the PAX record holding one "<sha256> <path>" line per file of the archive
+const checksumRecord = "PROOFAI.sha256sums"
+
+/*
+extractArchive is a function to extract a tar archive to outputDir
+ 1. Paths must stay inside outputDir, only directories and regular files are extracted
+ 2. Every file is hashed while it is written
+ 3. The hashes must match the checksums at the end of the archive, an archive without them was cut off
+ 4. The files may not be larger than maxSize in total, 0 is no limit
+    Returns the number of bytes extracted
+*/
+func extractArchive(archive io.Reader, outputDir string, maxSize int64) (int64, error) {
+	reader := tar.NewReader(archive)
+	sums := map[string]string{}
+	var checksums map[string]string
+	var size int64
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return size, fmt.Errorf("failed to read archive: %v", err)
+		}
+
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			if checksums, err = parseChecksums(header.PAXRecords[checksumRecord]); err != nil {
+				return size, err
+			}
+			continue
+		}
+
+		name := strings.TrimSuffix(header.Name, "/")
+		if !isLocalPath(name) {
+			return size, fmt.Errorf("archive path %q leaves the output directory", header.Name)
+		}
+		target := filepath.Join(outputDir, filepath.FromSlash(name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return size, fmt.Errorf("failed to create directory %s: %v", name, err)
+			}
+		case tar.TypeReg:
+			if maxSize > 0 && size+header.Size > maxSize {
+				return size, fmt.Errorf("archive is larger than the expected %d bytes", maxSize)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return size, fmt.Errorf("failed to create directory %s: %v", filepath.Dir(name), err)
+			}
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return size, fmt.Errorf("failed to save file %s: %v", name, err)
+			}
+			hash := sha256.New()
+			n, err := io.Copy(io.MultiWriter(file, hash), reader)
+			size += n
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return size, fmt.Errorf("failed to save file %s: %v", name, err)
+			}
+			sums[name] = hex.EncodeToString(hash.Sum(nil))
+		default:
+			return size, fmt.Errorf("unsupported archive entry %s", name)
+		}
+	}
+
+	if checksums == nil {
+		return size, fmt.Errorf("archive has no checksums, the download was interrupted")
+	}
+	if len(checksums) != len(sums) {
+		return size, fmt.Errorf("archive has %d files, checksums list %d", len(sums), len(checksums))
+	}
+	for name, sum := range sums {
+		if checksums[name] != sum {
+			return size, fmt.Errorf("checksum of %s does not match", name)
+		}
+	}
+	return size, nil
+}
+
+/*
+parseChecksums is a function to read the "<sha256> <path>" lines of the checksum record
+*/
+func parseChecksums(record string) (map[string]string, error) {
+	checksums := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(record, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, " ")
+		if !ok || len(sum) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid checksum line %q", line)
+		}
+		checksums[name] = sum
+	}
+	return checksums, nil
+}
+
+/*
+writeArchive is a function to write the files of dir as a tar archive read by extractArchive
+every file is hashed while it is written, the hashes are written in a PAX global header at the end
+*/
+func writeArchive(w io.Writer, dir string) error {
+	writer := tar.NewWriter(w)
+	var lines strings.Builder
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		name := filepath.ToSlash(rel)
+		if err := writer.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: info.Size()}); err != nil {
+			return err
+		}
+		hash := sha256.New()
+		if err := copyFile(io.MultiWriter(writer, hash), path); err != nil {
+			return err
+		}
+		fmt.Fprintf(&lines, "%s %s\n", hex.EncodeToString(hash.Sum(nil)), name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = writer.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		Name:       "checksums",
+		PAXRecords: map[string]string{checksumRecord: lines.String()},
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
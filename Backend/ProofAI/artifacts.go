@@ -0,0 +1,225 @@
+package main
+
+/*
+	In this file we keep the output artifacts of a transaction. The outputs declared in the job manifest are uploaded
+	through the content store of the node, the transaction only stores their CID and SHA-256 hash.
+	1-		Artifact is a struct to store an uploaded output.
+	2-		uploadArtifacts function which is used to upload the declared outputs of a job.
+	3-		handleDownloadArtifact function which is used to download an output of a transaction.
+	4-		openRegularFile and checkOutputPath functions which are used to read the files written by a job.
+	The job can write links in its output directory, so the node only reads regular files inside that directory:
+	a link to a file of the host would otherwise be read, uploaded and published by the node.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+/*
+Artifact is a struct to store an output of a transaction
+ 1. Name is the file name declared in the job manifest
+ 2. CID is the IPFS directory holding all outputs of the transaction, the file is at <CID>/<Name>
+ 3. SHA256 and Size let the user check the downloaded file
+*/
+type Artifact struct {
+	Name   string `json:"name"`
+	CID    string `json:"cid"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+/*
+uploadArtifacts is a function to upload the declared outputs of a job
+ 1. Hash every output
+ 2. Upload the outputs as one content through the content store of the node (see contentStore.go)
+ 3. Return an Artifact for every output, no request is sent if the job declares no outputs
+*/
+func uploadArtifacts(outputDir string, outputs []string, serviceMachineURl string) ([]Artifact, error) {
+	if len(outputs) == 0 {
+		return nil, nil
+	}
+
+	artifacts := make([]Artifact, 0, len(outputs))
+	for _, name := range outputs {
+		if err := checkOutputPath(outputDir, name); err != nil {
+			return nil, err
+		}
+		sum, size, err := hashFile(filepath.Join(outputDir, name))
+		if err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, Artifact{Name: name, SHA256: sum, Size: size})
+	}
+
+	cid, err := contentStoreFor(serviceMachineURl).Upload(outputDir, outputs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range artifacts {
+		artifacts[i].CID = cid
+	}
+	return artifacts, nil
+}
+
+/*
+hashFile is a function to get the SHA-256 hash and size of a regular file
+*/
+func hashFile(path string) (string, int64, error) {
+	hash := sha256.New()
+	size, err := copyFileSize(hash, path)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+/*
+copyFile is a function to copy the content of a regular file to w
+*/
+func copyFile(w io.Writer, path string) error {
+	_, err := copyFileSize(w, path)
+	return err
+}
+
+/*
+copyFileSize is a function to copy the content of a regular file to w and get the number of bytes copied
+*/
+func copyFileSize(w io.Writer, path string) (int64, error) {
+	file, err := openRegularFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open output %s: %v", filepath.Base(path), err)
+	}
+	defer file.Close()
+
+	size, err := io.Copy(w, file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read output %s: %v", filepath.Base(path), err)
+	}
+	return size, nil
+}
+
+/*
+openRegularFile is a function to open a file that is not a link, a directory or a device
+The file is checked with Lstat before it is opened and compared with the opened file, so a file replaced by a link
+in between is refused too
+*/
+func openRegularFile(path string) (*os.File, error) {
+	link, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !link.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", filepath.Base(path))
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil || !os.SameFile(link, info) {
+		file.Close()
+		return nil, fmt.Errorf("%s changed while it was opened", filepath.Base(path))
+	}
+	return file, nil
+}
+
+/*
+checkOutputPath is a function to check that the file name of a job stays inside its output directory once resolved
+*/
+func checkOutputPath(outputDir string, name string) error {
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("output %q is not inside the output directory", name)
+	}
+	dir, err := filepath.EvalSymlinks(outputDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the output directory: %v", err)
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(outputDir, name))
+	if err != nil {
+		return fmt.Errorf("failed to resolve output %s: %v", name, err)
+	}
+	if rel, err := filepath.Rel(dir, path); err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("output %s resolves outside the output directory", name)
+	}
+	return nil
+}
+
+/*
+  - handleDownloadArtifact downloads an output of a transaction
+    Input parameters : from address, nonce, name of the output
+    Output : the file, or an error response
+    logic : Find the transaction in the ledger, download the outputs (from the miners or the service machine)
+    and check the SHA-256 hash recorded in the transaction before sending the file.
+*/
+func handleDownloadArtifact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Get method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	from := r.URL.Query().Get("from")
+	nonce := r.URL.Query().Get("nonce")
+	name := r.URL.Query().Get("name")
+
+	var artifact *Artifact
+	for _, block := range chain.ledger.snapshot() {
+		for _, transaction := range block.Transactions {
+			if transaction.From != from || fmt.Sprint(transaction.Nonce) != nonce {
+				continue
+			}
+			for i := range transaction.Artifacts {
+				if transaction.Artifacts[i].Name == name {
+					artifact = &transaction.Artifacts[i]
+				}
+			}
+		}
+	}
+	if artifact == nil {
+		w.WriteHeader(http.StatusNotFound)
+		response := map[string]string{"error": "Artifact not found"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "ProofAI_artifact")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		response := map[string]string{"error": "Error creating temporary directory: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	if err := chain.fetchContent(artifact.CID, dir); err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		response := map[string]string{"error": "Error downloading artifact: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	path := filepath.Join(dir, artifact.Name)
+	if sum, _, err := hashFile(path); err != nil || sum != artifact.SHA256 {
+		w.WriteHeader(http.StatusBadGateway)
+		response := map[string]string{"error": "Downloaded artifact does not match its SHA-256 hash"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", artifact.Name))
+	http.ServeFile(w, r, path)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+writeHostSecret writes a file outside the output directory of a job, like a key file of the host
+*/
+func writeHostSecret(t *testing.T) string {
+	t.Helper()
+	secret := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(secret, []byte("private key of the host"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+func TestUploadArtifactsRefusesLinks(t *testing.T) {
+	secret := writeHostSecret(t)
+	outputDir := t.TempDir()
+	if err := os.Symlink(secret, filepath.Join(outputDir, "model.pt")); err != nil {
+		t.Skipf("symlinks are not available: %v", err)
+	}
+	// the upload fails before any request is sent to the service machine
+	if _, err := uploadArtifacts(outputDir, []string{"model.pt"}, "http://127.0.0.1:0"); err == nil {
+		t.Fatal("output linked to a file of the host was uploaded")
+	}
+	if _, _, err := hashFile(filepath.Join(outputDir, "model.pt")); err == nil {
+		t.Fatal("hashFile followed a link")
+	}
+}
+
+func TestHashFileRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "model.pt")
+	if err := os.WriteFile(path, []byte("weights"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum, size, err := hashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len("weights")) || len(sum) != 64 {
+		t.Fatalf("hashFile = %s, %d", sum, size)
+	}
+	if _, _, err := hashFile(filepath.Dir(path)); err == nil {
+		t.Fatal("hashFile read a directory")
+	}
+}
+
+func TestReadModelResultRefusesLinks(t *testing.T) {
+	secret := writeHostSecret(t)
+	jobDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(jobDir, "output"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(jobDir, "output", resultFile)); err != nil {
+		t.Skipf("symlinks are not available: %v", err)
+	}
+	_, _, err := readModelResult(jobDir, JobManifest{}, nil)
+	if err == nil {
+		t.Fatal("result file linked to a file of the host was read")
+	}
+	if strings.Contains(err.Error(), "private key") {
+		t.Fatalf("error leaks the content of the host file: %v", err)
+	}
+}
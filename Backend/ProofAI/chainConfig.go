@@ -0,0 +1,192 @@
+package main
+
+/*
+	In this file we check the configuration of the chain served by the service machine.
+	The service machine reads the chain from its chain config file and sends it with the hash of the configuration,
+	the node recomputes the hash, refuses a service machine or a miner with another configuration of the chain, and
+	mines and accepts blocks with the block policy and the proposers of the configuration.
+	1-		chainConfigHash function which is used to compute the hash of the configuration of the chain.
+	2-		checkChainConfig function which is used to check the configuration sent by the service machine.
+	3-		blockPolicy function which is used to get the transactions of a block and the time between two blocks.
+	4-		canPropose function which is used to check that a miner may propose blocks.
+	5-		checkBlockPolicy function which is used to check an incoming block against the configuration.
+	6-		genesisTime function which is used to get the time the chain starts, no block is mined or accepted before it.
+	7-		signBlock and verifyBlockProposer functions which are used to sign a block with the key of its proposer and to
+			check the signature, so the allowed proposers and the usage of the miners cannot be claimed by another miner.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Consensus engine run by the node
+const consensusPoW = "pow"
+
+// Block policy of the chains whose service machine has no chain config file
+const (
+	defaultMaxBlockTransactions = 2
+	defaultBlockInterval        = 2 * time.Minute
+)
+
+/*
+chainConfigHash is a function to compute the hash of the configuration of the chain
+The fields are joined with NUL bytes in the order used by the service machine
+*/
+func chainConfigHash(chainInfo ChainInfo) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{
+		chainInfo.ChainID,
+		strconv.Itoa(chainInfo.PowLen),
+		strconv.Itoa(chainInfo.Proof),
+		strconv.Itoa(chainInfo.MaxBlockTransactions),
+		chainInfo.BlockInterval,
+		chainInfo.Consensus,
+		strings.Join(chainInfo.AllowedProposers, ","),
+		chainInfo.GenesisTime,
+	}, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
+
+/*
+checkChainConfig is a function to check the configuration sent by the service machine
+Service machines without chain config file send no hash, their chain uses the default block policy
+*/
+func checkChainConfig(chainInfo ChainInfo) error {
+	if chainInfo.ConfigHash == "" {
+		return nil
+	}
+	if hash := chainConfigHash(chainInfo); hash != chainInfo.ConfigHash {
+		return fmt.Errorf("configuration of chain %s does not match its hash %s", chainInfo.ChainID, chainInfo.ConfigHash)
+	}
+	if chainInfo.Consensus != consensusPoW {
+		return fmt.Errorf("chain %s uses the consensus engine %q, the node only runs %q", chainInfo.ChainID, chainInfo.Consensus, consensusPoW)
+	}
+	if _, err := time.ParseDuration(chainInfo.BlockInterval); err != nil {
+		return fmt.Errorf("chain %s has an invalid block interval %q", chainInfo.ChainID, chainInfo.BlockInterval)
+	}
+	if _, err := time.Parse(time.RFC3339, chainInfo.GenesisTime); err != nil {
+		return fmt.Errorf("chain %s has an invalid genesis time %q", chainInfo.ChainID, chainInfo.GenesisTime)
+	}
+	return nil
+}
+
+/*
+blockPolicy returns the maximum number of transactions of a block and the time between two blocks of the chain
+*/
+func (sm *selfMiner) blockPolicy() (int, time.Duration) {
+	config := sm.getChainConfig()
+	maxTransactions, interval := defaultMaxBlockTransactions, defaultBlockInterval
+	if config.MaxBlockTransactions > 0 {
+		maxTransactions = config.MaxBlockTransactions
+	}
+	if duration, err := time.ParseDuration(config.BlockInterval); err == nil {
+		interval = duration
+	}
+	return maxTransactions, interval
+}
+
+/*
+canPropose returns true if the miner of pubKey may propose blocks, every miner may without allowed proposers
+*/
+func (sm *selfMiner) canPropose(pubKey string) bool {
+	config := sm.getChainConfig()
+	if len(config.AllowedProposers) == 0 {
+		return true
+	}
+	for _, proposer := range config.AllowedProposers {
+		if proposer == pubKey {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+genesisTime returns the time the chain starts, zero for chains without chain config file
+*/
+func (sm *selfMiner) genesisTime() time.Time {
+	genesis, err := time.Parse(time.RFC3339, sm.getChainConfig().GenesisTime)
+	if err != nil {
+		return time.Time{}
+	}
+	return genesis
+}
+
+/*
+checkBlockPolicy is a function to check that an incoming block follows the configuration of the chain
+ 1. The block is signed by its proposer
+ 2. The proposer is an allowed proposer of the chain
+ 3. The block has at most the transactions of a block of the chain and is not older than the genesis of the chain
+*/
+func (bf *ProofAIFactory) checkBlockPolicy(block *Block) error {
+	if err := verifyBlockProposer(block); err != nil {
+		return fmt.Errorf("block %d is not signed by its proposer %.16s: %v", block.BlockNum, block.ProposerId, err)
+	}
+	if !bf.selfMiningDetail.canPropose(block.ProposerId) {
+		return fmt.Errorf("block %d is proposed by %.16s, who is not an allowed proposer", block.BlockNum, block.ProposerId)
+	}
+	maxTransactions, _ := bf.selfMiningDetail.blockPolicy()
+	if len(block.Transactions) > maxTransactions {
+		return fmt.Errorf("block %d has %d transactions, the chain allows %d", block.BlockNum, len(block.Transactions), maxTransactions)
+	}
+	if genesis := bf.selfMiningDetail.genesisTime(); !genesis.IsZero() {
+		timeStamp, err := time.Parse(time.RFC3339, block.TimeStamp)
+		if err != nil || timeStamp.Before(genesis) {
+			return fmt.Errorf("block %d is dated %q, before the genesis of the chain %s", block.BlockNum, block.TimeStamp, genesis.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+/*
+blockProposerParts is a function to build the message signed by the proposer of a block
+The salt is left out, so the block is signed once before its Proof of Work
+*/
+func blockProposerParts(block *Block) ([]string, error) {
+	unsigned := *block
+	unsigned.Salt = ""
+	unsigned.ProposerSignature = ""
+	hash, err := hashStruct(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"block", hash}, nil
+}
+
+/*
+signBlock is a function to set the node as the proposer of a block and sign it, the block must not change afterwards
+except its salt
+*/
+func (sm *selfMiner) signBlock(block *Block) error {
+	pubKeyStr, prvKey := sm.identity()
+	if prvKey == nil {
+		return fmt.Errorf("login is required")
+	}
+	block.ProposerId = pubKeyStr
+	block.ProposerSignature = ""
+	parts, err := blockProposerParts(block)
+	if err != nil {
+		return err
+	}
+	block.ProposerSignature, err = signParts(prvKey, parts...)
+	return err
+}
+
+/*
+verifyBlockProposer is a function to check the signature of a block by the key of ProposerId
+*/
+func verifyBlockProposer(block *Block) error {
+	pubKey, err := hexToPublicKey(block.ProposerId)
+	if err != nil {
+		return err
+	}
+	parts, err := blockProposerParts(block)
+	if err != nil {
+		return err
+	}
+	return verifyParts(pubKey, block.ProposerSignature, parts...)
+}
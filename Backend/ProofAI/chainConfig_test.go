@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func signedTestBlock(t *testing.T, proposer *ProofAIFactory) *Block {
+	t.Helper()
+	block := &Block{ChainID: "test", BlockNum: 1, TimeStamp: time.Now().Format(time.RFC3339), Type: "block"}
+	if err := proposer.selfMiningDetail.signBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func TestSignBlockProvesProposer(t *testing.T) {
+	sm := newTestServiceMachine(t)
+	proposer, other := newTestNode(t, sm), newTestNode(t, sm)
+
+	block := signedTestBlock(t, proposer)
+	if err := verifyBlockProposer(block); err != nil {
+		t.Fatalf("signed block refused: %v", err)
+	}
+
+	// the Proof of Work only changes the salt
+	block.Salt = "00ff"
+	if err := verifyBlockProposer(block); err != nil {
+		t.Fatalf("block refused after a new salt: %v", err)
+	}
+
+	forged := *block
+	forged.ProposerId = other.selfMiningDetail.pubKeyStr
+	if err := verifyBlockProposer(&forged); err == nil {
+		t.Fatal("block with the proposer ID of another miner was accepted")
+	}
+
+	changed := *block
+	changed.BlockNum = 2
+	if err := verifyBlockProposer(&changed); err == nil {
+		t.Fatal("changed block was accepted")
+	}
+
+	unsigned := *block
+	unsigned.ProposerSignature = ""
+	if err := verifyBlockProposer(&unsigned); err == nil {
+		t.Fatal("unsigned block was accepted")
+	}
+}
+
+func TestCheckBlockPolicyAllowedProposers(t *testing.T) {
+	sm := newTestServiceMachine(t)
+	node, allowed, other := newTestNode(t, sm), newTestNode(t, sm), newTestNode(t, sm)
+	node.selfMiningDetail.setChainInfo("test", ChainInfo{ChainID: "test", AllowedProposers: []string{allowed.selfMiningDetail.pubKeyStr}})
+
+	if err := node.checkBlockPolicy(signedTestBlock(t, allowed)); err != nil {
+		t.Fatalf("block of an allowed proposer refused: %v", err)
+	}
+	if err := node.checkBlockPolicy(signedTestBlock(t, other)); err == nil {
+		t.Fatal("block of a miner that is not an allowed proposer was accepted")
+	}
+
+	// another miner claims the key of the allowed proposer
+	forged := signedTestBlock(t, other)
+	forged.ProposerId = allowed.selfMiningDetail.pubKeyStr
+	if err := node.checkBlockPolicy(forged); err == nil {
+		t.Fatal("block claiming an allowed proposer was accepted")
+	}
+}
+
+func TestGenesisTime(t *testing.T) {
+	sm := newTestServiceMachine(t)
+	node, proposer := newTestNode(t, sm), newTestNode(t, sm)
+	genesis := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	node.selfMiningDetail.setChainInfo("test", ChainInfo{ChainID: "test", GenesisTime: genesis.Format(time.RFC3339)})
+
+	if !node.selfMiningDetail.genesisTime().Equal(genesis) {
+		t.Fatalf("genesis time = %v, want %v", node.selfMiningDetail.genesisTime(), genesis)
+	}
+	if err := node.checkBlockPolicy(signedTestBlock(t, proposer)); err == nil {
+		t.Fatal("block dated before the genesis was accepted")
+	}
+
+	block := &Block{ChainID: "test", BlockNum: 1, TimeStamp: genesis.Add(time.Minute).Format(time.RFC3339)}
+	if err := proposer.selfMiningDetail.signBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.checkBlockPolicy(block); err != nil {
+		t.Fatalf("block dated after the genesis refused: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+/*
+	In this file we keep the chains the node takes part in. A chain is identified by the chain ID served by its service machine,
+	and every chain has its own ProofAIFactory with an isolated ledger, mempool and set of miners.
+	1. registerChain, unregisterChain: functions to add and remove a chain once its ID is known and checked by checkChainID
+	2. chainByID, joinedChains: functions to look up the joined chains
+	3. chainFromRequest: function to select the chain of an API request by its chainId parameter
+	4. handleGetChains, handleJoinChain, handleLeaveChain: REST API to list, join and leave chains
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+var (
+	chainsMu sync.RWMutex
+	chains   = make(map[string]*ProofAIFactory) // joined chains by chain ID
+)
+
+// chainIDPattern is the format of a chain ID, the chain ID is part of the name of the ledger file
+var chainIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+/*
+checkChainID is a function to refuse a chain ID that is not a safe file name part, like "../x" or "a/b"
+*/
+func checkChainID(chainID string) error {
+	if !chainIDPattern.MatchString(chainID) {
+		return fmt.Errorf("invalid chain ID %q, it must be 1 to 64 letters, digits, '.', '_' or '-' and start with a letter or digit", chainID)
+	}
+	return nil
+}
+
+/*
+legacyChainID is a function to build the chain ID of a service machine that does not send one
+It matches the ledger file name used before chain IDs: Transaction_<pow>_<blockLength>.json
+*/
+func legacyChainID(powLenght int, blockLength int) string {
+	return fmt.Sprintf("%d_%d", powLenght, blockLength)
+}
+
+/*
+registerChain is a function to add a chain to the joined chains
+returns an error for an invalid chain ID or if another session already takes part in the chain
+*/
+func registerChain(chainID string, chain *ProofAIFactory) error {
+	if err := checkChainID(chainID); err != nil {
+		return err
+	}
+	chainsMu.Lock()
+	defer chainsMu.Unlock()
+	if existing, ok := chains[chainID]; ok && existing != chain {
+		return fmt.Errorf("chain %s is already joined", chainID)
+	}
+	chains[chainID] = chain
+	return nil
+}
+
+/*
+unregisterChain is a function to remove a chain from the joined chains
+*/
+func unregisterChain(chain *ProofAIFactory) {
+	chainsMu.Lock()
+	defer chainsMu.Unlock()
+	for id, c := range chains {
+		if c == chain {
+			delete(chains, id)
+		}
+	}
+}
+
+/*
+chainByID is a function to get a joined chain by its ID, nil if the chain is not joined
+*/
+func chainByID(chainID string) *ProofAIFactory {
+	chainsMu.RLock()
+	defer chainsMu.RUnlock()
+	return chains[chainID]
+}
+
+/*
+joinedChains is a function to list the joined chains
+*/
+func joinedChains() []*ProofAIFactory {
+	chainsMu.RLock()
+	defer chainsMu.RUnlock()
+	list := make([]*ProofAIFactory, 0, len(chains))
+	for _, chain := range chains {
+		list = append(list, chain)
+	}
+	return list
+}
+
+/*
+chainFromRequest is a function to select the chain of an API request
+  - Without a chainId parameter the default chain (ProofAI) is used
+  - With an unknown chainId a 404 response is written and false is returned
+*/
+func chainFromRequest(w http.ResponseWriter, r *http.Request) (*ProofAIFactory, bool) {
+	chainID := r.URL.Query().Get("chainId")
+	if chainID == "" {
+		return ProofAI, true
+	}
+
+	chain := chainByID(chainID)
+	if chain == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		response := map[string]string{"error": "Chain not joined: " + chainID}
+		json.NewEncoder(w).Encode(response)
+		return nil, false
+	}
+	return chain, true
+}
+
+/*
+  - handleGetChains lists the joined chains
+    Output parameter : response
+*/
+func handleGetChains(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Get method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	list := []map[string]interface{}{}
+	for _, chain := range joinedChains() {
+		blockLength, powLenght := chain.selfMiningDetail.chainInfo()
+		latest, _ := chain.ledger.latest()
+		list = append(list, map[string]interface{}{
+			"chainId":          chain.selfMiningDetail.getChainID(),
+			"serviceMachineIP": chain.selfMiningDetail.serviceMachineURL(),
+			"blockLength":      blockLength,
+			"powLength":        powLenght,
+			"configHash":       chain.selfMiningDetail.getChainConfig().ConfigHash,
+			"height":           latest.BlockNum,
+			"peers":            len(chain.peers()),
+			"default":          chain == ProofAI,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i]["chainId"].(string) < list[j]["chainId"].(string)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	response := map[string]interface{}{"chains": list}
+	json.NewEncoder(w).Encode(response)
+}
+
+/*
+  - handleJoinChain joins the chain of another service machine with the keys of the logged in miner
+    Input parameter : ServiceMachineaddr
+    Output parameter : response
+    logic : The chain gets its own session, the chain ID is known once the service machine has answered the registration.
+*/
+func handleJoinChain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Post method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		response := map[string]string{"error": "Error parsing form data: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	ProofAI.selfMiningDetail.mu.Lock()
+	pubKey, prvKey := ProofAI.selfMiningDetail.pubKeyStr, ProofAI.selfMiningDetail.prvKeyStr
+	pubKeyDecoded, prvKeyDecoded := ProofAI.selfMiningDetail.pubKey, ProofAI.selfMiningDetail.prvKey
+	ProofAI.selfMiningDetail.mu.Unlock()
+	if pubKey == "" {
+		w.WriteHeader(http.StatusConflict)
+		response := map[string]string{"error": "No active session"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	serviceMachineAddr := r.FormValue("ServiceMachineaddr")
+	if serviceMachineAddr == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		response := map[string]string{"error": "ServiceMachineaddr is required"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	for _, chain := range append(joinedChains(), ProofAI) {
+		if chain.selfMiningDetail.serviceMachineURL() == "http://"+serviceMachineAddr {
+			w.WriteHeader(http.StatusConflict)
+			response := map[string]string{"error": "Chain of this service machine is already joined"}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+
+	chain := NewProofAIFactory()
+	chain.connectionPort = "0" // ports of additional chains are chosen by the operating system
+	chain.startPort = 0
+	chain.startSession(serviceMachineAddr, pubKey, prvKey, pubKeyDecoded, prvKeyDecoded)
+	go func() {
+		chain.establishConnection(chain.connectionPort)
+		// establishConnection only returns while the session is alive if joining failed
+		if chain.selfMiningDetail.isConnectionAlive() {
+			chain.closeSession()
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	response := map[string]string{"join": "Started"}
+	json.NewEncoder(w).Encode(response)
+}
+
+/*
+  - handleLeaveChain leaves a joined chain
+    Input parameter : chainId
+    Output parameter : response
+    logic : The default chain is left by logging out.
+*/
+func handleLeaveChain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Post method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if chain == ProofAI {
+		w.WriteHeader(http.StatusBadRequest)
+		response := map[string]string{"error": "The default chain is left by logging out"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain.closeSession()
+	w.WriteHeader(http.StatusOK)
+	response := map[string]string{"leave": "Success"}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+/*
+TestCheckChainID checks that chain IDs used in the ledger file name cannot leave the data directory
+*/
+func TestCheckChainID(t *testing.T) {
+	valid := []string{"1_4", "proofai-main", "Chain.2", "a", "0123456789012345678901234567890123456789012345678901234567890123"}
+	for _, chainID := range valid {
+		if err := checkChainID(chainID); err != nil {
+			t.Errorf("chain ID %q refused: %v", chainID, err)
+		}
+	}
+	invalid := []string{"", "../x", "a/b", `a\b`, ".hidden", "-a", "a b", "a\x00", "01234567890123456789012345678901234567890123456789012345678901234"}
+	for _, chainID := range invalid {
+		if err := checkChainID(chainID); err == nil {
+			t.Errorf("chain ID %q accepted", chainID)
+		}
+	}
+}
+
+/*
+TestApplyChainInfoRefusesUnsafeChainID checks that a service machine cannot make the node write outside its data directory
+*/
+func TestApplyChainInfoRefusesUnsafeChainID(t *testing.T) {
+	bf := NewProofAIFactory()
+	if err := bf.applyChainInfo(ChainInfo{ChainID: "../../etc/x"}); err == nil {
+		t.Fatal("unsafe chain ID joined")
+	}
+	if chainByID("../../etc/x") != nil || bf.selfMiningDetail.getChainID() != "" {
+		t.Fatal("unsafe chain ID registered")
+	}
+	if err := registerChain("a/b", bf); err == nil {
+		t.Fatal("registerChain accepted an unsafe chain ID")
+	}
+}
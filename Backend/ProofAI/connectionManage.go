@@ -7,21 +7,21 @@ package main
 	And after connection is established, miners create a new communication port for communication with each other.
 	1. MachineDetail: struct to store the details of a machine
 	2. ChainInfo: struct to store the chain information
-	3. getRadminIPv4: function to get the IPv4 address of the Radmin VPN
-	4. getRandomMiner: function to get a random miner from the service machine
-	5. registerMiner: function to register a miner with the service machine
-	6. establishConnection: function to establish a connection with the service machine
-	7. connectToMiner: function to connect to a miner
-	8. writeToConnection: function to write to a connection
-	9. handleConnection: function to handle a connection
+	3. getRandomMiner: function to get a random miner from the service machine
+	4. registerMiner: function to register a miner with the service machine
+	5. establishConnection: function to establish a connection with the service machine
+	6. connectToMiner: function to connect to a miner
+	7. acceptMiners: function to accept the connecting miners, acceptMiner: function to authenticate and accept a connecting miner
+	8. getChainInfo: function to get the chain information from the service machine
+	9. applyChainInfo: function to check the chain configuration, set the chain of the session and register it with the joined chains
 
 */
 
 import (
-	"bytes"
 	"crypto/ecdsa"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
@@ -38,64 +38,39 @@ type MachineDetail struct {
 	IP        string    `json:"ip"`
 	Port      string    `json:"port"`
 	PubKey    string    `json:"pubKey"`
+	Role      string    `json:"role,omitempty"`
+	Height    int       `json:"height"`
 	Timestamp time.Time `json:"timestamp"`
+	State     string    `json:"state,omitempty"`
 }
 
 /*
-ChainInfo is a struct to store the chain information
+ChainInfo is a struct to store the chain information, read by the service machine from its chain config file
+ChainID is empty for service machines started before chain IDs, legacyChainID is used for them
+ConfigHash is empty for service machines started before the chain config file (see chainConfig.go)
 */
 type ChainInfo struct {
-	PowLen int `json:"powLen"`
-	Proof  int `json:"proof"`
-}
-
-/*
-getRadminIPv4 is a function to get the IPv4 address of the Radmin VPN
- 1. Get the network interfaces
- 2. Check if the interface name contains "Radmin"
- 3. Get the IP address
- 4. Return the IPv4 address
-    And it use to make machine publicaly available
-*/
-func getRadminIPv4() (string, error) {
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		return "", fmt.Errorf("failed to get network interfaces: %v", err)
-	}
-
-	for _, iface := range interfaces {
-
-		if strings.Contains(iface.Name, "Radmin") {
-			addrs, err := iface.Addrs()
-			if err != nil {
-				continue
-			}
-			for _, addr := range addrs {
-				ipNet, ok := addr.(*net.IPNet)
-				if !ok {
-					continue
-				}
-
-				ipv4 := ipNet.IP.To4()
-				if ipv4 != nil {
-					return ipv4.String(), nil
-				}
-			}
-		}
-	}
-	return "", fmt.Errorf("RadminVPN IPv4 address not found")
+	ChainID              string   `json:"chainId"`
+	PowLen               int      `json:"powLen"`
+	Proof                int      `json:"proof"`
+	MaxBlockTransactions int      `json:"maxBlockTransactions"`
+	BlockInterval        string   `json:"blockInterval"`
+	Consensus            string   `json:"consensus"`
+	AllowedProposers     []string `json:"allowedProposers"`
+	GenesisTime          string   `json:"genesisTime"`
+	ConfigHash           string   `json:"configHash"`
 }
 
 /*
 getRandomMiner is a function to get a random miner from the service machine
- 1. Send a GET request to the service machine to get the list of miners
+ 1. Send a GET request to the service machine to get the list of live miners
  2. Decode the response
  3. Select a random miner , initialy it will be one of the miner from the list
  4. Convert the public key string to *ecdsa.PublicKey
  5. Return the IP address, public key, and error
 */
 func getRandomMiner(serverURL string) (string, *ecdsa.PublicKey, error) {
-	resp, err := http.Get(serverURL + "/machines")
+	resp, err := http.Get(serverURL + "/machines?state=live")
 	if err != nil {
 		return "", nil, fmt.Errorf("failed to fetch miners: %v", err)
 	}
@@ -126,72 +101,131 @@ func getRandomMiner(serverURL string) (string, *ecdsa.PublicKey, error) {
 /*
 registerMiner is a function to register a miner with the service machine
 1. Create a MachineDetail object
-2. Marshal the object to JSON
+2. Sign it with a nonce of the service machine (see minerAuth.go)
 3. Send a POST request to the service machine to register the miner
 4. Check the response status code
 5. Return an error if any
 */
-func registerMiner(serverURL, ip, port, pubKeyStr string) error {
+func (bf *ProofAIFactory) registerMiner(serverURL, ip, port string) error {
 	machine := MachineDetail{
-		IP:     ip,
-		Port:   port,
-		PubKey: pubKeyStr,
+		IP:   ip,
+		Port: port,
 	}
 
-	jsonData, err := json.Marshal(machine)
+	pubKeyStr, prvKey := bf.selfMiningDetail.identity()
+	request, err := newMinerRequest(serverURL, pubKeyStr, prvKey, "register", machine, ip, port)
 	if err != nil {
-		return fmt.Errorf("failed to marshal machine data: %v", err)
+		return fmt.Errorf("failed to sign the registration: %v", err)
 	}
 
-	resp, err := http.Post(serverURL+"/machine", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := postMinerRequest(serverURL, "/machine", request)
 	if err != nil {
 		return fmt.Errorf("failed to register miner: %v", err)
 	}
 
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("server returned status: %d %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
 	var chainInfo ChainInfo
 	err = json.NewDecoder(resp.Body).Decode(&chainInfo)
 	if err != nil {
 		return fmt.Errorf("failed to decode response of Service Machine to Set ChainInfo : %v", err)
 	}
 
-	ProofAI.selfMiningDetail.blockLength = chainInfo.PowLen
-	ProofAI.selfMiningDetail.powLenght = chainInfo.Proof
+	bf.selfMiningDetail.setAdvertisedAddress(ip, port)
+	return bf.applyChainInfo(chainInfo)
+}
+
+/*
+getChainInfo is a function to get the chain information from the service machine
+returns an error for service machines without the /chain endpoint, registerMiner sets the chain information for them
+*/
+func getChainInfo(serverURL string) (ChainInfo, error) {
+	var chainInfo ChainInfo
 
+	resp, err := http.Get(serverURL + "/chain")
+	if err != nil {
+		return chainInfo, fmt.Errorf("failed to fetch chain information: %v", err)
+	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("server returned status: %d", resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		return chainInfo, fmt.Errorf("server returned status: %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&chainInfo); err != nil {
+		return chainInfo, fmt.Errorf("failed to decode chain information: %v", err)
+	}
+	return chainInfo, nil
+}
+
+/*
+applyChainInfo is a function to set the chain of the session
+1. Use the legacy chain ID if the service machine does not send one
+2. Refuse a service machine that switches to another chain during the session
+3. Register the chain and read its ledger the first time
+*/
+func (bf *ProofAIFactory) applyChainInfo(chainInfo ChainInfo) error {
+	chainID := chainInfo.ChainID
+	if chainID == "" {
+		chainID = legacyChainID(chainInfo.Proof, chainInfo.PowLen)
+	}
+
+	if err := checkChainID(chainID); err != nil {
+		return err
 	}
+	if err := checkChainConfig(chainInfo); err != nil {
+		return err
+	}
+	if current := bf.selfMiningDetail.getChainID(); current != "" && current != chainID {
+		return fmt.Errorf("service machine moved from chain %s to chain %s", current, chainID)
+	}
+	if current := bf.selfMiningDetail.getChainConfig().ConfigHash; current != "" && current != chainInfo.ConfigHash {
+		return fmt.Errorf("configuration of chain %s changed from %s to %s", chainID, current, chainInfo.ConfigHash)
+	}
+	if err := registerChain(chainID, bf); err != nil {
+		return err
+	}
+	bf.selfMiningDetail.setChainInfo(chainID, chainInfo)
 
-	if !ProofAI.selfMiningDetail.readLedger {
-		ReadAndWriteMemoryTransaction()
-		ProofAI.selfMiningDetail.readLedger = true
+	if !bf.selfMiningDetail.readLedger {
+		bf.ReadAndWriteMemoryTransaction()
+		bf.selfMiningDetail.readLedger = true
 	}
 	return nil
 }
 
 /*
 establishConnection is a function to establish a connection with the service machine
-1. Get the machine IP
-2. Get a random miner
-3. Connect to the miner
-4. Listen for incoming connections
-5. Register the miner with the service machine
-6. Accept incoming connections
-7. Establish communication connection
-8. Read transactions
-9. Write to connection
+1. Get the advertised machine IP
+2. Get the chain information
+3. Get a random miner
+4. Connect to the miner
+5. Listen for incoming connections (port "0" lets the operating system choose the port)
+6. Register the miner with the service machine, the heartbeats keep it registered afterwards
+7. Accept incoming connections (see acceptMiners)
 */
-func establishConnection(port string) {
+func (bf *ProofAIFactory) establishConnection(port string) {
+
+	serviceMachineURl := bf.selfMiningDetail.serviceMachineURL()
 
-	machineIP, err := getRadminIPv4()
+	machineIP, err := advertiseAddress(serviceMachineURl)
 	if err != nil {
 		fmt.Printf("Error getting machine IP: %v\n", err)
 		return
 	}
 	machineIP = strings.ReplaceAll(machineIP, "\n", "")
 
-	serviceMachineURl := "http://" + ProofAI.selfMiningDetail.serviceMachineAddr
+	if chainInfo, err := getChainInfo(serviceMachineURl); err == nil {
+		if err := bf.applyChainInfo(chainInfo); err != nil {
+			log.Printf("Error joining chain: %v\n", err)
+			return
+		}
+	}
 
 	baseMiner, minerPubkey, err := getRandomMiner(serviceMachineURl)
 	if err != nil {
@@ -200,185 +234,153 @@ func establishConnection(port string) {
 	}
 
 	if len(baseMiner) != 0 {
-		connectToMiner(baseMiner, minerPubkey)
+		bf.connectToMiner(baseMiner, minerPubkey)
 	}
 
-	IP := "0.0.0.0"
-	ln, err := net.Listen("tcp", IP+":"+port)
-	ProofAI.selfMiningDetail.connListen = ln
-
+	IP := bindAddress()
+	ln, err := net.Listen("tcp", net.JoinHostPort(IP, port))
 	if err != nil {
 		log.Fatalf("Error listening: %v", err)
 	}
+	bf.selfMiningDetail.setListener(ln)
 	defer ln.Close()
+	_, port, _ = net.SplitHostPort(ln.Addr().String())
 
-	for {
-
-		publicIP := machineIP
-		publicIP = strings.ReplaceAll(publicIP, "\n", "")
-		if err != nil {
-			fmt.Printf("Error getting public IP %v\n", err)
-			return
-		}
+	err = bf.registerMiner(serviceMachineURl, machineIP, port)
+	if err != nil {
+		log.Printf("Error registering with the service machine: %v\n", err)
+		return
+	}
 
-		err = registerMiner(serviceMachineURl, publicIP, port, ProofAI.selfMiningDetail.pubKeyStr)
-		if err != nil {
-			return
-		}
+	bf.acceptMiners(ln, IP)
+}
 
+/*
+acceptMiners is a function to accept the miners connecting to the listener until it is closed
+Every connection is authenticated in its own goroutine, so a miner that does not answer the handshake does not block
+the others
+*/
+func (bf *ProofAIFactory) acceptMiners(ln net.Listener, IP string) {
+	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			log.Printf("Error accepting connection: %v\n", err)
 			return
-		} else {
-
-			fmt.Printf("\n\n")
-			miner := newMiner(conn)
-
-			addr := miner.conn.RemoteAddr().String()
-			parts := strings.Split(addr, ":")
-
-			minerPubkey, err := getPubKeyofIP(serviceMachineURl, parts[0])
-			miner.pubKey = minerPubkey
-
-			parts[1] = strconv.Itoa(ProofAI.startPort)
-			parts[0] = "0.0.0.0"
-
-			commLn, err := net.Listen("tcp", parts[0]+":"+parts[1])
-			if err != nil {
-				log.Printf("Error creating communication port for : %s at port: %s \n ", parts[0], parts[1])
-			} else {
-
-				go func() {
-					commConn, err := commLn.Accept()
-					if err != nil {
-						log.Printf("Error establishing communication connection with: %s at port: %s ", parts[0], parts[1])
-						return
-					} else {
-						miner.conn = commConn
-						ProofAI.Miners = append(ProofAI.Miners, *miner)
-						go readTransaction(miner)
-						ProofAI.startPort++
-					}
-				}()
-				writeToConnection(miner, parts[1])
-			}
 		}
+		fmt.Printf("\n\n")
+		go bf.acceptMiner(conn, IP)
 	}
-
 }
 
 /*
-connectToMiner is a function to connect to a miner
-1. Dial the connection
-2. Read the communication port
-3. Parse the address for communication connection
-4. Establish the communication connection
-5. Read transactions
+acceptMiner is a function to accept a miner connecting to the node
+1. Create the communication port
+2. Authenticate the miner with the handshake (see peerAuth.go), refuse banned and unregistered miners
+3. Accept the communication connection
+4. Read transactions
 */
-func connectToMiner(baseMiner string, minerPubkey *ecdsa.PublicKey) {
-
-	conn, err := net.Dial("tcp", baseMiner)
-
-	if err != nil {
-		log.Printf("Error connecting to %s: %v\n", baseMiner, err)
-		return
-	}
-
-	fmt.Println("Connection established with", baseMiner)
-	miner := newMiner(conn)
-	miner.pubKey = minerPubkey
+func (bf *ProofAIFactory) acceptMiner(conn net.Conn, IP string) {
+	miner := newMiner(conn, "inbound")
+	addr := conn.RemoteAddr().String()
 
-	communicationPort, err := miner.read.ReadString('\n')
+	commLn, err := bf.listenCommunication(IP)
 	if err != nil {
-		log.Printf("Error reading from %s: %v", miner.conn.RemoteAddr(), err)
+		log.Printf("Error creating communication port for : %s: %v\n", IP, err)
+		conn.Close()
 		return
 	}
-	communicationPort = strings.TrimSpace(communicationPort)
+	_, communicationPort, _ := net.SplitHostPort(commLn.Addr().String())
 
-	parts := strings.Split(baseMiner, ":")
-	commAddress := fmt.Sprintf("%s:%s", parts[0], communicationPort)
-	fmt.Println(commAddress)
-
-	conn, err = net.Dial("tcp", commAddress)
+	minerPubkey, err := bf.acceptHandshake(miner, communicationPort)
 	if err != nil {
-		log.Printf("Error establishing communication connection with %s at port %s: %v\n",
-			parts[0], communicationPort, err)
+		log.Printf("Rejected connection from %s: %v\n", addr, err)
+		commLn.Close()
+		conn.Close()
 		return
 	}
+	miner.pubKey = minerPubkey
 
-	miner.conn = conn
-	fmt.Printf("Connection established: %s for communication on port %v\n",
-		conn.RemoteAddr(), communicationPort)
-
-	go readTransaction(miner)
-	ProofAI.Miners = append(ProofAI.Miners, *miner)
+	go func() {
+		defer commLn.Close()
+		commConn, err := commLn.Accept()
+		if err != nil {
+			log.Printf("Error establishing communication connection with: %s at port: %s ", IP, communicationPort)
+			return
+		}
+		miner.conn = commConn
+		bf.addMiner(miner)
+		go bf.readTransaction(miner)
+	}()
 }
 
 /*
-writeToConnection is a function to write to a connection
-1. Write the message to the connection
-2. Log any errors
+listenCommunication is a function to listen on the next communication port, startPort 0 lets the operating system
+choose the port
 */
-func writeToConnection(miner *Miner, message string) {
-	message = strings.TrimSpace(message) + "\n"
-	_, err := miner.conn.Write([]byte(message))
+func (bf *ProofAIFactory) listenCommunication(IP string) (net.Listener, error) {
+	bf.portMu.Lock()
+	defer bf.portMu.Unlock()
+	commLn, err := net.Listen("tcp", net.JoinHostPort(IP, strconv.Itoa(bf.startPort)))
 	if err != nil {
-		log.Printf("Error writing to client %s: %v \n", miner.conn.RemoteAddr(), err)
-		return
+		return nil, err
 	}
+	if bf.startPort != 0 {
+		bf.startPort++
+	}
+	return commLn, nil
 }
 
 /*
-handleConnection is a function to handle a connection
-1. Close the connection when the function returns
-2. Create a new miner
-3. Get the IP address of the miner
-4. Get the public key of the miner
-5. Set the public key of the miner
-6. Create a communication port
-7. Accept incoming connections
-8. Establish a communication connection
-9. Read transactions
-10. Append the miner to the list of miners
-11. Increment the starting port
+connectToMiner is a function to connect to a miner
+ 1. Refuse banned miners
+ 2. Dial the connection
+ 3. Authenticate the miner with the handshake (see peerAuth.go), minerPubkey is the expected key of the miner, nil
+    accepts any registered key
+ 4. Refuse a miner of another chain or of another configuration of the chain
+ 5. Parse the address for communication connection
+ 6. Establish the communication connection
+ 7. Read transactions
 */
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
+func (bf *ProofAIFactory) connectToMiner(baseMiner string, minerPubkey *ecdsa.PublicKey) error {
 
-	miner := newMiner(conn)
-	addr := miner.conn.RemoteAddr().String()
-	parts := strings.Split(addr, ":")
+	if bf.isBanned(publicKeyToHex(minerPubkey)) {
+		return fmt.Errorf("miner %s is banned", baseMiner)
+	}
 
-	serviceMachineURl := "http://" + ProofAI.selfMiningDetail.serviceMachineAddr
+	conn, err := net.Dial("tcp", baseMiner)
 
-	minerPubkey, err := getPubKeyofIP(serviceMachineURl, parts[0])
 	if err != nil {
-		log.Printf("Error getting public key: %v\n", err)
-		return
+		log.Printf("Error connecting to %s: %v\n", baseMiner, err)
+		return err
 	}
-	miner.pubKey = minerPubkey
 
-	parts[1] = strconv.Itoa(ProofAI.startPort)
-	parts[0] = "0.0.0.0"
+	fmt.Println("Connection established with", baseMiner)
+	miner := newMiner(conn, "outbound")
 
-	commLn, err := net.Listen("tcp", parts[0]+":"+parts[1])
+	communicationPort, provenKey, err := bf.dialHandshake(miner, minerPubkey)
 	if err != nil {
-		log.Printf("Error creating communication port for: %s at port: %s\n", parts[0], parts[1])
-		return
+		conn.Close()
+		return fmt.Errorf("handshake with miner %s failed: %v", baseMiner, err)
 	}
-	defer commLn.Close()
+	miner.pubKey = provenKey
+
+	parts := strings.Split(baseMiner, ":")
+	commAddress := net.JoinHostPort(parts[0], communicationPort)
+	fmt.Println(commAddress)
 
-	commConn, err := commLn.Accept()
+	commConn, err := net.Dial("tcp", commAddress)
 	if err != nil {
-		log.Printf("Error establishing communication connection with: %s at port: %s\n", parts[0], parts[1])
-		return
+		log.Printf("Error establishing communication connection with %s at port %s: %v\n",
+			parts[0], communicationPort, err)
+		conn.Close()
+		return err
 	}
-	defer commConn.Close()
 
 	miner.conn = commConn
-	ProofAI.Miners = append(ProofAI.Miners, *miner)
+	fmt.Printf("Connection established: %s for communication on port %v\n",
+		commConn.RemoteAddr(), communicationPort)
 
-	go readTransaction(miner)
-	ProofAI.startPort++
+	bf.addMiner(miner)
+	go bf.readTransaction(miner)
+	return nil
 }
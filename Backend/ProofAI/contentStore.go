@@ -0,0 +1,184 @@
+package main
+
+/*
+	In this file we fetch and upload the datasets, models and outputs of the transactions through a ContentStore.
+	By default the content goes through the service machine of the chain, which keeps it in its own store (IPFS, a
+	directory or S3). Offline labs can instead share the directory of a service machine using the fs store with the
+	miners, the miners then read and write it directly. Content in a directory is addressed by the hash of its files
+	(see hashDir), so a fetched content is checked against its ID.
+	1-		ContentStore is the interface of the ways content is fetched and uploaded.
+	2-		contentStoreFor function which is used to get the store of the node configuration.
+	3-		serviceMachineStore goes through the /fetch/archive and /upload endpoints of the service machine.
+	4-		localContentStore reads and writes a content directory shared with the service machine.
+	The content is downloaded with fetchContent, which first asks the other miners (see peerContent.go).
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+/*
+ContentStore is the interface of the ways content is fetched and uploaded
+  - Fetch writes the files of cid to outputDir, keeping its directories
+  - Upload stores the files names of dir as one content and returns its ID
+*/
+type ContentStore interface {
+	Fetch(cid string, outputDir string) error
+	Upload(dir string, names []string) (string, error)
+}
+
+/*
+contentStoreFor is a function to get the ContentStore of the node configuration for the chain of serviceMachineURl
+*/
+func contentStoreFor(serviceMachineURl string) ContentStore {
+	if nodeConfig.ContentStore == "fs" {
+		return localContentStore{root: nodeConfig.ContentDir}
+	}
+	return serviceMachineStore{url: serviceMachineURl}
+}
+
+/*
+serviceMachineStore is a ContentStore going through the service machine at url
+*/
+type serviceMachineStore struct {
+	url string
+}
+
+/*
+Fetch requests the tar archive of the CID from the service machine and extracts it while it is downloaded,
+the checksums of the files are checked (see archive.go)
+*/
+func (s serviceMachineStore) Fetch(cid string, outputDir string) error {
+	resp, err := http.PostForm(s.url+"/fetch/archive", url.Values{"cid": {cid}})
+	if err != nil {
+		return fmt.Errorf("failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("server returned status: %d %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	if _, err := extractArchive(resp.Body, outputDir, 0); err != nil {
+		return fmt.Errorf("failed to download %s: %v", cid, err)
+	}
+	return nil
+}
+
+/*
+Upload streams the files as one multipart request to the /upload endpoint of the service machine
+*/
+func (s serviceMachineStore) Upload(dir string, names []string) (string, error) {
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		for _, name := range names {
+			part, err := form.CreateFormFile("files", name)
+			if err == nil {
+				err = copyFile(part, filepath.Join(dir, name))
+			}
+			if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+		writer.CloseWithError(form.Close())
+	}()
+
+	resp, err := http.Post(s.url+"/upload", form.FormDataContentType(), body)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload outputs: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("server returned status: %d %s", resp.StatusCode, message)
+	}
+
+	var response Response
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("failed to decode response: %v", err)
+	}
+	if !response.Success || response.Message == "" {
+		return "", fmt.Errorf("server error: %s", response.Message)
+	}
+	return response.Message, nil
+}
+
+// contentIDPattern is the format of the IDs of content kept in a directory
+var contentIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+/*
+localContentStore is a ContentStore keeping every content in the directory <root>/<ID>, the layout of the fs store
+of the service machine
+*/
+type localContentStore struct {
+	root string
+}
+
+/*
+Fetch copies the content to outputDir and checks that its files still hash to its ID
+*/
+func (s localContentStore) Fetch(cid string, outputDir string) error {
+	if !contentIDPattern.MatchString(cid) {
+		return fmt.Errorf("invalid content ID %q", cid)
+	}
+	dir := filepath.Join(s.root, cid)
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("content %s not found", cid)
+	}
+	if err := os.CopyFS(outputDir, os.DirFS(dir)); err != nil {
+		return fmt.Errorf("failed to copy content %s: %v", cid, err)
+	}
+	if sum, err := hashDir(outputDir); err != nil || sum != cid {
+		return fmt.Errorf("content %s does not match its ID", cid)
+	}
+	return nil
+}
+
+/*
+Upload copies the files to a temporary directory of the store and renames it to the ID of the content
+*/
+func (s localContentStore) Upload(dir string, names []string) (string, error) {
+	temp, err := os.MkdirTemp(s.root, ".add-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create directory in %s: %v", s.root, err)
+	}
+	defer os.RemoveAll(temp)
+
+	for _, name := range names {
+		file, err := os.Create(filepath.Join(temp, name))
+		if err != nil {
+			return "", fmt.Errorf("failed to save %s: %v", name, err)
+		}
+		err = copyFile(file, filepath.Join(dir, name))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	cid, err := hashDir(temp)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(temp, filepath.Join(s.root, cid)); err != nil {
+		if _, statErr := os.Stat(filepath.Join(s.root, cid)); statErr != nil {
+			return "", fmt.Errorf("failed to store content %s: %v", cid, err)
+		}
+	}
+	return cid, nil
+}
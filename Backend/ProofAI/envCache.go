@@ -0,0 +1,267 @@
+package main
+
+/*
+	In this file we cache the prepared Python environments of the executors, so the dependencies of a model are
+	installed once and reused by the next transactions with the same requirements.
+	An environment is a directory <cache dir>/<key>, the key is the hash of everything that changes the environment
+	(executor, python version or image, content of the requirements file, wheelhouse). The file .ready marks a finished
+	environment and its modification time is the last use, the least recently used environments are removed when the
+	cache is larger than its size limit. Environments in use are never removed.
+	1-		EnvCache is a struct to store the cache.
+	2-		newEnvCache function which is used to create the cache of the node configuration.
+	3-		environmentKey function which is used to compute the key of an environment.
+	4-		acquire function which is used to get an environment, building it if it is not cached.
+	5-		lockKey function which is used to serialise the builds of an environment.
+	6-		pipInstallArgs function which is used to build the pip arguments, with the wheelhouse for offline installs.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// envCache is the environment cache of the node, nil when caching is disabled, created once in main
+var envCache *EnvCache
+
+/*
+EnvCache is a struct to store the environment cache
+  - mu guards keyLocks and inUse
+  - keyLocks makes sure one environment is built only once at a time, a lock is removed when no acquire holds or
+    waits for it
+  - inUse counts the executions using an environment, a key is removed when its count drops to 0
+*/
+type EnvCache struct {
+	dir      string
+	limit    int64
+	mu       sync.Mutex
+	keyLocks map[string]*keyLock
+	inUse    map[string]int
+}
+
+/*
+keyLock is a struct to serialise the builds of one environment
+refs counts the acquires holding or waiting for the lock
+*/
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+/*
+newEnvCache is a function to create the environment cache of the node configuration
+returns nil if the cache size is 0
+*/
+func newEnvCache(config NodeConfig) (*EnvCache, error) {
+	if config.EnvCacheSize == "0" {
+		return nil, nil
+	}
+	limit, err := parseMemory(config.EnvCacheSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid environment cache size %q", config.EnvCacheSize)
+	}
+
+	dir := config.EnvCacheDir
+	if dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the user cache directory: %v", err)
+		}
+		dir = filepath.Join(cacheDir, "ProofAI", "environments")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create environment cache %s: %v", dir, err)
+	}
+
+	return &EnvCache{dir: dir, limit: limit, keyLocks: make(map[string]*keyLock), inUse: make(map[string]int)}, nil
+}
+
+/*
+environmentKey is a function to compute the key of an environment from everything that changes it
+*/
+func environmentKey(parts ...string) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:32]
+}
+
+/*
+acquire is a function to get the environment of key
+ 1. Without a cache the environment is built in fallbackDir
+ 2. A ready environment is reused and marked as used now
+ 3. Otherwise it is built with build, a failed build is removed
+ 4. release must be called when the execution no longer uses the environment
+*/
+func (c *EnvCache) acquire(key string, fallbackDir string, build func(dir string) error) (string, func(), bool, error) {
+	if c == nil {
+		if err := os.MkdirAll(fallbackDir, 0755); err != nil {
+			return "", nil, false, err
+		}
+		if err := build(fallbackDir); err != nil {
+			return "", nil, false, err
+		}
+		return fallbackDir, func() {}, false, nil
+	}
+
+	c.mu.Lock()
+	c.inUse[key]++
+	c.mu.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			c.mu.Lock()
+			c.inUse[key]--
+			if c.inUse[key] == 0 {
+				delete(c.inUse, key)
+			}
+			c.mu.Unlock()
+		})
+	}
+
+	unlock := c.lockKey(key)
+	defer unlock()
+
+	dir := filepath.Join(c.dir, key)
+	ready := filepath.Join(dir, ".ready")
+	if _, err := os.Stat(ready); err == nil {
+		now := time.Now()
+		os.Chtimes(ready, now, now)
+		return dir, release, true, nil
+	}
+
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		release()
+		return "", nil, false, err
+	}
+	if err := build(dir); err != nil {
+		os.RemoveAll(dir)
+		release()
+		return "", nil, false, err
+	}
+	if err := os.WriteFile(ready, nil, 0644); err != nil {
+		release()
+		return "", nil, false, err
+	}
+
+	c.evict()
+	return dir, release, false, nil
+}
+
+/*
+lockKey is a function to lock the environment of key, the returned function unlocks it
+*/
+func (c *EnvCache) lockKey(key string) func() {
+	c.mu.Lock()
+	lock, ok := c.keyLocks[key]
+	if !ok {
+		lock = &keyLock{}
+		c.keyLocks[key] = lock
+	}
+	lock.refs++
+	c.mu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+		c.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(c.keyLocks, key)
+		}
+		c.mu.Unlock()
+	}
+}
+
+/*
+evict is a function to remove the least recently used environments until the cache fits in its size limit
+environments in use or being built are kept
+*/
+func (c *EnvCache) evict() {
+	type environment struct {
+		key  string
+		size int64
+		used time.Time
+	}
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+
+	var environments []environment
+	var total int64
+	for _, entry := range entries {
+		dir := filepath.Join(c.dir, entry.Name())
+		size := dirSize(dir)
+		total += size
+
+		info, err := os.Stat(filepath.Join(dir, ".ready"))
+		if err != nil {
+			continue
+		}
+		environments = append(environments, environment{key: entry.Name(), size: size, used: info.ModTime()})
+	}
+	sort.Slice(environments, func(i, j int) bool {
+		return environments[i].used.Before(environments[j].used)
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, env := range environments {
+		if total <= c.limit {
+			return
+		}
+		if c.inUse[env.key] > 0 {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(c.dir, env.key)); err != nil {
+			fmt.Printf("Error removing cached environment %s: %v\n", env.key, err)
+			continue
+		}
+		total -= env.size
+		fmt.Printf("Cached environment %s removed\n", env.key)
+	}
+}
+
+/*
+dirSize is a function to get the size of the files in a directory
+*/
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+/*
+pipInstallArgs is a function to build the arguments of pip install
+  - with a wheelhouse the packages are installed from it only, so the install works offline
+  - target installs into a directory instead of the running environment, empty for a virtual environment
+*/
+func pipInstallArgs(requirements string, wheelhouse string, target string) []string {
+	args := []string{"-m", "pip", "install", "--no-cache-dir", "-r", requirements}
+	if wheelhouse != "" {
+		args = append(args, "--no-index", "--find-links", wheelhouse)
+	}
+	if target != "" {
+		args = append(args, "--target", target)
+	}
+	return args
+}
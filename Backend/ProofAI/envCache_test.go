@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+/*
+TestEnvCacheForgetsUnusedKeys checks that the locks and use counts of the environments do not grow with every key
+*/
+func TestEnvCacheForgetsUnusedKeys(t *testing.T) {
+	dir := t.TempDir()
+	cache := &EnvCache{dir: dir, limit: 1 << 30, keyLocks: make(map[string]*keyLock), inUse: make(map[string]int)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := environmentKey("test", string(rune('a'+i%4)))
+			_, release, _, err := cache.acquire(key, filepath.Join(dir, "fallback"), func(string) error { return nil })
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			release()
+		}(i)
+	}
+	wg.Wait()
+
+	if len(cache.keyLocks) != 0 || len(cache.inUse) != 0 {
+		t.Fatalf("cache keeps %d locks and %d use counts after every release", len(cache.keyLocks), len(cache.inUse))
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+/*
+	In this file we execute the model of a transaction. The dataset and model are downloaded to dirPath/dataset and dirPath/model
+	before an Executor runs the entrypoint of the job manifest, the outputs are written to dirPath/output.
+	The Executor is selected by the executor setting of the node.
+	1-		Executor is the interface of the ways a model can be executed.
+	2-		newExecutor function which is used to create the Executor of the node configuration.
+	3-		venvExecutor runs the model in a virtual environment on the host (no isolation, for trusted chains only).
+	4-		containerExecutor runs the model in an OCI container: read-only dataset, writable job directory,
+			no network after the dependencies are installed, and CPU and memory limits.
+	Every execution is bound to a context, when it ends the whole process tree (or the container) is killed.
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+/*
+Executor is the interface of the ways a model can be executed
+  - Execute runs the entrypoint of manifest from dirPath/model and returns the output of the script,
+    the script finds the path of its result file in the PROOFAI_RESULT environment variable (see result.go)
+  - The CPU time and peak memory of the script are returned as its usage (see usage.go)
+  - Every step is logged with logger, the log is given to the user with the transaction
+  - The execution stops when ctx ends, the error then wraps ctx.Err()
+*/
+type Executor interface {
+	Execute(ctx context.Context, dirPath string, manifest JobManifest, logger *log.Logger) ([]byte, ResourceUsage, error)
+}
+
+/*
+newExecutor is a function to create the Executor of the node configuration
+returns an error for an unknown executor
+*/
+func newExecutor(config NodeConfig) (Executor, error) {
+	switch config.Executor {
+	case "", "venv":
+		return venvExecutor{wheelhouse: config.Wheelhouse}, nil
+	case "container":
+		if config.ContainerRuntime == "" || config.ContainerImage == "" {
+			return nil, fmt.Errorf("container executor needs a container runtime and image")
+		}
+		return containerExecutor{
+			runtime:    config.ContainerRuntime,
+			image:      config.ContainerImage,
+			cpus:       config.CPULimit,
+			memory:     config.MemoryLimit,
+			wheelhouse: config.Wheelhouse,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown executor %q, use venv or container", config.Executor)
+	}
+}
+
+/*
+venvExecutor is an Executor running the model in a virtual environment on the host
+The model has the same access to the files and network of the host as the node
+wheelhouse is an optional directory of wheels the packages are installed from
+*/
+type venvExecutor struct {
+	wheelhouse string
+}
+
+/*
+Execute runs the model in a virtual environment
+ 1. Create the virtualEnvironment directory, the commands run in it without changing the directory of the node
+ 2. Get the virtual environment of the python version and the requirements from the environment cache,
+    creating it and installing the required packages if it is not cached
+ 3. Execute the entrypoint of the manifest
+*/
+func (ve venvExecutor) Execute(ctx context.Context, dirPath string, manifest JobManifest, logger *log.Logger) ([]byte, ResourceUsage, error) {
+	jobDir, err := filepath.Abs(dirPath)
+	if err != nil {
+		logger.Printf("Failed to get absolute path of %s: %v", dirPath, err)
+		return nil, ResourceUsage{}, err
+	}
+	modelDir := filepath.Join(jobDir, "model")
+
+	virtualEnvDir := filepath.Join(jobDir, "virtualEnvironment")
+
+	if err := os.Mkdir(virtualEnvDir, 0777); err != nil {
+		logger.Printf("Failed to create directory: %v", err)
+		return nil, ResourceUsage{}, err
+	}
+
+	// Execute commands for virtual environment setup and model execution
+	launcher := pythonLauncher()
+	if manifest.Python != "" {
+		if _, err := exec.LookPath("python" + manifest.Python); err == nil {
+			launcher = "python" + manifest.Python
+		} else {
+			logger.Printf("Python %s is not installed, using %s\n", manifest.Python, launcher)
+		}
+	}
+	requirements, err := readRequirements(modelDir, manifest)
+	if err != nil {
+		logger.Printf("Failed to read required packages: %v", err)
+		return nil, ResourceUsage{}, err
+	}
+
+	// the environment is reused from the cache when the python and the requirements are the same
+	key := environmentKey("venv", runtime.GOOS, launcher, requirements, ve.wheelhouse)
+	envDir, release, cached, err := envCache.acquire(key, virtualEnvDir, func(envDir string) error {
+		if _, err := runCommand(ctx, virtualEnvDir, launcher, "-m", "venv", filepath.Join(envDir, "Env")); err != nil {
+			logger.Printf("Failed to create virtual environment : %v", err)
+			return err
+		}
+		logger.Printf("Virtual environment created\n")
+
+		if manifest.Requirements != "" {
+			python := venvPython(filepath.Join(envDir, "Env"))
+			if _, err := runCommand(ctx, virtualEnvDir, python, pipInstallArgs(filepath.Join(modelDir, filepath.FromSlash(manifest.Requirements)), ve.wheelhouse, "")...); err != nil {
+				logger.Printf("Failed to install required packages: %v", err)
+				return err
+			}
+			logger.Printf("Required packages installed\n")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, ResourceUsage{}, err
+	}
+	defer release()
+	if cached {
+		logger.Printf("Virtual environment reused from cache\n")
+	}
+
+	// the python binary of the virtual environment is run directly, no shell activation is needed
+	python := venvPython(filepath.Join(envDir, "Env"))
+	if _, err := os.Stat(python); err != nil {
+		logger.Printf("Failed to activate virtual environment: %v", err)
+		return nil, ResourceUsage{}, err
+	}
+	logger.Printf("Virtual environment activated\n")
+
+	// Execute the entrypoint of the manifest
+	args := append([]string{filepath.Join(modelDir, filepath.FromSlash(manifest.Entrypoint))},
+		manifest.expandArgs(filepath.Join(jobDir, "dataset"), modelDir, filepath.Join(jobDir, "output"))...)
+	env := []string{resultEnv + "=" + filepath.Join(jobDir, "output", resultFile)}
+	model, usage, err := runPythonFile(ctx, virtualEnvDir, env, python, args...)
+	if err != nil {
+		logger.Printf("Failed to execute the Python model script: %v", err)
+		return nil, usage, err
+	}
+	return model, usage, nil
+}
+
+/*
+containerExecutor is an Executor running the model in an OCI container with docker or podman
+  - runtime, image: container runtime and python image
+  - cpus, memory: limits passed to --cpus and --memory
+  - wheelhouse: optional directory of wheels the packages are installed from
+*/
+type containerExecutor struct {
+	runtime    string
+	image      string
+	cpus       string
+	memory     string
+	wheelhouse string
+}
+
+/*
+Execute runs the model in two containers
+ 1. Use the python image of the manifest version and the limits of the manifest if they fit in the node limits
+ 2. Get the dependencies of the image and the requirements from the environment cache, installing them with
+    pip --target if they are not cached, the only step with network access
+ 3. Execute the entrypoint without network, the dataset is mounted read-only and the dependencies are
+    found through PYTHONPATH, only the model and output directories are writable
+    the CPU time and peak memory are read from the cgroup of the container by the node (see measureContainer)
+ 4. Remove the container of the running step when ctx ends
+*/
+func (ce containerExecutor) Execute(ctx context.Context, dirPath string, manifest JobManifest, logger *log.Logger) ([]byte, ResourceUsage, error) {
+	cpus, memory, err := manifest.limitsFor(ce.cpus, ce.memory)
+	if err != nil {
+		logger.Printf("Job does not fit in the limits of the node: %v", err)
+		return nil, ResourceUsage{}, err
+	}
+	ce.cpus, ce.memory = cpus, memory
+	if manifest.Python != "" {
+		ce.image = "python:" + manifest.Python + "-slim"
+	}
+
+	if _, err := exec.LookPath(ce.runtime); err != nil {
+		logger.Printf("Container runtime %s not found: %v", ce.runtime, err)
+		return nil, ResourceUsage{}, err
+	}
+
+	jobDir, err := filepath.Abs(dirPath)
+	if err != nil {
+		logger.Printf("Failed to get absolute path of %s: %v", dirPath, err)
+		return nil, ResourceUsage{}, err
+	}
+	requirements, err := readRequirements(filepath.Join(jobDir, "model"), manifest)
+	if err != nil {
+		logger.Printf("Failed to read required packages: %v", err)
+		return nil, ResourceUsage{}, err
+	}
+
+	key := environmentKey("container", ce.runtime, ce.image, requirements, ce.wheelhouse)
+	envDir, release, cached, err := envCache.acquire(key, filepath.Join(jobDir, "dependencies"), func(envDir string) error {
+		if manifest.Requirements == "" {
+			return nil
+		}
+		install := []string{
+			"-v", filepath.Join(jobDir, "model") + ":/job/model:ro",
+			"-v", envDir + ":/job/dependencies",
+		}
+		wheelhouse := ""
+		if ce.wheelhouse != "" {
+			install = append(install, "-v", ce.wheelhouse+":/job/wheelhouse:ro")
+			wheelhouse = "/job/wheelhouse"
+		}
+		command := append([]string{"python"}, pipInstallArgs("/job/model/"+manifest.Requirements, wheelhouse, "/job/dependencies")...)
+		if _, err := ce.run(ctx, install, nil, command...); err != nil {
+			logger.Printf("Failed to install required packages: %v", err)
+			return err
+		}
+		logger.Printf("Required packages installed\n")
+		return nil
+	})
+	if err != nil {
+		return nil, ResourceUsage{}, err
+	}
+	defer release()
+	if cached {
+		logger.Printf("Required packages reused from cache\n")
+	}
+
+	execute := []string{
+		"--network", "none",
+		"-v", filepath.Join(jobDir, "dataset") + ":/job/dataset:ro",
+		"-v", filepath.Join(jobDir, "model") + ":/job/model",
+		"-v", filepath.Join(jobDir, "output") + ":/job/output",
+		"-v", envDir + ":/job/dependencies:ro",
+		"-e", "PYTHONPATH=/job/dependencies",
+		"-e", resultEnv + "=/job/output/" + resultFile,
+	}
+	command := append([]string{"python", "/job/model/" + manifest.Entrypoint}, manifest.expandArgs("/job/dataset", "/job/model", "/job/output")...)
+	var usage ResourceUsage
+	out, err := ce.run(ctx, execute, &usage, command...)
+	if err != nil {
+		logger.Printf("Failed to execute the Python model script: %v", err)
+		return nil, usage, err
+	}
+
+	return out.Bytes(), usage, nil
+}
+
+/*
+run is a function to run a command in a new container and return its stdout and stderr
+ 1. The container has a read-only root filesystem, no capabilities, a process limit and the CPU and memory limits
+ 2. On Linux it runs as the user of the node so the files it writes belong to the node
+ 3. The container is removed when the context ends before the command
+ 4. Its CPU time and peak memory are measured into usage when usage is not nil
+*/
+func (ce containerExecutor) run(ctx context.Context, mounts []string, usage *ResourceUsage, command ...string) (bytes.Buffer, error) {
+	var out bytes.Buffer
+
+	name, err := containerName()
+	if err != nil {
+		return out, err
+	}
+
+	args := []string{"run", "--rm", "--name", name,
+		"--read-only", "--tmpfs", "/tmp",
+		"--cap-drop", "ALL", "--security-opt", "no-new-privileges",
+		"--pids-limit", "256",
+		"-e", "HOME=/tmp", "-w", "/tmp",
+	}
+	if ce.cpus != "" {
+		args = append(args, "--cpus", ce.cpus)
+	}
+	if ce.memory != "" {
+		args = append(args, "--memory", ce.memory, "--memory-swap", ce.memory)
+	}
+	if runtime.GOOS == "linux" {
+		args = append(args, "--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()))
+	}
+	args = append(args, mounts...)
+	args = append(args, ce.image)
+	args = append(args, command...)
+
+	cmd := exec.CommandContext(ctx, ce.runtime, args...)
+	killProcessTree(cmd)
+	cmd.Stdout = io.MultiWriter(&out, logStreamFrom(ctx))
+	cmd.Stderr = cmd.Stdout
+
+	if err = cmd.Start(); err == nil {
+		stop := measureContainer(ce.runtime, name, usage)
+		err = cmd.Wait()
+		stop()
+	}
+	if ctx.Err() != nil {
+		// killing the runtime client does not stop the container
+		exec.Command(ce.runtime, "rm", "-f", name).Run()
+		return out, fmt.Errorf("execution stopped: %s: %w", strings.Join(command, " "), ctx.Err())
+	}
+	if err != nil {
+		return out, fmt.Errorf("Command failed: %s\nError: %v\nOutput: %s", strings.Join(command, " "), err, out.String())
+	}
+	return out, nil
+}
+
+/*
+containerName is a function to get a unique name for a container, used to remove it after the time limit
+*/
+func containerName() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate container name: %v", err)
+	}
+	return "proofai-" + hex.EncodeToString(b), nil
+}
+
+/*
+readRequirements is a function to read the requirements file of the manifest, empty if the manifest has none
+*/
+func readRequirements(modelDir string, manifest JobManifest) (string, error) {
+	if manifest.Requirements == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(filepath.Join(modelDir, filepath.FromSlash(manifest.Requirements)))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
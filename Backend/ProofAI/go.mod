@@ -2,6 +2,9 @@ module ProoAiBackend
 
 go 1.23.3
 
-require github.com/gorilla/handlers v1.5.2
+require (
+	github.com/gorilla/handlers v1.5.2
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require github.com/felixge/httpsnoop v1.0.4 // indirect
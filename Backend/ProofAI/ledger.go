@@ -5,42 +5,109 @@ package main
 	1. Ledger: struct to store the ledger details
 	2. Block: struct to store the block details
 	3. Transaction: struct to store the transaction details
+	4. Ledger methods: read and update the blocks under the ledger lock
 */
 
+import "sync"
+
 /*
 Ledger is a struct to store the ledger details
 -Blocks: list of blocks in the ledger
+-file: path of the ledger file the blocks are persisted to
+-mu: guards blocks and file, and serialises writes to the ledger file
 */
 type Ledger struct {
+	mu     sync.RWMutex
 	blocks []Block
+	file   string
+}
+
+/*
+latest returns the last block of the ledger, false if the ledger is empty
+*/
+func (l *Ledger) latest() (Block, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.blocks) == 0 {
+		return Block{}, false
+	}
+	return l.blocks[len(l.blocks)-1], true
+}
+
+/*
+snapshot returns a copy of the blocks of the ledger
+*/
+func (l *Ledger) snapshot() []Block {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	blocks := make([]Block, len(l.blocks))
+	copy(blocks, l.blocks)
+	return blocks
+}
+
+/*
+commit appends the block to the ledger and the ledger file
+*/
+func (l *Ledger) commit(block Block) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.blocks = append(l.blocks, block)
+	InsertBlockInLedgerFile(l.file, &block)
+}
+
+/*
+reset empties the ledger
+*/
+func (l *Ledger) reset() {
+	l.mu.Lock()
+	l.blocks = nil
+	l.file = ""
+	l.mu.Unlock()
 }
 
 /*
 Block is a struct to store the block details
+ChainID, Usage and ProposerSignature are omitted when empty so that blocks of ledgers written before them keep their hash
+ProposerSignature is the signature of the block by ProposerId, see signBlock in chainConfig.go
 */
 type Block struct {
-	Transactions     []Transaction `json:"transactions"`
-	Prev_Hash        string        `json:"prev_Hash"`
-	ProposerId       string        `json:"proposerId"`
-	BlockNum         int           `json:"blockNum"`
-	TimeStamp        string        `json:"timeStamp"`
-	TransactionsHash string        `json:"transactionsHash"`
-	Salt             string        `json:"salt"`
-	Difficulty       int           `json:"difficulty"`
-	Type             string        `json:"type"`
+	ChainID           string         `json:"chainId,omitempty"`
+	Transactions      []Transaction  `json:"transactions"`
+	Prev_Hash         string         `json:"prev_Hash"`
+	ProposerId        string         `json:"proposerId"`
+	BlockNum          int            `json:"blockNum"`
+	TimeStamp         string         `json:"timeStamp"`
+	TransactionsHash  string         `json:"transactionsHash"`
+	Salt              string         `json:"salt"`
+	Difficulty        int            `json:"difficulty"`
+	Type              string         `json:"type"`
+	Usage             *ResourceUsage `json:"usage,omitempty"`
+	ProposerSignature string         `json:"proposerSignature,omitempty"`
 }
 
 /*
 Transaction is a struct to store the transaction details
 */
 type Transaction struct {
-	From           string `json:"from"`
-	Nonce          int    `json:"nonce"`
-	Input_dataSet  string `json:"input_dataSet"`
-	Input_model    string `json:"input_model"`
-	Model_output   []byte `json:"model_output"`
-	TransactionLog []byte `json:"transactionLog"`
-	BlockNum       int    `json:"blockNum"`
-	Signature      string `json:"signature"`
-	Type           string `json:"type"`
+	ChainID        string         `json:"chainId,omitempty"`
+	From           string         `json:"from"`
+	Nonce          int            `json:"nonce"`
+	Input_dataSet  string         `json:"input_dataSet"`
+	Input_model    string         `json:"input_model"`
+	Model_output   []byte         `json:"model_output"`
+	Result         *ModelResult   `json:"result,omitempty"`
+	TransactionLog []byte         `json:"transactionLog"`
+	BlockNum       int            `json:"blockNum"`
+	Signature      string         `json:"signature"`
+	Type           string         `json:"type"`
+	Status         string         `json:"status,omitempty"`
+	Artifacts      []Artifact     `json:"artifacts,omitempty"`
+	Usage          *ResourceUsage `json:"usage,omitempty"`
 }
+
+// Status of the execution of a transaction, empty in blocks mined before the status was recorded
+const (
+	ExecutionSucceeded = "succeeded"
+	ExecutionFailed    = "failed"
+	ExecutionTimedOut  = "timeout"
+)
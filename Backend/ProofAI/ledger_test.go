@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+/*
+TestLedgerConcurrentCommit commits blocks while other goroutines read the ledger, run it with -race
+*/
+func TestLedgerConcurrentCommit(t *testing.T) {
+	ledger := &Ledger{file: filepath.Join(t.TempDir(), "Transaction_test.json")}
+
+	const writers, blocksPerWriter = 4, 25
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < blocksPerWriter; i++ {
+				ledger.commit(Block{BlockNum: w*blocksPerWriter + i + 1})
+			}
+		}(w)
+	}
+	for r := 0; r < writers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < blocksPerWriter; i++ {
+				ledger.latest()
+				for _, block := range ledger.snapshot() {
+					_ = block.BlockNum
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	blocks := ledger.snapshot()
+	if len(blocks) != writers*blocksPerWriter {
+		t.Fatalf("ledger has %d blocks, want %d", len(blocks), writers*blocksPerWriter)
+	}
+	stored, err := ReadBlocksFromLedgerFile(ledger.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != len(blocks) {
+		t.Fatalf("ledger file has %d blocks, want %d", len(stored), len(blocks))
+	}
+	latest, ok := ledger.latest()
+	if !ok || latest.BlockNum != blocks[len(blocks)-1].BlockNum {
+		t.Fatalf("latest block %d is not the last committed block %d", latest.BlockNum, blocks[len(blocks)-1].BlockNum)
+	}
+}
+
+/*
+TestLedgerSnapshotIsCopy checks that a snapshot is not changed by later commits
+*/
+func TestLedgerSnapshotIsCopy(t *testing.T) {
+	ledger := &Ledger{file: filepath.Join(t.TempDir(), "Transaction_test.json")}
+	ledger.commit(Block{BlockNum: 1})
+	snapshot := ledger.snapshot()
+	snapshot[0].BlockNum = 42
+	ledger.commit(Block{BlockNum: 2})
+
+	if latest, _ := ledger.latest(); latest.BlockNum != 2 {
+		t.Fatalf("latest block is %d, want 2", latest.BlockNum)
+	}
+	if blocks := ledger.snapshot(); blocks[0].BlockNum != 1 {
+		t.Fatalf("first block is %d, want 1", blocks[0].BlockNum)
+	}
+}
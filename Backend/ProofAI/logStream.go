@@ -0,0 +1,322 @@
+package main
+
+/*
+	In this file we stream the log of the transaction being executed, line by line, to the local API.
+	The executors write the transaction log and the stdout and stderr of the commands they run to the logStream of the
+	execution, which is carried by the context of the execution. Clients follow it with Server-Sent Events.
+	1-		logStream is a struct to store the lines of one execution and its subscribers.
+	2-		logHub is a struct to store the streams of the running and recently finished executions by transaction.
+	3-		withLogStream and logStreamFrom functions which are used to carry a stream in a context.
+	4-		handleTransactionLogs function which is used to follow the log of a transaction.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxLogLines      = 5000            // lines kept for clients that subscribe late
+	logSubscriberBuf = 256             // lines queued for one client, a slower client is dropped
+	logStreamKeep    = 5 * time.Minute // time a finished stream stays available
+	maxLogLineSize   = 64 << 10        // bytes of a line without end, longer output is published in pieces
+)
+
+// logStreams is the log hub of the node
+var logStreams = newLogHub()
+
+/*
+logStream is a struct to store the lines of one execution
+  - mu guards every field
+  - partial holds the end of the last write until its line is complete, at most maxLogLineSize bytes
+  - afterCR is true when the last line ended with '\r', so a following '\n' does not end another line
+*/
+type logStream struct {
+	mu          sync.Mutex
+	lines       []string
+	partial     []byte
+	afterCR     bool
+	subscribers map[chan string]bool
+	done        bool
+}
+
+/*
+Write splits p into lines and publishes every complete line
+'\n', '\r\n' and '\r' end a line, so the progress bars of pip and tqdm, which only use '\r', reach the clients.
+A '\r' without text before it is not published, and a line longer than maxLogLineSize is published in pieces.
+*/
+func (s *logStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexAny(s.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		end := s.partial[i]
+		secondOfCRLF := end == '\n' && i == 0 && s.afterCR
+		if !secondOfCRLF && (end == '\n' || i > 0) {
+			s.publish(string(s.partial[:i]))
+		}
+		s.afterCR = end == '\r'
+		s.partial = s.partial[i+1:]
+	}
+	for len(s.partial) >= maxLogLineSize {
+		s.publish(string(s.partial[:maxLogLineSize]))
+		s.partial = s.partial[maxLogLineSize:]
+		s.afterCR = false
+	}
+	if len(s.partial) > 0 {
+		s.afterCR = false
+	}
+	// keep the partial line in its own buffer, so the buffer of the published lines can be released
+	s.partial = append([]byte(nil), s.partial...)
+	return len(p), nil
+}
+
+/*
+publish is a function to keep a line and send it to the subscribers, the caller holds mu
+*/
+func (s *logStream) publish(line string) {
+	s.lines = append(s.lines, line)
+	if len(s.lines) > maxLogLines {
+		s.lines = s.lines[len(s.lines)-maxLogLines:]
+	}
+	for ch := range s.subscribers {
+		select {
+		case ch <- line:
+		default:
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+/*
+close is a function to publish the last partial line and end the stream for every subscriber
+*/
+func (s *logStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	if len(s.partial) > 0 {
+		s.publish(string(s.partial))
+		s.partial = nil
+	}
+	s.done = true
+	for ch := range s.subscribers {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
+
+/*
+subscribe is a function to get the lines so far and a channel of the next lines
+the channel is closed when the stream ends or the subscriber is too slow, it is nil if the stream already ended
+*/
+func (s *logStream) subscribe() ([]string, chan string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := append([]string(nil), s.lines...)
+	if s.done {
+		return history, nil
+	}
+	ch := make(chan string, logSubscriberBuf)
+	s.subscribers[ch] = true
+	return history, ch
+}
+
+/*
+unsubscribe is a function to stop sending lines to ch
+*/
+func (s *logStream) unsubscribe(ch chan string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subscribers[ch] {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
+
+/*
+finished is a function to check if the execution of the stream has ended
+*/
+func (s *logStream) finished() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done
+}
+
+/*
+logHub is a struct to store the log streams by transaction
+*/
+type logHub struct {
+	mu      sync.Mutex
+	streams map[string]*logStream
+	latest  map[string]string // key of the last execution started on a chain
+}
+
+/*
+newLogHub is a function to create an empty log hub
+*/
+func newLogHub() *logHub {
+	return &logHub{streams: make(map[string]*logStream), latest: make(map[string]string)}
+}
+
+/*
+transactionLogKey is a function to get the key of the log stream of a transaction
+*/
+func transactionLogKey(chainID string, from string, nonce int) string {
+	return fmt.Sprintf("%s/%s/%d", chainID, from, nonce)
+}
+
+/*
+open is a function to start the log stream of a transaction of a chain, replacing the stream of an earlier execution
+*/
+func (h *logHub) open(chainID string, key string) *logStream {
+	stream := &logStream{subscribers: make(map[chan string]bool)}
+	h.mu.Lock()
+	old := h.streams[key]
+	h.streams[key] = stream
+	h.latest[chainID] = key
+	h.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+	return stream
+}
+
+/*
+finish is a function to end the log stream of a transaction, it stays available for logStreamKeep
+*/
+func (h *logHub) finish(key string, stream *logStream) {
+	stream.close()
+	time.AfterFunc(logStreamKeep, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.streams[key] == stream {
+			delete(h.streams, key)
+		}
+	})
+}
+
+/*
+getLatest is a function to get the log stream of the last execution started on a chain, nil if it has none
+*/
+func (h *logHub) getLatest(chainID string) *logStream {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.streams[h.latest[chainID]]
+}
+
+/*
+get is a function to get the log stream of a transaction, nil if it has none
+*/
+func (h *logHub) get(key string) *logStream {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.streams[key]
+}
+
+type logStreamKey struct{}
+
+/*
+withLogStream is a function to carry the log stream of an execution in its context
+*/
+func withLogStream(ctx context.Context, stream *logStream) context.Context {
+	return context.WithValue(ctx, logStreamKey{}, stream)
+}
+
+/*
+logStreamFrom is a function to get the writer of the log stream of an execution, io.Discard if it has none
+*/
+func logStreamFrom(ctx context.Context) io.Writer {
+	if stream, ok := ctx.Value(logStreamKey{}).(*logStream); ok {
+		return stream
+	}
+	return io.Discard
+}
+
+/*
+  - handleTransactionLogs follows the log of the execution of a transaction with Server-Sent Events
+    Input parameters : from address, nonce, without them the last execution of the chain is followed
+    Output : every line as a "data:" event, then an "end" event when the execution is finished
+    logic : The lines so far are sent first, then the lines as they are written.
+*/
+func handleTransactionLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Get method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	chainID := chain.selfMiningDetail.getChainID()
+	stream := logStreams.getLatest(chainID)
+	if from := r.URL.Query().Get("from"); from != "" {
+		nonce, err := strconv.Atoi(r.URL.Query().Get("nonce"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			response := map[string]string{"error": "Invalid nonce"}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		stream = logStreams.get(transactionLogKey(chainID, from, nonce))
+	}
+	flusher, canFlush := w.(http.Flusher)
+	if stream == nil || !canFlush {
+		w.WriteHeader(http.StatusNotFound)
+		response := map[string]string{"error": "No execution of this transaction"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	history, ch := stream.subscribe()
+	if ch != nil {
+		defer stream.unsubscribe(ch)
+	}
+	for _, line := range history {
+		fmt.Fprintf(w, "data: %s\n\n", line)
+	}
+	flusher.Flush()
+
+	for ch != nil {
+		select {
+		case line, open := <-ch:
+			if !open {
+				// a subscriber too slow to keep up is dropped before the end, the client reconnects
+				if !stream.finished() {
+					return
+				}
+				ch = nil
+				break
+			}
+			fmt.Fprintf(w, "data: %s\n\n", line)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+	fmt.Fprint(w, "event: end\ndata: \n\n")
+	flusher.Flush()
+}
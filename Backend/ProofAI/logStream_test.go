@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeAll(t *testing.T, s *logStream, chunks ...string) {
+	t.Helper()
+	for _, chunk := range chunks {
+		if _, err := s.Write([]byte(chunk)); err != nil {
+			t.Fatalf("write %q: %v", chunk, err)
+		}
+	}
+}
+
+func TestLogStreamLineEnds(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string
+	}{
+		{"newline", []string{"a\nb\n"}, []string{"a", "b"}},
+		{"empty line", []string{"a\n\nb\n"}, []string{"a", "", "b"}},
+		{"crlf", []string{"a\r\nb\r\n"}, []string{"a", "b"}},
+		{"crlf across writes", []string{"a\r", "\nb\n"}, []string{"a", "b"}},
+		{"carriage return", []string{"10%\r50%\r100%\n"}, []string{"10%", "50%", "100%"}},
+		{"leading carriage return", []string{"\r 10%", "\r 50%", "\r"}, []string{" 10%", " 50%"}},
+		{"partial line", []string{"a", "b", "c\n"}, []string{"abc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &logStream{subscribers: make(map[chan string]bool)}
+			writeAll(t, s, tt.chunks...)
+			lines, _ := s.subscribe()
+			if !reflect.DeepEqual(lines, tt.want) {
+				t.Fatalf("lines = %q, want %q", lines, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogStreamCapsPartialLine(t *testing.T) {
+	s := &logStream{subscribers: make(map[chan string]bool)}
+	long := strings.Repeat("x", 2*maxLogLineSize+10)
+	for i := 0; i < len(long); i += 1000 {
+		end := i + 1000
+		if end > len(long) {
+			end = len(long)
+		}
+		writeAll(t, s, long[i:end])
+		if len(s.partial) >= maxLogLineSize {
+			t.Fatalf("partial line has %d bytes, the limit is %d", len(s.partial), maxLogLineSize)
+		}
+	}
+	lines, _ := s.subscribe()
+	if len(lines) != 2 || len(lines[0]) != maxLogLineSize || len(lines[1]) != maxLogLineSize {
+		t.Fatalf("got %d lines, want 2 lines of %d bytes", len(lines), maxLogLineSize)
+	}
+
+	s.close()
+	lines, _ = s.subscribe()
+	if len(lines) != 3 || lines[2] != strings.Repeat("x", 10) {
+		t.Fatalf("close did not publish the rest of the line, got %d lines", len(lines))
+	}
+}
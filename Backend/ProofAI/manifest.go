@@ -0,0 +1,267 @@
+package main
+
+/*
+	In this file we read the job manifest of a training transaction. The manifest is the file proofai.yaml in the model CID:
+
+		entrypoint: train.py                           # script in the model directory
+		args: ["{dataset}", "{output}/model.pt"]       # {dataset}, {model} and {output} are replaced by the directories
+		python: "3.11"                                 # optional python version
+		requirements: requirements.txt                 # optional requirements file in the model directory
+		outputs: ["model.pt"]                          # files the script must write to {output}, uploaded to IPFS
+		resources: {cpus: "2", memory: "4g"}           # optional, must fit in the limits of the miner
+		timeout: 30m                                   # optional, must fit in the time limit of the miner
+
+	Models without a manifest run as before: model.py {dataset}/ {model}/knn_model.pkl with requirements.txt.
+	1-		JobManifest is a struct to store the manifest.
+	2-		loadJobManifest function which is used to read and validate the manifest of a model directory.
+	3-		validateModelManifest function which is used to check the manifest of a model CID before a transaction is created.
+	4-		expandArgs, checkOutputs, limitsFor and timeoutFor functions which are used by the executors.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// manifestFile is the name of the job manifest in the model CID
+const manifestFile = "proofai.yaml"
+
+/*
+JobManifest is a struct to store the job manifest of a model
+*/
+type JobManifest struct {
+	Entrypoint   string       `yaml:"entrypoint"`
+	Args         []string     `yaml:"args"`
+	Python       string       `yaml:"python"`
+	Requirements string       `yaml:"requirements"`
+	Outputs      []string     `yaml:"outputs"`
+	Resources    JobResources `yaml:"resources"`
+	Timeout      string       `yaml:"timeout"`
+}
+
+/*
+JobResources is a struct to store the resources a job needs
+*/
+type JobResources struct {
+	CPUs   string `yaml:"cpus"`
+	Memory string `yaml:"memory"`
+}
+
+var pythonVersionPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+){0,2}$`)
+
+/*
+defaultJobManifest is a function to get the manifest of models without proofai.yaml
+*/
+func defaultJobManifest() JobManifest {
+	return JobManifest{
+		Entrypoint:   "model.py",
+		Args:         []string{"{dataset}/", "{model}/knn_model.pkl"},
+		Requirements: "requirements.txt",
+	}
+}
+
+/*
+loadJobManifest is a function to read the manifest of a model directory
+ 1. Use the default manifest if the model has no proofai.yaml
+ 2. Parse the manifest, unknown fields are an error
+ 3. Validate the manifest against the files of the model
+*/
+func loadJobManifest(modelDir string) (JobManifest, error) {
+	data, err := os.ReadFile(filepath.Join(modelDir, manifestFile))
+	if os.IsNotExist(err) {
+		return defaultJobManifest(), nil
+	}
+	if err != nil {
+		return JobManifest{}, fmt.Errorf("failed to read %s: %v", manifestFile, err)
+	}
+
+	var manifest JobManifest
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&manifest); err != nil {
+		return JobManifest{}, fmt.Errorf("failed to parse %s: %v", manifestFile, err)
+	}
+
+	if err := manifest.validate(modelDir); err != nil {
+		return JobManifest{}, fmt.Errorf("invalid %s: %v", manifestFile, err)
+	}
+	return manifest, nil
+}
+
+/*
+validate is a function to check the manifest
+  - entrypoint and requirements must be files of the model directory
+  - outputs must stay inside the output directory
+  - python, resources and timeout must be well formed
+*/
+func (m JobManifest) validate(modelDir string) error {
+	if m.Entrypoint == "" {
+		return fmt.Errorf("entrypoint is required")
+	}
+	if err := checkModelFile(modelDir, m.Entrypoint); err != nil {
+		return fmt.Errorf("entrypoint: %v", err)
+	}
+	if m.Requirements != "" {
+		if err := checkModelFile(modelDir, m.Requirements); err != nil {
+			return fmt.Errorf("requirements: %v", err)
+		}
+	}
+	seen := map[string]bool{}
+	for _, output := range m.Outputs {
+		if !isLocalPath(output) || filepath.Base(output) != output || seen[output] {
+			return fmt.Errorf("output %q must be a unique file name in the output directory", output)
+		}
+		if output == resultFile {
+			return fmt.Errorf("output %q is the result file of the job", output)
+		}
+		seen[output] = true
+	}
+	if m.Python != "" && !pythonVersionPattern.MatchString(m.Python) {
+		return fmt.Errorf("invalid python version %q", m.Python)
+	}
+	if m.Resources.CPUs != "" {
+		if cpus, err := strconv.ParseFloat(m.Resources.CPUs, 64); err != nil || cpus <= 0 {
+			return fmt.Errorf("invalid cpus %q", m.Resources.CPUs)
+		}
+	}
+	if m.Resources.Memory != "" {
+		if _, err := parseMemory(m.Resources.Memory); err != nil {
+			return err
+		}
+	}
+	if m.Timeout != "" {
+		if timeout, err := time.ParseDuration(m.Timeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q", m.Timeout)
+		}
+	}
+	return nil
+}
+
+/*
+checkModelFile is a function to check that name is a file inside the model directory
+*/
+func checkModelFile(modelDir string, name string) error {
+	if !isLocalPath(name) {
+		return fmt.Errorf("%q must be a relative path inside the model", name)
+	}
+	info, err := os.Stat(filepath.Join(modelDir, filepath.FromSlash(name)))
+	if err != nil || info.IsDir() {
+		return fmt.Errorf("%q is not a file of the model", name)
+	}
+	return nil
+}
+
+/*
+isLocalPath is a function to check that a path is relative and does not leave its directory
+*/
+func isLocalPath(name string) bool {
+	return name != "" && filepath.IsLocal(filepath.FromSlash(name))
+}
+
+/*
+expandArgs is a function to replace {dataset}, {model} and {output} in the arguments of the entrypoint
+*/
+func (m JobManifest) expandArgs(datasetDir string, modelDir string, outputDir string) []string {
+	replacer := strings.NewReplacer("{dataset}", datasetDir, "{model}", modelDir, "{output}", outputDir)
+	args := make([]string, len(m.Args))
+	for i, arg := range m.Args {
+		args[i] = replacer.Replace(arg)
+	}
+	return args
+}
+
+/*
+checkOutputs is a function to check that the script wrote every declared output
+*/
+func (m JobManifest) checkOutputs(outputDir string) error {
+	for _, output := range m.Outputs {
+		if _, err := os.Stat(filepath.Join(outputDir, filepath.FromSlash(output))); err != nil {
+			return fmt.Errorf("declared output %s was not written", output)
+		}
+	}
+	return nil
+}
+
+/*
+limitsFor is a function to get the CPU and memory limits of a job on this node
+The job gets what it asks for, the node limits when it asks for nothing, and an error when it asks for more
+*/
+func (m JobManifest) limitsFor(cpuLimit string, memoryLimit string) (string, string, error) {
+	cpus, memory := cpuLimit, memoryLimit
+
+	if m.Resources.CPUs != "" {
+		requested, _ := strconv.ParseFloat(m.Resources.CPUs, 64)
+		if limit, err := strconv.ParseFloat(cpuLimit, 64); err == nil && requested > limit {
+			return "", "", fmt.Errorf("job needs %s CPUs, this node allows %s", m.Resources.CPUs, cpuLimit)
+		}
+		cpus = m.Resources.CPUs
+	}
+	if m.Resources.Memory != "" {
+		requested, _ := parseMemory(m.Resources.Memory)
+		if limit, err := parseMemory(memoryLimit); err == nil && requested > limit {
+			return "", "", fmt.Errorf("job needs %s memory, this node allows %s", m.Resources.Memory, memoryLimit)
+		}
+		memory = m.Resources.Memory
+	}
+	return cpus, memory, nil
+}
+
+/*
+timeoutFor is a function to get the timeout of a job on this node
+The job gets the timeout it asks for, the node time limit when it asks for nothing, and an error when it asks for more
+*/
+func (m JobManifest) timeoutFor(timeLimit time.Duration) (time.Duration, error) {
+	if m.Timeout == "" {
+		return timeLimit, nil
+	}
+	requested, _ := time.ParseDuration(m.Timeout)
+	if requested > timeLimit {
+		return 0, fmt.Errorf("job needs %v, this node allows %v", requested, timeLimit)
+	}
+	return requested, nil
+}
+
+/*
+parseMemory is a function to parse a memory size like 512m or 4g into bytes
+*/
+func parseMemory(value string) (int64, error) {
+	units := map[string]int64{"": 1, "b": 1, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30, "t": 1 << 40}
+
+	v := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), "b")
+	i := len(v)
+	for i > 0 && (v[i-1] < '0' || v[i-1] > '9') {
+		i--
+	}
+	number, err := strconv.ParseInt(v[:i], 10, 64)
+	unit, ok := units[v[i:]]
+	if err != nil || !ok || number <= 0 {
+		return 0, fmt.Errorf("invalid memory %q", value)
+	}
+	return number * unit, nil
+}
+
+/*
+validateModelManifest is a function to check the manifest of a model CID before a transaction is created
+the model is downloaded to a temporary directory with fetchContent
+*/
+func (bf *ProofAIFactory) validateModelManifest(modelCID string) error {
+	dir, err := os.MkdirTemp("", "ProofAI_manifest")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := bf.fetchContent(modelCID, dir); err != nil {
+		return fmt.Errorf("failed to download model: %v", err)
+	}
+	_, err = loadJobManifest(dir)
+	return err
+}
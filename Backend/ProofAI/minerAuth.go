@@ -0,0 +1,172 @@
+package main
+
+/*
+	In this file we sign the requests of the miner that change its registration on the service machine.
+	The service machine issues a nonce for the public key of the miner, the miner signs the action, its public key, the
+	nonce and the fields of the request, so nobody else can register, refresh or remove the miner.
+	1-		MinerRequest is a struct to store a signed request of the miner.
+	2-		signParts and verifyParts functions which are used to sign a message made of parts with a private key and to
+			check its signature.
+	3-		newMinerRequest function which is used to get a nonce and sign a request, getNonce to get a nonce.
+	4-		postMinerRequest function which is used to send a signed request to the service machine.
+	5-		sendHeartbeats function which is used to send the liveness of the miner every heartbeatInterval, with its address,
+			the height of the tip of its ledger and its role.
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// heartbeatInterval is the time between two heartbeats of the miner
+const heartbeatInterval = 30 * time.Second
+
+/*
+MinerRequest is a struct to store a signed request of the miner, the machine fields are only used by the registration
+*/
+type MinerRequest struct {
+	MachineDetail
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
+}
+
+/*
+signParts is a function to sign the parts joined with NUL bytes, the signature is the one of transactions over the
+SHA-256 hash of the message
+*/
+func signParts(prvKey *ecdsa.PrivateKey, parts ...string) (string, error) {
+	if prvKey == nil {
+		return "", fmt.Errorf("login is required")
+	}
+	hash := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return signTransaction(prvKey, hex.EncodeToString(hash[:]))
+}
+
+/*
+verifyParts is a function to check the signature made by signParts of the parts with the public key
+*/
+func verifyParts(pubKey *ecdsa.PublicKey, signature string, parts ...string) error {
+	signatureBytes, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("error decoding signature: %v", err)
+	}
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(signatureBytes, &sig); err != nil {
+		return fmt.Errorf("error unmarshaling signature: %v", err)
+	}
+	hash := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	if sig.R == nil || sig.S == nil || !ecdsa.Verify(pubKey, hash[:], sig.R, sig.S) {
+		return fmt.Errorf("signature verification failed")
+	}
+	return nil
+}
+
+/*
+newMinerRequest is a function to sign a request of the miner for action
+ 1. Get a nonce for the public key from the service machine
+ 2. Sign the action, the public key, the nonce and the fields
+*/
+func newMinerRequest(serviceMachineURl string, pubKeyStr string, prvKey *ecdsa.PrivateKey, action string, machine MachineDetail, fields ...string) (MinerRequest, error) {
+	request := MinerRequest{MachineDetail: machine}
+	request.PubKey = pubKeyStr
+
+	nonce, err := getNonce(serviceMachineURl, pubKeyStr)
+	if err != nil {
+		return request, err
+	}
+	request.Nonce = nonce
+
+	request.Signature, err = signParts(prvKey, append([]string{action, pubKeyStr, request.Nonce}, fields...)...)
+	return request, err
+}
+
+/*
+getNonce is a function to get a nonce of the service machine for the public key, it can be used once
+*/
+func getNonce(serviceMachineURl string, pubKeyStr string) (string, error) {
+	resp, err := http.Get(serviceMachineURl + "/nonce?pubKey=" + url.QueryEscape(pubKeyStr))
+	if err != nil {
+		return "", fmt.Errorf("failed to get a nonce: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var answer struct {
+		Nonce string `json:"nonce"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&answer) != nil || answer.Nonce == "" {
+		return "", fmt.Errorf("failed to get a nonce: status %d", resp.StatusCode)
+	}
+	return answer.Nonce, nil
+}
+
+/*
+postMinerRequest is a function to send a signed request to path of the service machine
+The caller closes the body of the response
+*/
+func postMinerRequest(serviceMachineURl string, path string, request MinerRequest) (*http.Response, error) {
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	return http.Post(serviceMachineURl+path, "application/json", bytes.NewBuffer(jsonData))
+}
+
+/*
+sendHeartbeats is a function to send the liveness of the miner to the service machine until ctx is done
+The service machine removes the miners without heartbeat for its miner TTL, a removed miner joins again with its next
+heartbeat. Heartbeats start once the miner is registered, the errors are only printed
+*/
+func (bf *ProofAIFactory) sendHeartbeats(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ip, port := bf.selfMiningDetail.advertisedAddress()
+		if ip == "" {
+			continue
+		}
+		machine := MachineDetail{IP: ip, Port: port, Role: bf.selfMiningDetail.getRole()}
+		if block, ok := bf.ledger.latest(); ok {
+			machine.Height = block.BlockNum
+		}
+
+		serviceMachineURl := bf.selfMiningDetail.serviceMachineURL()
+		pubKeyStr, prvKey := bf.selfMiningDetail.identity()
+		request, err := newMinerRequest(serviceMachineURl, pubKeyStr, prvKey, "heartbeat", machine, ip, port, strconv.Itoa(machine.Height), machine.Role)
+		if err != nil {
+			fmt.Printf("Error sending heartbeat: %v\n", err)
+			continue
+		}
+		resp, err := postMinerRequest(serviceMachineURl, "/heartbeat", request)
+		if err != nil {
+			fmt.Printf("Error sending heartbeat: %v\n", err)
+			continue
+		}
+		if resp.StatusCode != http.StatusNoContent {
+			message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			fmt.Printf("Heartbeat refused by the service machine: %s\n", strings.TrimSpace(string(message)))
+		}
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+/*
+	In this file every connected miner gets its own bounded outbound queue drained by its own writer goroutine,
+	so a slow or dead miner cannot stall the broadcast of blocks and transactions to the other miners.
+	1. enqueue: function to queue a message for a miner without blocking the caller
+	2. writeLoop: function to drain the queues of a miner and write them to the connection
+	3. disconnect: function to close the connection of a miner and remove it from the list of miners
+*/
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	minerBlockQueueSize       = 32               // blocks waiting to be written to a miner
+	minerTransactionQueueSize = 256              // transactions waiting to be written to a miner
+	minerWriteTimeout         = 10 * time.Second // deadline of a single write to a miner
+)
+
+/*
+enqueue is a function to queue a message for a miner
+ 1. message: json line to send
+ 2. isBlock: blocks use their own queue which is drained first
+    If the queue is full the miner is too slow to keep up and it is disconnected
+*/
+func (m *Miner) enqueue(message []byte, isBlock bool) error {
+	queue := m.transactions
+	if isBlock {
+		queue = m.blocks
+	}
+
+	select {
+	case <-m.closed:
+		return fmt.Errorf("miner %s is disconnected", m.conn.RemoteAddr())
+	default:
+	}
+
+	select {
+	case queue <- message:
+		return nil
+	default:
+		log.Printf("Outbound queue of miner %s is full, disconnecting\n", m.conn.RemoteAddr())
+		m.disconnect()
+		return fmt.Errorf("outbound queue of miner %s is full", m.conn.RemoteAddr())
+	}
+}
+
+/*
+writeLoop is a function to drain the queues of a miner
+ 1. Wait for a queued block or transaction, blocks are taken first
+ 2. Write it with a write deadline and flush once the queues are empty
+ 3. Disconnect the miner on any write error
+*/
+func (m *Miner) writeLoop() {
+	for {
+		var message []byte
+		select {
+		case message = <-m.blocks:
+		default:
+			select {
+			case message = <-m.blocks:
+			case message = <-m.transactions:
+			case <-m.closed:
+				return
+			}
+		}
+
+		m.link.SetWriteDeadline(time.Now().Add(minerWriteTimeout))
+		n, err := m.write.Write(message)
+		m.bytesOut.Add(int64(n))
+		if err == nil && len(m.blocks) == 0 && len(m.transactions) == 0 {
+			err = m.write.Flush()
+		}
+		if err != nil {
+			log.Printf("Error writing to miner %s: %v\n", m.conn.RemoteAddr(), err)
+			m.disconnect()
+			return
+		}
+	}
+}
+
+/*
+disconnect is a function to close the connection of a miner
+ 1. Stop the writer goroutine
+ 2. Close the connections, which also stops readTransaction
+ 3. Remove the miner from the list of miners
+*/
+func (m *Miner) disconnect() {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		m.link.Close()
+		m.conn.Close()
+		if m.chain != nil && m.chain.removeMiner(m) {
+			fmt.Println("Miner removed from the list")
+		}
+	})
+}
@@ -0,0 +1,430 @@
+package main
+
+/*
+	In this file we load the configuration of the node and select the network addresses it uses.
+	Every setting is read from (later ones win): defaults, the JSON config file, environment variables, command line flags.
+	1. NodeConfig: struct to store the configuration of the node
+	2. loadNodeConfig: function to load the configuration
+	3. getInterfaceIPv4: function to get the IPv4 address of a network interface by name
+	4. bindAddress: function to select the IP the servers listen on
+	5. advertiseAddress: function to select the IP registered with the service machine
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+NodeConfig is a struct to store the configuration of the node
+ 1. BindAddress: IP the peer listener and the external API listen on, empty selects it automatically
+ 2. AdvertiseAddress: IP or host name registered with the service machine, empty detects it automatically
+ 3. Interface: part of the name of the preferred network interface (RadminVPN by default)
+ 4. ExternalAddressURL: optional URL answering with the public IP of the node, used behind NAT
+ 5. Executor: how transactions are executed, "container" in a sandbox (the default) or "venv" on the host
+    AllowUnsandboxed: explicit opt-in to the venv executor, only from the -allow-unsandboxed flag or
+    PROOFAI_ALLOW_UNSANDBOXED, because venv runs the model code of other users with the rights of the node
+ 6. ContainerRuntime, ContainerImage: OCI runtime (docker or podman) and python image of the sandbox
+ 7. CPULimit, MemoryLimit: limits of a sandboxed execution (e.g. "2", "2g")
+ 8. TimeLimit: longest time a transaction may run with any executor (e.g. "30m"), a job manifest may ask for less
+ 9. EnvCacheDir, EnvCacheSize: directory and size limit of the cache of prepared environments ("0" disables it)
+ 10. Wheelhouse: optional directory of wheels, packages are then installed from it only (offline)
+ 11. DataDir: directory of the ledger files and the executions of the node, the working directory by default
+ 12. ContentStore, ContentDir: where datasets, models and outputs are fetched from and uploaded to, "service" goes
+    through the service machine, "fs" uses ContentDir, the store directory of an fs service machine shared with the node
+ 13. ContentCacheSize: size limit of the cache of fetched datasets and models served to the other miners ("0" disables it)
+ 14. PeerContentLimit: largest content downloaded from a miner when its size is not known from the ledger
+*/
+type NodeConfig struct {
+	BindAddress        string `json:"bindAddress"`
+	AdvertiseAddress   string `json:"advertiseAddress"`
+	Interface          string `json:"interface"`
+	ExternalAddressURL string `json:"externalAddressURL"`
+	Executor           string `json:"executor"`
+	AllowUnsandboxed   bool   `json:"-"`
+	ContainerRuntime   string `json:"containerRuntime"`
+	ContainerImage     string `json:"containerImage"`
+	CPULimit           string `json:"cpuLimit"`
+	MemoryLimit        string `json:"memoryLimit"`
+	TimeLimit          string `json:"timeLimit"`
+	EnvCacheDir        string `json:"envCacheDir"`
+	EnvCacheSize       string `json:"envCacheSize"`
+	Wheelhouse         string `json:"wheelhouse"`
+	DataDir            string `json:"dataDir"`
+	ContentStore       string `json:"contentStore"`
+	ContentDir         string `json:"contentDir"`
+	ContentCacheSize   string `json:"contentCacheSize"`
+	PeerContentLimit   string `json:"peerContentLimit"`
+}
+
+// nodeConfig is the configuration of the node, loaded once in main
+var nodeConfig = defaultNodeConfig()
+
+/*
+defaultNodeConfig is a function to get the configuration used when nothing is set
+*/
+func defaultNodeConfig() NodeConfig {
+	return NodeConfig{
+		Interface:        "Radmin",
+		Executor:         "container",
+		ContainerRuntime: "docker",
+		ContainerImage:   "python:3.11-slim",
+		CPULimit:         "2",
+		MemoryLimit:      "2g",
+		TimeLimit:        "30m",
+		EnvCacheSize:     "10g",
+		DataDir:          ".",
+		ContentStore:     "service",
+		ContentCacheSize: "10g",
+		PeerContentLimit: "20g",
+	}
+}
+
+/*
+loadNodeConfig is a function to load the configuration of the node
+ 1. Read the config file given by -config or PROOFAI_CONFIG (ProofAI_config.json if present)
+ 2. Override with the PROOFAI_* environment variables
+ 3. Override with the command line flags
+ 4. Check the executor and content store settings, the venv executor needs AllowUnsandboxed
+ 5. Make the directories absolute, so they do not depend on the working directory, and create the data directory
+*/
+func loadNodeConfig(args []string) (NodeConfig, error) {
+	config := defaultNodeConfig()
+
+	flags := flag.NewFlagSet("ProofAI", flag.ContinueOnError)
+	configFile := flags.String("config", envOr("PROOFAI_CONFIG", "ProofAI_config.json"), "path of the JSON config file")
+	bind := flags.String("bind", "", "IP the peer listener and the external API listen on")
+	advertise := flags.String("advertise", "", "IP or host name registered with the service machine")
+	iface := flags.String("interface", "", "part of the name of the preferred network interface")
+	externalURL := flags.String("external-ip-url", "", "URL answering with the public IP of the node")
+	executor := flags.String("executor", "", "how transactions are executed: container or venv")
+	allowUnsandboxed := flags.Bool("allow-unsandboxed", false, "allow the venv executor, which runs model code on the host without sandbox")
+	runtimeName := flags.String("container-runtime", "", "OCI runtime of the sandbox: docker or podman")
+	image := flags.String("container-image", "", "python image of the sandbox")
+	cpuLimit := flags.String("cpu-limit", "", "CPUs of a sandboxed execution")
+	memoryLimit := flags.String("memory-limit", "", "memory of a sandboxed execution")
+	timeLimit := flags.String("time-limit", "", "longest time a transaction may run")
+	envCacheDir := flags.String("env-cache-dir", "", "directory of the cache of prepared environments")
+	envCacheSize := flags.String("env-cache-size", "", "size limit of the cache of prepared environments, 0 disables it")
+	wheelhouse := flags.String("wheelhouse", "", "directory of wheels to install packages from")
+	dataDir := flags.String("data-dir", "", "directory of the ledger files and the executions")
+	contentStore := flags.String("content-store", "", "where content is fetched from and uploaded to: service or fs")
+	contentDir := flags.String("content-dir", "", "content directory of the fs content store")
+	contentCacheSize := flags.String("content-cache-size", "", "size limit of the cache of fetched content, 0 disables it")
+	peerContentLimit := flags.String("peer-content-limit", "", "largest content downloaded from a miner when its size is unknown")
+	if err := flags.Parse(args); err != nil {
+		return config, err
+	}
+
+	data, err := os.ReadFile(*configFile)
+	if err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return config, fmt.Errorf("failed to parse config file %s: %v", *configFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return config, fmt.Errorf("failed to read config file %s: %v", *configFile, err)
+	}
+
+	config.BindAddress = envOr("PROOFAI_BIND_ADDRESS", config.BindAddress)
+	config.AdvertiseAddress = envOr("PROOFAI_ADVERTISE_ADDRESS", config.AdvertiseAddress)
+	config.Interface = envOr("PROOFAI_INTERFACE", config.Interface)
+	config.ExternalAddressURL = envOr("PROOFAI_EXTERNAL_IP_URL", config.ExternalAddressURL)
+	config.Executor = envOr("PROOFAI_EXECUTOR", config.Executor)
+	if value := envOr("PROOFAI_ALLOW_UNSANDBOXED", ""); value != "" {
+		if config.AllowUnsandboxed, err = strconv.ParseBool(value); err != nil {
+			return config, fmt.Errorf("invalid PROOFAI_ALLOW_UNSANDBOXED %q, use true or false", value)
+		}
+	}
+	config.ContainerRuntime = envOr("PROOFAI_CONTAINER_RUNTIME", config.ContainerRuntime)
+	config.ContainerImage = envOr("PROOFAI_CONTAINER_IMAGE", config.ContainerImage)
+	config.CPULimit = envOr("PROOFAI_CPU_LIMIT", config.CPULimit)
+	config.MemoryLimit = envOr("PROOFAI_MEMORY_LIMIT", config.MemoryLimit)
+	config.TimeLimit = envOr("PROOFAI_TIME_LIMIT", config.TimeLimit)
+	config.EnvCacheDir = envOr("PROOFAI_ENV_CACHE_DIR", config.EnvCacheDir)
+	config.EnvCacheSize = envOr("PROOFAI_ENV_CACHE_SIZE", config.EnvCacheSize)
+	config.Wheelhouse = envOr("PROOFAI_WHEELHOUSE", config.Wheelhouse)
+	config.DataDir = envOr("PROOFAI_DATA_DIR", config.DataDir)
+	config.ContentStore = envOr("PROOFAI_CONTENT_STORE", config.ContentStore)
+	config.ContentDir = envOr("PROOFAI_CONTENT_DIR", config.ContentDir)
+	config.ContentCacheSize = envOr("PROOFAI_CONTENT_CACHE_SIZE", config.ContentCacheSize)
+	config.PeerContentLimit = envOr("PROOFAI_PEER_CONTENT_LIMIT", config.PeerContentLimit)
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "bind":
+			config.BindAddress = *bind
+		case "advertise":
+			config.AdvertiseAddress = *advertise
+		case "interface":
+			config.Interface = *iface
+		case "external-ip-url":
+			config.ExternalAddressURL = *externalURL
+		case "executor":
+			config.Executor = *executor
+		case "allow-unsandboxed":
+			config.AllowUnsandboxed = *allowUnsandboxed
+		case "container-runtime":
+			config.ContainerRuntime = *runtimeName
+		case "container-image":
+			config.ContainerImage = *image
+		case "cpu-limit":
+			config.CPULimit = *cpuLimit
+		case "memory-limit":
+			config.MemoryLimit = *memoryLimit
+		case "time-limit":
+			config.TimeLimit = *timeLimit
+		case "env-cache-dir":
+			config.EnvCacheDir = *envCacheDir
+		case "env-cache-size":
+			config.EnvCacheSize = *envCacheSize
+		case "wheelhouse":
+			config.Wheelhouse = *wheelhouse
+		case "data-dir":
+			config.DataDir = *dataDir
+		case "content-store":
+			config.ContentStore = *contentStore
+		case "content-dir":
+			config.ContentDir = *contentDir
+		case "content-cache-size":
+			config.ContentCacheSize = *contentCacheSize
+		case "peer-content-limit":
+			config.PeerContentLimit = *peerContentLimit
+		}
+	})
+
+	if _, err := config.timeLimit(); err != nil {
+		return config, err
+	}
+	if _, err := config.peerContentLimit(); err != nil {
+		return config, err
+	}
+	if _, err := newExecutor(config); err != nil {
+		return config, err
+	}
+	if config.Executor == "venv" && !config.AllowUnsandboxed {
+		return config, fmt.Errorf("the venv executor runs the model code of other users on the host without sandbox, use the container executor or allow it with -allow-unsandboxed or PROOFAI_ALLOW_UNSANDBOXED=true")
+	}
+	switch config.ContentStore {
+	case "service":
+	case "fs":
+		if config.ContentDir == "" {
+			return config, fmt.Errorf("fs content store needs a content directory")
+		}
+	default:
+		return config, fmt.Errorf("unknown content store %q, use service or fs", config.ContentStore)
+	}
+	for _, dir := range []*string{&config.Wheelhouse, &config.EnvCacheDir, &config.DataDir, &config.ContentDir} {
+		if *dir == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*dir)
+		if err != nil {
+			return config, fmt.Errorf("invalid directory %q: %v", *dir, err)
+		}
+		*dir = abs
+	}
+	if config.DataDir == "" {
+		return config, fmt.Errorf("data directory is required")
+	}
+	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+		return config, fmt.Errorf("failed to create data directory %s: %v", config.DataDir, err)
+	}
+	return config, nil
+}
+
+/*
+dataPath is a function to get the absolute path of a file or directory in the data directory
+*/
+func (config NodeConfig) dataPath(elem ...string) string {
+	return filepath.Join(append([]string{config.DataDir}, elem...)...)
+}
+
+/*
+timeLimit is a function to get the longest time a transaction may run
+*/
+func (config NodeConfig) timeLimit() (time.Duration, error) {
+	timeLimit, err := time.ParseDuration(config.TimeLimit)
+	if err != nil || timeLimit <= 0 {
+		return 0, fmt.Errorf("invalid time limit %q", config.TimeLimit)
+	}
+	return timeLimit, nil
+}
+
+/*
+peerContentLimit is a function to get the largest content downloaded from a miner when its size is unknown
+*/
+func (config NodeConfig) peerContentLimit() (int64, error) {
+	limit, err := parseMemory(config.PeerContentLimit)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("invalid peer content limit %q", config.PeerContentLimit)
+	}
+	return limit, nil
+}
+
+/*
+envOr is a function to read an environment variable, returns fallback if it is not set
+*/
+func envOr(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+/*
+getInterfaceIPv4 is a function to get the IPv4 address of a network interface
+ 1. Get the network interfaces
+ 2. Check if the interface name contains name
+ 3. Get the IP address
+ 4. Return the IPv4 address
+*/
+func getInterfaceIPv4(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("no network interface name given")
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", fmt.Errorf("failed to get network interfaces: %v", err)
+	}
+
+	for _, iface := range interfaces {
+
+		if strings.Contains(iface.Name, name) {
+			addrs, err := iface.Addrs()
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs {
+				ipNet, ok := addr.(*net.IPNet)
+				if !ok {
+					continue
+				}
+
+				ipv4 := ipNet.IP.To4()
+				if ipv4 != nil {
+					return ipv4.String(), nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("IPv4 address of network interface %q not found", name)
+}
+
+/*
+bindAddress is a function to select the IP the servers listen on
+ 1. The configured bind address
+ 2. The address of the preferred network interface, so that a RadminVPN machine only listens on the VPN
+ 3. All interfaces
+*/
+func bindAddress() string {
+	if nodeConfig.BindAddress != "" {
+		return nodeConfig.BindAddress
+	}
+	if ip, err := getInterfaceIPv4(nodeConfig.Interface); err == nil {
+		return ip
+	}
+	return "0.0.0.0"
+}
+
+/*
+advertiseAddress is a function to select the IP registered with the service machine
+ 1. The configured advertise address
+ 2. The address of the preferred network interface
+ 3. The public IP answered by the external address URL (NAT)
+ 4. The address the service machine sees the node connecting from (NAT)
+ 5. The local address of the route to the service machine
+ 6. The first non-loopback IPv4 address
+*/
+func advertiseAddress(serviceMachineURL string) (string, error) {
+	if nodeConfig.AdvertiseAddress != "" {
+		return nodeConfig.AdvertiseAddress, nil
+	}
+	if ip, err := getInterfaceIPv4(nodeConfig.Interface); err == nil {
+		return ip, nil
+	}
+	if nodeConfig.ExternalAddressURL != "" {
+		ip, err := fetchIP(nodeConfig.ExternalAddressURL)
+		if err == nil {
+			return ip, nil
+		}
+		log.Printf("Error getting external address from %s: %v\n", nodeConfig.ExternalAddressURL, err)
+	}
+	if ip, err := fetchIP(serviceMachineURL + "/whoami"); err == nil {
+		return ip, nil
+	}
+	if ip, err := routeIPv4(serviceMachineURL); err == nil {
+		return ip, nil
+	}
+	return firstIPv4()
+}
+
+/*
+fetchIP is a function to get an IP address from a URL answering with the IP as plain text
+*/
+func fetchIP(url string) (string, error) {
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("server returned status: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address %q", strings.TrimSpace(string(body)))
+	}
+	return ip.String(), nil
+}
+
+/*
+routeIPv4 is a function to get the local IPv4 address used to reach the service machine
+No packet is sent, dialing UDP only selects the route
+*/
+func routeIPv4(serviceMachineURL string) (string, error) {
+	host := strings.TrimPrefix(serviceMachineURL, "http://")
+	conn, err := net.Dial("udp4", host)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+/*
+firstIPv4 is a function to get the first non-loopback IPv4 address of the machine
+*/
+func firstIPv4() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", fmt.Errorf("failed to get network interfaces: %v", err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+		if ipv4 := ipNet.IP.To4(); ipv4 != nil {
+			return ipv4.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no IPv4 address found")
+}
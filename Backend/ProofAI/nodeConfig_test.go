@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+/*
+TestExecutorDefaultsToContainer checks that transactions are sandboxed unless venv is explicitly allowed
+*/
+func TestExecutorDefaultsToContainer(t *testing.T) {
+	dir := t.TempDir()
+	base := []string{"-config", filepath.Join(dir, "missing.json"), "-data-dir", dir}
+	t.Setenv("PROOFAI_EXECUTOR", "")
+	t.Setenv("PROOFAI_ALLOW_UNSANDBOXED", "")
+
+	config, err := loadNodeConfig(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Executor != "container" {
+		t.Fatalf("default executor is %q, want container", config.Executor)
+	}
+
+	if _, err := loadNodeConfig(append(base, "-executor", "venv")); err == nil {
+		t.Fatal("venv executor accepted without opt-in")
+	}
+	if _, err := loadNodeConfig(append(base, "-executor", "venv", "-allow-unsandboxed")); err != nil {
+		t.Fatalf("venv executor refused with -allow-unsandboxed: %v", err)
+	}
+
+	t.Setenv("PROOFAI_EXECUTOR", "venv")
+	if _, err := loadNodeConfig(base); err == nil {
+		t.Fatal("venv executor from the environment accepted without opt-in")
+	}
+	t.Setenv("PROOFAI_ALLOW_UNSANDBOXED", "true")
+	if _, err := loadNodeConfig(base); err != nil {
+		t.Fatalf("venv executor refused with PROOFAI_ALLOW_UNSANDBOXED: %v", err)
+	}
+	t.Setenv("PROOFAI_ALLOW_UNSANDBOXED", "maybe")
+	if _, err := loadNodeConfig(base); err == nil {
+		t.Fatal("invalid PROOFAI_ALLOW_UNSANDBOXED accepted")
+	}
+}
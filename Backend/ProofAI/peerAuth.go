@@ -0,0 +1,265 @@
+package main
+
+/*
+	In this file we authenticate the miners that connect to each other.
+	The public key of a peer is proven in the handshake, not looked up by its address: the dialing miner sends its public
+	key and a nonce, the listening miner answers with its communication port, its chain, its public key, its own nonce and
+	the signature of the nonce of the dialer, and the dialer answers with the signature of the nonce of the listener.
+	Both keys must be registered on the service machine. Bans and the peer API only use keys proven this way.
+	1-		PeerHello, PeerHandshake and PeerProof are the messages of the handshake, one JSON line each.
+	2-		peerParts function which is used to build the message signed by a peer.
+	3-		dialHandshake function which is used to authenticate the listening miner and prove the key of the node.
+	4-		acceptHandshake function which is used to authenticate the dialing miner and prove the key of the node.
+	5-		isRegisteredMiner function which is used to check that a key is registered on the service machine.
+*/
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// peerHandshakeTimeout is the time a miner has to complete the handshake
+const peerHandshakeTimeout = 10 * time.Second
+
+/*
+PeerHello is the first message of the handshake, sent by the dialing miner
+*/
+type PeerHello struct {
+	PubKey string `json:"pubKey"`
+	Nonce  string `json:"nonce"`
+}
+
+/*
+PeerHandshake is the answer of the listening miner, Signature signs the nonce of the hello
+*/
+type PeerHandshake struct {
+	Port       string `json:"port"`
+	ChainID    string `json:"chainId"`
+	ConfigHash string `json:"configHash"`
+	PubKey     string `json:"pubKey"`
+	Nonce      string `json:"nonce"`
+	Signature  string `json:"signature"`
+}
+
+/*
+PeerProof is the last message of the handshake, Signature signs the nonce of the listening miner
+*/
+type PeerProof struct {
+	Signature string `json:"signature"`
+}
+
+/*
+peerParts is a function to build the message a peer signs to prove pubKey over the nonce of the other miner
+port is the communication port of the listening miner, empty for the dialing miner
+*/
+func peerParts(pubKey string, nonce string, chainID string, configHash string, port string) []string {
+	return []string{"peer", pubKey, nonce, chainID, configHash, port}
+}
+
+/*
+newPeerNonce is a function to generate the random nonce a peer has to sign
+*/
+func newPeerNonce() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+/*
+writePeerMessage is a function to send a message of the handshake as one JSON line
+*/
+func writePeerMessage(conn net.Conn, message interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(data, '\n'))
+	return err
+}
+
+/*
+readPeerMessage is a function to read a message of the handshake, a line longer than the read buffer is refused
+*/
+func readPeerMessage(reader *bufio.Reader, message interface{}) error {
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(line, message); err != nil {
+		return fmt.Errorf("invalid handshake message, the miner may run an older version: %v", err)
+	}
+	return nil
+}
+
+/*
+checkPeerKey is a function to check that a proven key may connect: not banned and registered on the service machine
+*/
+func (bf *ProofAIFactory) checkPeerKey(pubKey string) error {
+	if bf.isBanned(pubKey) {
+		return fmt.Errorf("miner %.16s is banned", pubKey)
+	}
+	registered, err := isRegisteredMiner(bf.selfMiningDetail.serviceMachineURL(), pubKey)
+	if err != nil {
+		return err
+	}
+	if !registered {
+		return fmt.Errorf("miner %.16s is not registered on the service machine", pubKey)
+	}
+	return nil
+}
+
+/*
+dialHandshake is a function to run the handshake on a connection dialed by the node
+ 1. Send the public key of the node and a nonce
+ 2. Read the answer of the listening miner and refuse another chain or configuration of the chain
+ 3. Check the signature of the nonce, the expected key (if any), the ban list and the registration of the miner
+ 4. Sign the nonce of the listening miner
+ 5. Return the communication port and the proven key
+*/
+func (bf *ProofAIFactory) dialHandshake(miner *Miner, expected *ecdsa.PublicKey) (string, *ecdsa.PublicKey, error) {
+	pubKeyStr, prvKey := bf.selfMiningDetail.identity()
+	if prvKey == nil {
+		return "", nil, fmt.Errorf("login is required")
+	}
+	nonce, err := newPeerNonce()
+	if err != nil {
+		return "", nil, err
+	}
+
+	miner.conn.SetDeadline(time.Now().Add(peerHandshakeTimeout))
+	defer miner.conn.SetDeadline(time.Time{})
+
+	if err := writePeerMessage(miner.conn, PeerHello{PubKey: pubKeyStr, Nonce: nonce}); err != nil {
+		return "", nil, err
+	}
+	var handshake PeerHandshake
+	if err := readPeerMessage(miner.read, &handshake); err != nil {
+		return "", nil, err
+	}
+
+	chainID := bf.selfMiningDetail.getChainID()
+	if chainID != "" && handshake.ChainID != chainID {
+		return "", nil, fmt.Errorf("miner is on chain %s, not on chain %s", handshake.ChainID, chainID)
+	}
+	if configHash := bf.selfMiningDetail.getChainConfig().ConfigHash; configHash != "" && handshake.ConfigHash != configHash {
+		return "", nil, fmt.Errorf("miner uses another configuration of chain %s", chainID)
+	}
+
+	pubKey, err := hexToPublicKey(handshake.PubKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid public key of the miner: %v", err)
+	}
+	if err := verifyParts(pubKey, handshake.Signature, peerParts(handshake.PubKey, nonce, handshake.ChainID, handshake.ConfigHash, handshake.Port)...); err != nil {
+		return "", nil, fmt.Errorf("miner did not prove its key: %v", err)
+	}
+	if expected != nil && !expected.Equal(pubKey) {
+		return "", nil, fmt.Errorf("miner proved another key than the registered one")
+	}
+	if err := bf.checkPeerKey(handshake.PubKey); err != nil {
+		return "", nil, err
+	}
+
+	signature, err := signParts(prvKey, peerParts(pubKeyStr, handshake.Nonce, handshake.ChainID, handshake.ConfigHash, "")...)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := writePeerMessage(miner.conn, PeerProof{Signature: signature}); err != nil {
+		return "", nil, err
+	}
+	return handshake.Port, pubKey, nil
+}
+
+/*
+acceptHandshake is a function to run the handshake on a connection accepted by the node
+ 1. Read the public key and the nonce of the dialing miner, refuse banned and unregistered keys
+ 2. Answer with the communication port, the chain, the public key of the node, a nonce and the signature of the nonce
+ 3. Check the signature of the nonce of the node by the dialing miner
+ 4. Return the proven key
+*/
+func (bf *ProofAIFactory) acceptHandshake(miner *Miner, communicationPort string) (*ecdsa.PublicKey, error) {
+	pubKeyStr, prvKey := bf.selfMiningDetail.identity()
+	if prvKey == nil {
+		return nil, fmt.Errorf("login is required")
+	}
+
+	miner.conn.SetDeadline(time.Now().Add(peerHandshakeTimeout))
+	defer miner.conn.SetDeadline(time.Time{})
+
+	var hello PeerHello
+	if err := readPeerMessage(miner.read, &hello); err != nil {
+		return nil, err
+	}
+	pubKey, err := hexToPublicKey(hello.PubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key of the miner: %v", err)
+	}
+	if hello.Nonce == "" {
+		return nil, fmt.Errorf("handshake without nonce")
+	}
+	if err := bf.checkPeerKey(hello.PubKey); err != nil {
+		return nil, err
+	}
+
+	nonce, err := newPeerNonce()
+	if err != nil {
+		return nil, err
+	}
+	handshake := PeerHandshake{
+		Port:       communicationPort,
+		ChainID:    bf.selfMiningDetail.getChainID(),
+		ConfigHash: bf.selfMiningDetail.getChainConfig().ConfigHash,
+		PubKey:     pubKeyStr,
+		Nonce:      nonce,
+	}
+	handshake.Signature, err = signParts(prvKey, peerParts(pubKeyStr, hello.Nonce, handshake.ChainID, handshake.ConfigHash, communicationPort)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePeerMessage(miner.conn, handshake); err != nil {
+		return nil, err
+	}
+
+	var proof PeerProof
+	if err := readPeerMessage(miner.read, &proof); err != nil {
+		return nil, err
+	}
+	if err := verifyParts(pubKey, proof.Signature, peerParts(hello.PubKey, nonce, handshake.ChainID, handshake.ConfigHash, "")...); err != nil {
+		return nil, fmt.Errorf("miner did not prove its key: %v", err)
+	}
+	return pubKey, nil
+}
+
+/*
+isRegisteredMiner is a function to check that a public key is registered on the service machine
+*/
+func isRegisteredMiner(serverURL string, pubKey string) (bool, error) {
+	resp, err := http.Get(serverURL + "/machines")
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch miners: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("server returned status: %d", resp.StatusCode)
+	}
+
+	var machines []MachineDetail
+	if err := json.NewDecoder(resp.Body).Decode(&machines); err != nil {
+		return false, fmt.Errorf("failed to decode response: %v", err)
+	}
+	for _, machine := range machines {
+		if machine.PubKey == pubKey {
+			return true, nil
+		}
+	}
+	return false, nil
+}
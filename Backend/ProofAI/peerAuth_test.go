@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+testServiceMachine serves the registered miners on /machines like the service machine
+*/
+type testServiceMachine struct {
+	mu       sync.Mutex
+	machines []MachineDetail
+	server   *httptest.Server
+}
+
+func newTestServiceMachine(t *testing.T) *testServiceMachine {
+	sm := &testServiceMachine{}
+	sm.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sm.mu.Lock()
+		defer sm.mu.Unlock()
+		json.NewEncoder(w).Encode(sm.machines)
+	}))
+	t.Cleanup(sm.server.Close)
+	return sm
+}
+
+func (sm *testServiceMachine) register(pubKey string) {
+	sm.mu.Lock()
+	sm.machines = append(sm.machines, MachineDetail{IP: "127.0.0.1", Port: "1", PubKey: pubKey})
+	sm.mu.Unlock()
+}
+
+/*
+newTestNode creates a logged in node of the chain of the service machine
+*/
+func newTestNode(t *testing.T, sm *testServiceMachine) *ProofAIFactory {
+	prvKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := prvKey.PublicKey.ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf := NewProofAIFactory()
+	bf.startPort = 0
+	bf.selfMiningDetail.prvKey = prvKey
+	bf.selfMiningDetail.pubKey = &prvKey.PublicKey
+	bf.selfMiningDetail.pubKeyStr = hex.EncodeToString(pubKey.Bytes())
+	bf.selfMiningDetail.serviceMachineAddr = strings.TrimPrefix(sm.server.URL, "http://")
+	bf.selfMiningDetail.setChainInfo("test", ChainInfo{ChainID: "test"})
+	return bf
+}
+
+/*
+listen accepts one miner on a loopback port, done is closed once acceptMiner returned
+*/
+func listen(t *testing.T, bf *ProofAIFactory) (string, chan struct{}) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		bf.acceptMiner(conn, "127.0.0.1")
+	}()
+	return ln.Addr().String(), done
+}
+
+func waitPeers(t *testing.T, bf *ProofAIFactory, n int) []*Miner {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if peers := bf.peers(); len(peers) == n {
+			return peers
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("node has %d peers, want %d", len(bf.peers()), n)
+	return nil
+}
+
+/*
+TestPeerHandshakeProvesKeys connects two registered nodes, each knows the key proven by the other
+*/
+func TestPeerHandshakeProvesKeys(t *testing.T) {
+	sm := newTestServiceMachine(t)
+	listener, dialer := newTestNode(t, sm), newTestNode(t, sm)
+	sm.register(listener.selfMiningDetail.pubKeyStr)
+	sm.register(dialer.selfMiningDetail.pubKeyStr)
+
+	address, _ := listen(t, listener)
+	if err := dialer.connectToMiner(address, listener.selfMiningDetail.pubKey); err != nil {
+		t.Fatal(err)
+	}
+
+	outbound := waitPeers(t, dialer, 1)[0]
+	if !outbound.pubKey.Equal(listener.selfMiningDetail.pubKey) {
+		t.Fatal("dialer does not know the key of the listener")
+	}
+	inbound := waitPeers(t, listener, 1)[0]
+	if !inbound.pubKey.Equal(dialer.selfMiningDetail.pubKey) {
+		t.Fatal("listener does not know the key of the dialer")
+	}
+}
+
+/*
+TestPeerHandshakeRefusesImpostor checks that a miner claiming the key of a registered miner without its private key
+is refused
+*/
+func TestPeerHandshakeRefusesImpostor(t *testing.T) {
+	sm := newTestServiceMachine(t)
+	listener, victim, impostor := newTestNode(t, sm), newTestNode(t, sm), newTestNode(t, sm)
+	sm.register(listener.selfMiningDetail.pubKeyStr)
+	sm.register(victim.selfMiningDetail.pubKeyStr)
+
+	address, done := listen(t, listener)
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	if err := writePeerMessage(conn, PeerHello{PubKey: victim.selfMiningDetail.pubKeyStr, Nonce: "n"}); err != nil {
+		t.Fatal(err)
+	}
+	var handshake PeerHandshake
+	if err := readPeerMessage(reader, &handshake); err != nil {
+		t.Fatal(err)
+	}
+	signature, _ := signParts(impostor.selfMiningDetail.prvKey, peerParts(victim.selfMiningDetail.pubKeyStr, handshake.Nonce, handshake.ChainID, handshake.ConfigHash, "")...)
+	writePeerMessage(conn, PeerProof{Signature: signature})
+
+	<-done
+	if peers := listener.peers(); len(peers) != 0 {
+		t.Fatalf("impostor was accepted")
+	}
+}
+
+/*
+TestPeerHandshakeRefusesUnregistered checks that a key unknown to the service machine is refused
+*/
+func TestPeerHandshakeRefusesUnregistered(t *testing.T) {
+	sm := newTestServiceMachine(t)
+	listener, dialer := newTestNode(t, sm), newTestNode(t, sm)
+	sm.register(listener.selfMiningDetail.pubKeyStr)
+
+	address, done := listen(t, listener)
+	if err := dialer.connectToMiner(address, nil); err == nil {
+		t.Fatal("unregistered miner connected")
+	}
+	<-done
+	if len(listener.peers()) != 0 {
+		t.Fatal("unregistered miner was accepted")
+	}
+}
+
+/*
+TestPeerHandshakeRefusesBanned checks that the ban list applies to the proven key
+*/
+func TestPeerHandshakeRefusesBanned(t *testing.T) {
+	sm := newTestServiceMachine(t)
+	listener, dialer := newTestNode(t, sm), newTestNode(t, sm)
+	sm.register(listener.selfMiningDetail.pubKeyStr)
+	sm.register(dialer.selfMiningDetail.pubKeyStr)
+	listener.banKey(dialer.selfMiningDetail.pubKeyStr)
+
+	address, done := listen(t, listener)
+	if err := dialer.connectToMiner(address, nil); err == nil {
+		t.Fatal("banned miner connected")
+	}
+	<-done
+	if len(listener.peers()) != 0 {
+		t.Fatal("banned miner was accepted")
+	}
+}
+
+/*
+TestPeerHandshakeRefusesOtherKey checks that the dialer refuses a miner proving another key than the expected one
+*/
+func TestPeerHandshakeRefusesOtherKey(t *testing.T) {
+	sm := newTestServiceMachine(t)
+	listener, dialer, other := newTestNode(t, sm), newTestNode(t, sm), newTestNode(t, sm)
+	sm.register(listener.selfMiningDetail.pubKeyStr)
+	sm.register(dialer.selfMiningDetail.pubKeyStr)
+
+	address, _ := listen(t, listener)
+	if err := dialer.connectToMiner(address, other.selfMiningDetail.pubKey); err == nil {
+		t.Fatal("dialer accepted another key than the expected one")
+	}
+	if len(dialer.peers()) != 0 {
+		t.Fatal("dialer kept the miner")
+	}
+}
+
+func TestGetPubKeyOfAddressMatchesPort(t *testing.T) {
+	sm := newTestServiceMachine(t)
+	first, second := newTestNode(t, sm), newTestNode(t, sm)
+	sm.mu.Lock()
+	sm.machines = []MachineDetail{
+		{IP: "10.0.0.1", Port: "8090", PubKey: first.selfMiningDetail.pubKeyStr},
+		{IP: "10.0.0.1", Port: "8091", PubKey: second.selfMiningDetail.pubKeyStr},
+	}
+	sm.mu.Unlock()
+
+	pubKey, err := getPubKeyOfAddress(sm.server.URL, "10.0.0.1:8091")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pubKey == nil || !pubKey.Equal(second.selfMiningDetail.pubKey) {
+		t.Fatal("key of the miner on another port of the same IP was returned")
+	}
+
+	pubKey, err = getPubKeyOfAddress(sm.server.URL, "10.0.0.1:8092")
+	if err != nil || pubKey != nil {
+		t.Fatalf("unregistered address: got key %v, error %v", pubKey, err)
+	}
+
+	sm.server.Close()
+	if _, err := getPubKeyOfAddress(sm.server.URL, "10.0.0.1:8090"); err == nil {
+		t.Fatal("unreachable service machine was not reported")
+	}
+}
+
+/*
+TestSilentMinerDoesNotBlockAccept checks that a connection that never sends its hello does not keep the other miners
+from connecting until the handshake timeout
+*/
+func TestSilentMinerDoesNotBlockAccept(t *testing.T) {
+	sm := newTestServiceMachine(t)
+	listener, dialer := newTestNode(t, sm), newTestNode(t, sm)
+	sm.register(listener.selfMiningDetail.pubKeyStr)
+	sm.register(dialer.selfMiningDetail.pubKeyStr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go listener.acceptMiners(ln, "127.0.0.1")
+
+	silent, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	start := time.Now()
+	if err := dialer.connectToMiner(ln.Addr().String(), listener.selfMiningDetail.pubKey); err != nil {
+		t.Fatal(err)
+	}
+	waitPeers(t, listener, 1)
+	if elapsed := time.Since(start); elapsed >= peerHandshakeTimeout {
+		t.Fatalf("miner accepted after %v, behind the silent connection", elapsed)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+/*
+	In this file the miners share the datasets and models they already hold, so every miner does not download them
+	from the service machine. A content a miner fetched is kept in its content cache (<data dir>/content/<CID>) and is
+	served to the other miners on /api/content of the external world server, as the same checksummed tar archive as
+	/fetch/archive of the service machine. A content downloaded from a miner must hash (see hashDir) to the hash
+	expected for its CID: the CID itself for the fs and s3 stores, the hash recorded by the transactions of the ledger
+	which used it, or the hash given by /fetch/hash of the service machine. The service machine is the fallback when
+	no miner has the content or its hash is unknown.
+	1-		ContentCache is a struct to store the content cache.
+	2-		newContentCache function which is used to create the content cache of the node configuration.
+	3-		fetchContent function which is used to download a content from the cache, the miners or the service machine.
+	4-		expectedContentHash function which is used to find the hash of the files of a CID.
+	5-		fetchFromPeer function which is used to download a content from a miner.
+	6-		handleGetContent function which is used to serve a cached content to the miners.
+*/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxContentPeers      = 5                // miners asked for a content before the service machine
+	peerContentTimeout   = 10 * time.Second // time a miner has to start sending a content, and to send more of it
+	contentCacheTempGlob = ".add-*"         // directories being added to the cache
+)
+
+/*
+peerContentClient is the client used to download content from the miners
+the download has no time limit, but a miner sending nothing for peerContentTimeout is given up
+*/
+var peerContentClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			conn, err := (&net.Dialer{Timeout: peerContentTimeout}).DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return idleTimeoutConn{Conn: conn, timeout: peerContentTimeout}, nil
+		},
+		ResponseHeaderTimeout: peerContentTimeout,
+	},
+}
+
+/*
+idleTimeoutConn is a connection whose reads fail when nothing is received for timeout
+*/
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c idleTimeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// contentCache is the content cache of the node, nil when caching is disabled, created once in main
+var contentCache *ContentCache
+
+// cacheKeyPattern is the format of the CIDs kept in the cache, IPFS CIDs and content IDs are alphanumeric
+var cacheKeyPattern = regexp.MustCompile(`^[A-Za-z0-9]{1,128}$`)
+
+/*
+ContentCache is a struct to store the content cache
+every content is the directory <dir>/<CID>, its modification time is the last use
+the least recently used contents are removed when the cache is larger than limit
+*/
+type ContentCache struct {
+	dir   string
+	limit int64
+	mu    sync.Mutex
+}
+
+/*
+newContentCache is a function to create the content cache of the node configuration
+returns nil if the cache size is 0
+*/
+func newContentCache(config NodeConfig) (*ContentCache, error) {
+	if config.ContentCacheSize == "0" {
+		return nil, nil
+	}
+	limit, err := parseMemory(config.ContentCacheSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content cache size %q", config.ContentCacheSize)
+	}
+
+	dir := config.dataPath("content")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create content cache %s: %v", dir, err)
+	}
+	// directories left by an interrupted add
+	if temps, err := filepath.Glob(filepath.Join(dir, contentCacheTempGlob)); err == nil {
+		for _, temp := range temps {
+			os.RemoveAll(temp)
+		}
+	}
+	return &ContentCache{dir: dir, limit: limit}, nil
+}
+
+/*
+path is a function to get the directory of a cached content, marked as used now
+*/
+func (c *ContentCache) path(cid string) (string, bool) {
+	if c == nil || !cacheKeyPattern.MatchString(cid) {
+		return "", false
+	}
+	dir := filepath.Join(c.dir, cid)
+	if _, err := os.Stat(dir); err != nil {
+		return "", false
+	}
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+	return dir, true
+}
+
+/*
+add is a function to copy the content in dir to the cache
+the content is copied to a temporary directory renamed to the CID, so a cached content is always complete
+*/
+func (c *ContentCache) add(cid string, dir string) {
+	if c == nil || !cacheKeyPattern.MatchString(cid) {
+		return
+	}
+	target := filepath.Join(c.dir, cid)
+	if _, err := os.Stat(target); err == nil {
+		return
+	}
+
+	temp, err := os.MkdirTemp(c.dir, contentCacheTempGlob)
+	if err != nil {
+		fmt.Printf("Error caching content %s: %v\n", cid, err)
+		return
+	}
+	defer os.RemoveAll(temp)
+	if err := os.CopyFS(temp, os.DirFS(dir)); err != nil {
+		fmt.Printf("Error caching content %s: %v\n", cid, err)
+		return
+	}
+	if err := os.Rename(temp, target); err != nil {
+		return
+	}
+	c.evict()
+}
+
+/*
+evict is a function to remove the least recently used contents until the cache fits in its size limit
+*/
+func (c *ContentCache) evict() {
+	type content struct {
+		cid  string
+		size int64
+		used time.Time
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+
+	var contents []content
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		size := dirSize(filepath.Join(c.dir, entry.Name()))
+		total += size
+		contents = append(contents, content{cid: entry.Name(), size: size, used: info.ModTime()})
+	}
+	sort.Slice(contents, func(i, j int) bool {
+		return contents[i].used.Before(contents[j].used)
+	})
+
+	for _, cached := range contents {
+		if total <= c.limit {
+			return
+		}
+		if err := os.RemoveAll(filepath.Join(c.dir, cached.cid)); err != nil {
+			fmt.Printf("Error removing cached content %s: %v\n", cached.cid, err)
+			continue
+		}
+		total -= cached.size
+		fmt.Printf("Cached content %s removed\n", cached.cid)
+	}
+}
+
+/*
+fetchContent is a function to download the files of a content to outputDir
+ 1. Copy it from the content cache
+ 2. Download it from up to maxContentPeers miners of the chain, if its hash is known
+ 3. Download it from the content store of the node, the service machine by default
+    A content downloaded from a miner or the service machine is added to the cache
+    The fs content store is already local, the cache and the miners are not used with it
+*/
+func (bf *ProofAIFactory) fetchContent(cid string, outputDir string) error {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+	store := contentStoreFor(bf.selfMiningDetail.serviceMachineURL())
+	if nodeConfig.ContentStore == "fs" {
+		return store.Fetch(cid, outputDir)
+	}
+
+	if dir, ok := contentCache.path(cid); ok {
+		if err := os.CopyFS(outputDir, os.DirFS(dir)); err == nil {
+			return nil
+		}
+		emptyDir(outputDir)
+	}
+
+	if peers := bf.contentPeers(); len(peers) > 0 {
+		if hash, size, ok := bf.expectedContentHash(cid); ok {
+			if size == 0 {
+				size, _ = nodeConfig.peerContentLimit()
+			}
+			for _, address := range peers {
+				err := fetchFromPeer(address, cid, hash, size, outputDir)
+				if err == nil {
+					fmt.Printf("Content %s downloaded from miner %s\n", cid, address)
+					contentCache.add(cid, outputDir)
+					return nil
+				}
+				fmt.Printf("Error downloading %s from miner %s: %v\n", cid, address, err)
+				emptyDir(outputDir)
+			}
+		}
+	}
+
+	if err := store.Fetch(cid, outputDir); err != nil {
+		return err
+	}
+	contentCache.add(cid, outputDir)
+	return nil
+}
+
+/*
+contentPeers is a function to get the external world addresses of up to maxContentPeers miners, in random order
+*/
+func (bf *ProofAIFactory) contentPeers() []string {
+	var addresses []string
+	for _, miner := range bf.peers() {
+		host, _, err := net.SplitHostPort(miner.conn.RemoteAddr().String())
+		if err == nil {
+			addresses = append(addresses, "http://"+net.JoinHostPort(host, "8079"))
+		}
+	}
+	rand.Shuffle(len(addresses), func(i, j int) {
+		addresses[i], addresses[j] = addresses[j], addresses[i]
+	})
+	if len(addresses) > maxContentPeers {
+		addresses = addresses[:maxContentPeers]
+	}
+	return addresses
+}
+
+/*
+expectedContentHash is a function to find the hash (see hashDir) of the files of a CID
+ 1. The IDs of the fs and s3 stores are the hash of their files
+ 2. The dataset and model hashes of the results and the artifacts of the transactions of the ledger
+ 3. The hash given by the service machine
+    Returns false when the hash is unknown, the content is then only downloaded from the service machine
+    The size of the files is returned when the artifacts of a transaction give it, 0 otherwise
+*/
+func (bf *ProofAIFactory) expectedContentHash(cid string) (string, int64, bool) {
+	if contentIDPattern.MatchString(cid) {
+		return cid, 0, true
+	}
+
+	blocks := bf.ledger.snapshot()
+	for i := len(blocks) - 1; i >= 0; i-- {
+		for _, transaction := range blocks[i].Transactions {
+			if result := transaction.Result; result != nil {
+				if transaction.Input_dataSet == cid && result.DatasetHash != "" {
+					return result.DatasetHash, 0, true
+				}
+				if transaction.Input_model == cid && result.ModelHash != "" {
+					return result.ModelHash, 0, true
+				}
+			}
+			if hash, size, ok := artifactsHash(transaction.Artifacts, cid); ok {
+				return hash, size, true
+			}
+		}
+	}
+
+	hash, err := fetchContentHash(bf.selfMiningDetail.serviceMachineURL(), cid)
+	if err != nil {
+		fmt.Printf("Hash of %s is unknown: %v\n", cid, err)
+		return "", 0, false
+	}
+	return hash, 0, true
+}
+
+/*
+artifactsHash is a function to compute the hash and the size of the outputs of a transaction uploaded as cid
+the outputs are the only files of their content, so the hash is computed like hashDir from their SHA-256 hashes
+*/
+func artifactsHash(artifacts []Artifact, cid string) (string, int64, bool) {
+	var lines []string
+	var size int64
+	for _, artifact := range artifacts {
+		if artifact.CID != cid {
+			return "", 0, false
+		}
+		lines = append(lines, fmt.Sprintf("%s\x00%s\n", artifact.Name, artifact.SHA256))
+		size += artifact.Size
+	}
+	if len(lines) == 0 {
+		return "", 0, false
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "")))
+	return hex.EncodeToString(sum[:]), size, true
+}
+
+/*
+fetchContentHash is a function to get the hash of the files of a CID from /fetch/hash of the service machine
+*/
+func fetchContentHash(serviceMachineURl string, cid string) (string, error) {
+	resp, err := http.Get(serviceMachineURl + "/fetch/hash?cid=" + url.QueryEscape(cid))
+	if err != nil {
+		return "", fmt.Errorf("failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("server returned status: %d", resp.StatusCode)
+	}
+
+	var response struct {
+		Hash string `json:"hash"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("failed to decode response: %v", err)
+	}
+	if !contentIDPattern.MatchString(response.Hash) {
+		return "", fmt.Errorf("invalid hash %q", response.Hash)
+	}
+	return response.Hash, nil
+}
+
+/*
+fetchFromPeer is a function to download a content from the miner at address
+the archive is extracted to outputDir, its files must hash to hash and the download stops past maxSize bytes of files
+*/
+func fetchFromPeer(address string, cid string, hash string, maxSize int64, outputDir string) error {
+	resp, err := peerContentClient.Get(address + "/api/content?cid=" + url.QueryEscape(cid))
+	if err != nil {
+		return fmt.Errorf("failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("miner returned status: %d", resp.StatusCode)
+	}
+
+	if _, err := extractArchive(resp.Body, outputDir, maxSize); err != nil {
+		return err
+	}
+	if sum, err := hashDir(outputDir); err != nil || sum != hash {
+		return fmt.Errorf("content does not match the hash of %s", cid)
+	}
+	return nil
+}
+
+/*
+emptyDir is a function to remove the files of a directory left by a failed download
+*/
+func emptyDir(dir string) {
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		os.RemoveAll(filepath.Join(dir, entry.Name()))
+	}
+}
+
+/*
+  - handleGetContent serves a cached content to the miners
+    Input parameters : cid
+    Output : the files of the content as a tar archive with checksums (see archive.go), or an error response
+*/
+func handleGetContent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Get method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	dir, ok := contentCache.path(r.URL.Query().Get("cid"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		response := map[string]string{"error": "Content not cached"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	if err := writeArchive(w, dir); err != nil {
+		// the status is already sent, the miner sees an archive without checksums
+		fmt.Printf("Error sending content %s: %v\n", filepath.Base(dir), err)
+	}
+}
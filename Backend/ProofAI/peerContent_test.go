@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+TestFetchFromPeerStopsAtMaxSize checks that a miner cannot fill the disk with a content larger than expected
+*/
+func TestFetchFromPeerStopsAtMaxSize(t *testing.T) {
+	contentDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(contentDir, "data.bin"), []byte(strings.Repeat("x", 4096)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hashDir(contentDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeArchive(w, contentDir)
+	}))
+	defer server.Close()
+
+	outputDir := t.TempDir()
+	if err := fetchFromPeer(server.URL, "cid", hash, 1024, outputDir); err == nil {
+		t.Fatal("content larger than the expected size was extracted")
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "data.bin")); err == nil {
+		t.Fatal("file larger than the expected size was written")
+	}
+
+	emptyDir(outputDir)
+	if err := fetchFromPeer(server.URL, "cid", hash, 4096, outputDir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/*
+TestIdleTimeoutConn checks that a read fails when the miner stops sending
+*/
+func TestIdleTimeoutConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := idleTimeoutConn{Conn: client, timeout: 50 * time.Millisecond}
+	defer conn.Close()
+
+	go server.Write([]byte("x"))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read of a silent connection succeeded")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("read of a silent connection did not time out")
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+/*
+	In this file we expose the connected miners through the local REST API and manage the ban list.
+	1. PeerInfo: struct returned by the peer API for every connected miner
+	2. recordMessage, recordTipHeight: functions to update the statistics of a miner
+	3. isBanned, banKey, unbanKey, bannedKeys: functions to manage the banned public keys
+	4. handleGetPeers: lists the connected miners
+	5. handleConnectPeer: connects to a miner manually
+	6. handleDisconnectPeer: disconnects a miner
+	7. handleBanPeer, handleUnbanPeer, handleGetBannedPeers: ban, unban and list banned public keys
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+/*
+PeerInfo is a struct to show the details of a connected miner
+*/
+type PeerInfo struct {
+	Address         string    `json:"address"`
+	PubKey          string    `json:"pubKey"`
+	Direction       string    `json:"direction"`
+	ConnectedSince  time.Time `json:"connectedSince"`
+	BytesIn         int64     `json:"bytesIn"`
+	BytesOut        int64     `json:"bytesOut"`
+	LastMessageAt   time.Time `json:"lastMessageAt"`
+	LastMessageType string    `json:"lastMessageType"`
+	TipHeight       int       `json:"tipHeight"`
+}
+
+/*
+recordMessage is a function to record the time and type of the last message received from a miner
+*/
+func (m *Miner) recordMessage(messageType string) {
+	m.statsMu.Lock()
+	m.lastMessageAt = time.Now()
+	m.lastMessageType = messageType
+	m.statsMu.Unlock()
+}
+
+/*
+recordTipHeight is a function to record the highest block number advertised by a miner
+*/
+func (m *Miner) recordTipHeight(blockNum int) {
+	m.statsMu.Lock()
+	if blockNum > m.tipHeight {
+		m.tipHeight = blockNum
+	}
+	m.statsMu.Unlock()
+}
+
+/*
+info is a function to collect the details of a miner for the peer API
+*/
+func (m *Miner) info() PeerInfo {
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+	return PeerInfo{
+		Address:         m.link.RemoteAddr().String(),
+		PubKey:          publicKeyToHex(m.pubKey),
+		Direction:       m.direction,
+		ConnectedSince:  m.connectedSince,
+		BytesIn:         m.bytesIn.Load(),
+		BytesOut:        m.bytesOut.Load(),
+		LastMessageAt:   m.lastMessageAt,
+		LastMessageType: m.lastMessageType,
+		TipHeight:       m.tipHeight,
+	}
+}
+
+/*
+isBanned is a function to check if a public key is banned, the empty key is never banned
+*/
+func (bf *ProofAIFactory) isBanned(pubKey string) bool {
+	if pubKey == "" {
+		return false
+	}
+	bf.bannedMu.RLock()
+	defer bf.bannedMu.RUnlock()
+	return bf.banned[pubKey]
+}
+
+/*
+banKey is a function to ban a public key and disconnect the miners using it
+*/
+func (bf *ProofAIFactory) banKey(pubKey string) {
+	bf.bannedMu.Lock()
+	bf.banned[pubKey] = true
+	bf.bannedMu.Unlock()
+
+	for _, miner := range bf.peers() {
+		if publicKeyToHex(miner.pubKey) == pubKey {
+			miner.disconnect()
+		}
+	}
+}
+
+/*
+unbanKey is a function to remove a public key from the ban list, returns false if it was not banned
+*/
+func (bf *ProofAIFactory) unbanKey(pubKey string) bool {
+	bf.bannedMu.Lock()
+	defer bf.bannedMu.Unlock()
+	if !bf.banned[pubKey] {
+		return false
+	}
+	delete(bf.banned, pubKey)
+	return true
+}
+
+/*
+bannedKeys is a function to list the banned public keys
+*/
+func (bf *ProofAIFactory) bannedKeys() []string {
+	bf.bannedMu.RLock()
+	defer bf.bannedMu.RUnlock()
+	keys := make([]string, 0, len(bf.banned))
+	for key := range bf.banned {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+  - handleGetPeers lists the connected miners
+    Output parameter : response
+*/
+func handleGetPeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Get method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	peers := []PeerInfo{}
+	for _, miner := range chain.peers() {
+		peers = append(peers, miner.info())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	response := map[string]interface{}{"peers": peers}
+	json.NewEncoder(w).Encode(response)
+}
+
+/*
+  - handleConnectPeer connects to a miner manually
+    Input parameter : address (ip:port of the connection port of the miner)
+    Output parameter : response
+    logic : The key registered with the address on the service machine must be the key proven in the handshake,
+    a miner registered with another address only has to prove a registered key.
+*/
+func handleConnectPeer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Post method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		response := map[string]string{"error": "Error parsing form data: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if pubKeyStr, _ := chain.selfMiningDetail.identity(); pubKeyStr == "" {
+		w.WriteHeader(http.StatusConflict)
+		response := map[string]string{"error": "No active session"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	address := r.FormValue("address")
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := map[string]string{"error": "Invalid address: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	serviceMachineURl := chain.selfMiningDetail.serviceMachineURL()
+	minerPubkey, err := getPubKeyOfAddress(serviceMachineURl, address)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		response := map[string]string{"error": "Error getting public key: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if err := chain.connectToMiner(address, minerPubkey); err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		response := map[string]string{"error": "Error connecting to miner: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := map[string]string{"connect": "Success"}
+	json.NewEncoder(w).Encode(response)
+}
+
+/*
+  - handleDisconnectPeer disconnects a miner
+    Input parameter : address or pubKey of the miner
+    Output parameter : response
+*/
+func handleDisconnectPeer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Post method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		response := map[string]string{"error": "Error parsing form data: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	address := r.FormValue("address")
+	pubKey := r.FormValue("pubKey")
+	if address == "" && pubKey == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		response := map[string]string{"error": "address or pubKey is required"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	disconnected := 0
+	for _, miner := range chain.peers() {
+		info := miner.info()
+		if (address != "" && info.Address == address) || (pubKey != "" && info.PubKey == pubKey) {
+			miner.disconnect()
+			disconnected++
+		}
+	}
+
+	if disconnected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		response := map[string]string{"error": "Miner not found"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := map[string]string{"disconnect": fmt.Sprintf("%d miner(s) disconnected", disconnected)}
+	json.NewEncoder(w).Encode(response)
+}
+
+/*
+  - handleBanPeer bans a public key and disconnects the miners using it
+    Input parameter : pubKey
+    Output parameter : response
+*/
+func handleBanPeer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Post method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		response := map[string]string{"error": "Error parsing form data: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	pubKey := r.FormValue("pubKey")
+	if _, err := hexToPublicKey(pubKey); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		response := map[string]string{"error": "Error decoding public key: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain.banKey(pubKey)
+	w.WriteHeader(http.StatusOK)
+	response := map[string]string{"ban": "Success"}
+	json.NewEncoder(w).Encode(response)
+}
+
+/*
+  - handleUnbanPeer removes a public key from the ban list
+    Input parameter : pubKey
+    Output parameter : response
+*/
+func handleUnbanPeer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Post method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		response := map[string]string{"error": "Error parsing form data: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if !chain.unbanKey(r.FormValue("pubKey")) {
+		w.WriteHeader(http.StatusNotFound)
+		response := map[string]string{"error": "Public key is not banned"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := map[string]string{"unban": "Success"}
+	json.NewEncoder(w).Encode(response)
+}
+
+/*
+  - handleGetBannedPeers lists the banned public keys
+    Output parameter : response
+*/
+func handleGetBannedPeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Get method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	response := map[string]interface{}{"banned": chain.bannedKeys()}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,202 @@
+package main
+
+/*
+	In this file we manage the content pinned on the service machine.
+	The service machine keeps an upload as long as its owner pins it or a transaction of the ledger references it,
+	other content is released after a retention period. The owner of an upload is the key that claims it when the
+	upload is finalized, and only that key can unpin it.
+	1-		contentReferences function which is used to list the CIDs referenced by the ledger, the mempool and the block being mined.
+	2-		handleGetContentRefs function which is used to send these CIDs to the service machine for its garbage collection.
+	3-		handleClaimUpload function which is used to sign the claim of an upload session by the node.
+	4-		handleGetPins function which is used to list the content pinned by the node and its quota.
+	5-		handleUnpin function which is used to unpin content owned by the node.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+contentReferences is a function to list the CIDs of the datasets, models and outputs used by the chain
+*/
+func (bf *ProofAIFactory) contentReferences() []string {
+	seen := map[string]bool{}
+	refs := []string{}
+	add := func(cid string) {
+		if cid != "" && !seen[cid] {
+			seen[cid] = true
+			refs = append(refs, cid)
+		}
+	}
+
+	for _, block := range bf.ledger.snapshot() {
+		for _, transaction := range block.Transactions {
+			add(transaction.Input_dataSet)
+			add(transaction.Input_model)
+			for _, artifact := range transaction.Artifacts {
+				add(artifact.CID)
+			}
+		}
+	}
+	for _, transaction := range bf.memPool.pending() {
+		add(transaction.Input_dataSet)
+		add(transaction.Input_model)
+	}
+	if block := bf.miningBlock(); block != nil {
+		for _, transaction := range block.Transactions {
+			add(transaction.Input_dataSet)
+			add(transaction.Input_model)
+		}
+	}
+	return refs
+}
+
+/*
+  - handleGetContentRefs sends the CIDs referenced by the chain to the service machine
+    Input parameters : chainId
+    Output : JSON list of CIDs
+*/
+func handleGetContentRefs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Get method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chain.contentReferences())
+}
+
+/*
+  - handleClaimUpload signs the claim of an upload session, the service machine makes the node owner of the upload
+    Input parameters : id (upload session)
+    Output : owner, nonce and signature, sent with /upload/finalize
+*/
+func handleClaimUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Post method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	id := r.FormValue("id")
+	if len(id) != 32 {
+		w.WriteHeader(http.StatusBadRequest)
+		response := map[string]string{"error": "Invalid upload session ID"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	owner, nonce, signature, err := chain.signMessage("pin", id)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		response := map[string]string{"error": "Error signing the claim: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	response := map[string]string{"owner": owner, "nonce": nonce, "signature": signature}
+	json.NewEncoder(w).Encode(response)
+}
+
+/*
+  - handleGetPins lists the content pinned by the node on the service machine
+    Output : pins, bytes used and quota of the node
+*/
+func handleGetPins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Get method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	owner, _ := chain.selfMiningDetail.identity()
+	resp, err := http.Get(chain.selfMiningDetail.serviceMachineURL() + "/pins?owner=" + url.QueryEscape(owner))
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		response := map[string]string{"error": "Error listing the pins: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	defer resp.Body.Close()
+
+	var pins json.RawMessage
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&pins) != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		response := map[string]string{"error": "Service machine has no pin management"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(pins)
+}
+
+/*
+  - handleUnpin unpins content owned by the node, the service machine keeps it while the ledger references it
+    Input parameters : cid
+*/
+func handleUnpin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Post method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	cid := r.FormValue("cid")
+	owner, nonce, signature, err := chain.signMessage("unpin", cid)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		response := map[string]string{"error": "Error signing the request: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	body, _ := json.Marshal(map[string]string{"cid": cid, "owner": owner, "nonce": nonce, "signature": signature})
+	resp, err := http.Post(chain.selfMiningDetail.serviceMachineURL()+"/pins/unpin", "application/json", bytes.NewReader(body))
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		response := map[string]string{"error": "Error unpinning: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		w.WriteHeader(resp.StatusCode)
+		response := map[string]string{"error": strings.TrimSpace(string(message))}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	response := map[string]string{"message": "Unpinned " + cid}
+	json.NewEncoder(w).Encode(response)
+}
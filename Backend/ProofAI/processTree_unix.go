@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+/*
+	In this file we kill the whole process tree of a command on Linux and macOS.
+	The command runs in its own process group, so pip, the training script and the processes they start are killed together.
+*/
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+/*
+killProcessTree is a function to make the cancellation of cmd kill its whole process tree
+must be called before cmd is started
+*/
+func killProcessTree(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 10 * time.Second
+}
@@ -0,0 +1,25 @@
+//go:build windows
+
+package main
+
+/*
+	In this file we kill the whole process tree of a command on Windows.
+	taskkill /T kills the command and every process it started.
+*/
+
+import (
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+/*
+killProcessTree is a function to make the cancellation of cmd kill its whole process tree
+must be called before cmd is started
+*/
+func killProcessTree(cmd *exec.Cmd) {
+	cmd.Cancel = func() error {
+		return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+	}
+	cmd.WaitDelay = 10 * time.Second
+}
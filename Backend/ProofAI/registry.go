@@ -0,0 +1,211 @@
+package main
+
+/*
+	In this file we use the registry of datasets and models of the service machine, which names and versions CIDs.
+	Transactions may be created with a registry reference (name or name@version) instead of a CID, the reference is
+	resolved to its CID before the transaction is signed, so the ledger always records the CID.
+	1-		RegistryEntry is a struct to store a version of a dataset or model.
+	2-		resolveContentRef function which is used to get the CID of a reference.
+	3-		handlePublishRegistry function which is used to publish a CID under a name, signed with the key of the node.
+	4-		handleGetRegistry function which is used to search the registry.
+	5-		signMessage function which is used to sign a request to the service machine with the key of the node and a nonce.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+RegistryEntry is a struct to store a version of a dataset or model of the registry
+*/
+type RegistryEntry struct {
+	Name        string    `json:"name"`
+	Version     int       `json:"version"`
+	Kind        string    `json:"kind"`
+	Owner       string    `json:"owner"`
+	CID         string    `json:"cid"`
+	Size        int64     `json:"size"`
+	Description string    `json:"description,omitempty"`
+	License     string    `json:"license,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// registryRefPattern is the format of a registry reference, name or name@version
+var registryRefPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}(@[0-9]+)?$`)
+
+/*
+resolveContentRef is a function to get the CID of ref
+ 1. A reference with a version must be in the registry
+ 2. A name of the registry gives the CID of its latest version
+ 3. Anything else is a CID, also when the service machine has no registry
+*/
+func resolveContentRef(serviceMachineURl string, ref string) (string, error) {
+	ref = strings.TrimSpace(ref)
+	if !registryRefPattern.MatchString(ref) {
+		return ref, nil
+	}
+	versioned := strings.Contains(ref, "@")
+
+	resp, err := http.Get(serviceMachineURl + "/registry/resolve?ref=" + url.QueryEscape(ref))
+	if err != nil {
+		if versioned {
+			return "", fmt.Errorf("failed to resolve %s: %v", ref, err)
+		}
+		return ref, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		if versioned {
+			message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			return "", fmt.Errorf("failed to resolve %s: %s", ref, strings.TrimSpace(string(message)))
+		}
+		return ref, nil
+	}
+
+	var entry RegistryEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil || entry.CID == "" {
+		return "", fmt.Errorf("invalid registry entry of %s", ref)
+	}
+	fmt.Printf("%s is %s@%d: %s\n", ref, entry.Name, entry.Version, entry.CID)
+	return entry.CID, nil
+}
+
+/*
+  - handlePublishRegistry publishes a CID under a name of the registry of the service machine
+    Input parameters : name, kind (dataset or model), cid, description, license
+    Output : the registry entry with its version, or an error response
+    logic : The entry is signed with the key of the node, which owns the name once its first version is published.
+*/
+func handlePublishRegistry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Post method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	entry := RegistryEntry{
+		Name:        r.FormValue("name"),
+		Kind:        r.FormValue("kind"),
+		CID:         r.FormValue("cid"),
+		Description: r.FormValue("description"),
+		License:     r.FormValue("license"),
+	}
+	owner, nonce, signature, err := chain.signMessage("registry", entry.Name, entry.Kind, entry.CID, entry.Description, entry.License)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		response := map[string]string{"error": "Error signing the entry: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	entry.Owner = owner
+
+	body, _ := json.Marshal(struct {
+		RegistryEntry
+		Nonce     string `json:"nonce"`
+		Signature string `json:"signature"`
+	}{entry, nonce, signature})
+	resp, err := http.Post(chain.selfMiningDetail.serviceMachineURL()+"/registry", "application/json", bytes.NewReader(body))
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		response := map[string]string{"error": "Error publishing the entry: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		w.WriteHeader(resp.StatusCode)
+		response := map[string]string{"error": strings.TrimSpace(string(message))}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		response := map[string]string{"error": "Error reading the entry: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	response := map[string]interface{}{"entry": entry}
+	json.NewEncoder(w).Encode(response)
+}
+
+/*
+signMessage is a function to sign a request to the service machine with the key of the node
+The parts and a nonce of the service machine are signed with signParts, so the request cannot be replayed
+Returns the public key of the node, the nonce and the signature
+*/
+func (bf *ProofAIFactory) signMessage(parts ...string) (string, string, string, error) {
+	pubKey, prvKey := bf.selfMiningDetail.identity()
+	if prvKey == nil {
+		return "", "", "", fmt.Errorf("login is required")
+	}
+	nonce, err := getNonce(bf.selfMiningDetail.serviceMachineURL(), pubKey)
+	if err != nil {
+		return "", "", "", err
+	}
+	signature, err := signParts(prvKey, append(parts, nonce)...)
+	return pubKey, nonce, signature, err
+}
+
+/*
+  - handleGetRegistry searches the registry of the service machine
+    Input parameters : optional q (name or description), kind, owner, latest=true
+    Output : the matching entries, newest version first
+*/
+func handleGetRegistry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Get method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	query := url.Values{}
+	for _, key := range []string{"q", "kind", "owner", "latest"} {
+		if value := r.URL.Query().Get(key); value != "" {
+			query.Set(key, value)
+		}
+	}
+	resp, err := http.Get(chain.selfMiningDetail.serviceMachineURL() + "/registry?" + query.Encode())
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		response := map[string]string{"error": "Error searching the registry: " + err.Error()}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	defer resp.Body.Close()
+
+	var entries []RegistryEntry
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&entries) != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		response := map[string]string{"error": fmt.Sprintf("Service machine has no registry (status %d)", resp.StatusCode)}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	response := map[string]interface{}{"entries": entries}
+	json.NewEncoder(w).Encode(response)
+}
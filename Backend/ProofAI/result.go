@@ -0,0 +1,185 @@
+package main
+
+/*
+	In this file we read the result of a training job. The script writes a JSON result file to the path in the
+	PROOFAI_RESULT environment variable ({output}/result.json):
+
+		{
+		  "version": 1,                                          # version of the result contract, required
+		  "metrics": {"loss": 0.12, "accuracy": 0.97, "custom": {"f1": 0.95}},
+		  "artifacts": ["model.pt"],                             # outputs of the manifest the script wrote
+		  "seed": 42,                                            # optional random seed of the run
+		  "frameworks": {"torch": "2.3.0"},                      # optional versions of the libraries used
+		  "error": ""                                            # a message here fails the transaction
+		}
+
+	The node adds the SHA-256 hashes of the dataset and model it downloaded, before the script could change them. Scripts without a result file are parsed as
+	before from the last {"model", "error"} JSON line they print.
+	1-		ModelResult is a struct to store the result of a job.
+	2-		readModelResult function which is used to read and validate the result of a finished job.
+	3-		hashDir function which is used to hash the dataset and model directories.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	resultFile    = "result.json" // name of the result file in the output directory
+	resultEnv     = "PROOFAI_RESULT"
+	resultVersion = 1       // version of the result contract this node reads
+	maxResultSize = 1 << 20 // largest result file accepted
+)
+
+/*
+ModelResult is a struct to store the result of a job
+  - Metrics, Artifacts, Seed, Frameworks and Error are written by the script
+  - DatasetHash and ModelHash are computed by the node
+*/
+type ModelResult struct {
+	Version     int               `json:"version"`
+	Metrics     ResultMetrics     `json:"metrics"`
+	Artifacts   []string          `json:"artifacts,omitempty"`
+	Seed        *int64            `json:"seed,omitempty"`
+	Frameworks  map[string]string `json:"frameworks,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	DatasetHash string            `json:"datasetHash,omitempty"`
+	ModelHash   string            `json:"modelHash,omitempty"`
+}
+
+/*
+ResultMetrics is a struct to store the metrics of a job, Loss and Accuracy are optional
+*/
+type ResultMetrics struct {
+	Loss     *float64           `json:"loss,omitempty"`
+	Accuracy *float64           `json:"accuracy,omitempty"`
+	Custom   map[string]float64 `json:"custom,omitempty"`
+}
+
+/*
+validate is a function to check the result against the contract
+  - the version must be the one of this node
+  - accuracy is between 0 and 1, loss is not negative
+  - artifacts are outputs declared in the manifest
+  - metric and framework names are not empty
+*/
+func (r ModelResult) validate(manifest JobManifest) error {
+	if r.Version != resultVersion {
+		return fmt.Errorf("unsupported result version %d, expected %d", r.Version, resultVersion)
+	}
+	if r.Metrics.Loss != nil && *r.Metrics.Loss < 0 {
+		return fmt.Errorf("loss must not be negative")
+	}
+	if r.Metrics.Accuracy != nil && (*r.Metrics.Accuracy < 0 || *r.Metrics.Accuracy > 1) {
+		return fmt.Errorf("accuracy must be between 0 and 1")
+	}
+	for name := range r.Metrics.Custom {
+		if name == "" {
+			return fmt.Errorf("custom metric without a name")
+		}
+	}
+
+	declared := map[string]bool{}
+	for _, output := range manifest.Outputs {
+		declared[output] = true
+	}
+	for _, artifact := range r.Artifacts {
+		if !declared[artifact] {
+			return fmt.Errorf("artifact %q is not an output of the manifest", artifact)
+		}
+	}
+
+	for name, version := range r.Frameworks {
+		if name == "" || version == "" {
+			return fmt.Errorf("framework versions need a name and a version")
+		}
+	}
+	return nil
+}
+
+/*
+readModelResult is a function to read the result of a finished job
+ 1. Read and validate the result file of the output directory, unknown fields are an error, links are refused
+ 2. Without a result file, parse the output of the script as a legacy {"model", "error"} output
+    Returns the result and the legacy model output, one of them is nil
+*/
+func readModelResult(dirPath string, manifest JobManifest, scriptOutput []byte) (*ModelResult, []byte, error) {
+	outputDir := filepath.Join(dirPath, "output")
+	if _, err := os.Lstat(filepath.Join(outputDir, resultFile)); os.IsNotExist(err) {
+		model, err := parseModelOutput(scriptOutput)
+		return nil, model, err
+	}
+	// the job writes the result file, a link to a file of the host is refused
+	if err := checkOutputPath(outputDir, resultFile); err != nil {
+		return nil, nil, err
+	}
+	file, err := openRegularFile(filepath.Join(outputDir, resultFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open %s: %v", resultFile, err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxResultSize+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %v", resultFile, err)
+	}
+	if len(data) > maxResultSize {
+		return nil, nil, fmt.Errorf("%s is larger than %d bytes", resultFile, maxResultSize)
+	}
+
+	var result ModelResult
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s: %v", resultFile, err)
+	}
+	if err := result.validate(manifest); err != nil {
+		return nil, nil, fmt.Errorf("invalid %s: %v", resultFile, err)
+	}
+	if result.Error != "" {
+		return nil, nil, fmt.Errorf("Python script error: %s", result.Error)
+	}
+	result.DatasetHash, result.ModelHash = "", ""
+	return &result, nil, nil
+}
+
+/*
+hashDir is a function to get the SHA-256 hash of the files of a directory
+the relative path and the hash of every file are hashed in path order, so the same content always gives the same hash
+*/
+func hashDir(dir string) (string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list %s: %v", filepath.Base(dir), err)
+	}
+	sort.Strings(files)
+
+	hash := sha256.New()
+	for _, path := range files {
+		sum, _, err := hashFile(path)
+		if err != nil {
+			return "", err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		fmt.Fprintf(hash, "%s\x00%s\n", filepath.ToSlash(rel), sum)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -11,6 +11,8 @@ package main
   7-		keyToHex is a function to convert public and private key to hex string
   8-		keyVerification is a function to verify the public and private key
   9-		hexToPrivateKey is a function to convert hex string to private key
+  10-		publicKeyToHex is a function to convert public key to hex string
+  11-		selfMiner and MemPool methods guard the fields shared between the HTTP handlers, peer readers and the mining loop
 */
 
 import (
@@ -24,24 +26,50 @@ import (
 	"math/big"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*
 Miner is a struct to store the miner details
  1. conn: connection object
- 2. write: writer object
- 3. read: reader object
- 4. pubKey: public key of the miner
+ 2. link: connection the read and write buffers are bound to
+ 3. write: writer object, only used by the writer goroutine of the miner
+ 4. read: reader object
+ 5. pubKey: public key of the miner
+ 6. blocks, transactions: bounded outbound queues drained by writeLoop, blocks are sent first
+ 7. closed: closed when the miner is disconnected
+ 8. chain: chain the miner is connected for, set by addMiner
+ 9. direction, connectedSince, bytesIn, bytesOut, lastMessageAt, lastMessageType, tipHeight: statistics shown by the peer API
 */
 type Miner struct {
-	conn   net.Conn
-	write  *bufio.Writer
-	read   *bufio.Reader
-	pubKey *ecdsa.PublicKey
+	conn         net.Conn
+	link         net.Conn
+	write        *bufio.Writer
+	read         *bufio.Reader
+	pubKey       *ecdsa.PublicKey
+	blocks       chan []byte
+	transactions chan []byte
+	closed       chan struct{}
+	closeOnce    sync.Once
+	chain        *ProofAIFactory
+
+	direction       string
+	connectedSince  time.Time
+	bytesIn         atomic.Int64
+	bytesOut        atomic.Int64
+	statsMu         sync.Mutex
+	lastMessageAt   time.Time
+	lastMessageType string
+	tipHeight       int
 }
 
 /*
 selfMiner is a struct to store the self miner details
+  - mu guards the keys, serviceMachineAddr, advertisedIP, advertisedPort, nonce, cancel, pendingInterrupts, role, connectionAlive, connListen, chainID, blockLength, powLenght and chainConfig
+  - miningSlot holds one token while a block is being mined or an incoming block is being verified,
+    so an incoming block interrupts the mining round and waits for it on the channel instead of polling
+  - CurrentlyMineBlock is only touched by the holder of miningSlot
 */
 type selfMiner struct {
 	pubKey             *ecdsa.PublicKey
@@ -49,28 +77,286 @@ type selfMiner struct {
 	pubKeyStr          string
 	prvKeyStr          string
 	nonce              int
-	context            context.Context
 	cancel             context.CancelFunc
+	miningSlot         chan struct{}
+	pendingInterrupts  int
 	CurrentlyMineBlock Block
-	interuptStatus     bool
 	role               string
 	connectionAlive    bool
 	serviceMachineAddr string
+	advertisedIP       string
+	advertisedPort     string
 	transactionFile    string
 	connListen         net.Listener
 	mu                 sync.Mutex
+	chainID            string
 	blockLength        int
 	powLenght          int
-	LedgerFile         string
+	chainConfig        ChainInfo
 	readLedger         bool
 }
 
 /*
 MemPool is a struct to store the memory pool details
 transactions: list of transactions
+mu: guards transactions
+added: signalled (without blocking) whenever a transaction is added so the mining loop wakes up
 */
 type MemPool struct {
+	mu           sync.Mutex
 	transactions []Transaction
+	added        chan struct{}
+}
+
+/*
+newMemPool creates an empty memory pool
+*/
+func newMemPool() MemPool {
+	return MemPool{added: make(chan struct{}, 1)}
+}
+
+/*
+add appends a transaction to the memory pool and wakes up the mining loop
+*/
+func (mp *MemPool) add(transaction Transaction) {
+	mp.mu.Lock()
+	mp.transactions = append(mp.transactions, transaction)
+	mp.mu.Unlock()
+
+	select {
+	case mp.added <- struct{}{}:
+	default:
+	}
+}
+
+/*
+take removes and returns at most n transactions from the front of the memory pool
+*/
+func (mp *MemPool) take(n int) []Transaction {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if n > len(mp.transactions) {
+		n = len(mp.transactions)
+	}
+	taken := make([]Transaction, n)
+	copy(taken, mp.transactions[:n])
+	indices := make([]int, n)
+	for i := range indices {
+		indices[i] = i
+	}
+	mp.transactions = RemoveByIndex(mp.transactions, indices)
+	return taken
+}
+
+/*
+pending returns a copy of the transactions of the memory pool
+*/
+func (mp *MemPool) pending() []Transaction {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return append([]Transaction(nil), mp.transactions...)
+}
+
+/*
+reset empties the memory pool
+*/
+func (mp *MemPool) reset() {
+	mp.mu.Lock()
+	mp.transactions = nil
+	mp.mu.Unlock()
+}
+
+/*
+getRole returns the current role of the node ("Miner" or "Validator")
+*/
+func (sm *selfMiner) getRole() string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.role
+}
+
+/*
+setRole sets the role of the node
+*/
+func (sm *selfMiner) setRole(role string) {
+	sm.mu.Lock()
+	sm.role = role
+	sm.mu.Unlock()
+}
+
+/*
+identity returns the public key (hex) and the private key of the logged in miner
+*/
+func (sm *selfMiner) identity() (string, *ecdsa.PrivateKey) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.pubKeyStr, sm.prvKey
+}
+
+/*
+serviceMachineURL returns the base URL of the service machine of the session
+*/
+func (sm *selfMiner) serviceMachineURL() string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return "http://" + sm.serviceMachineAddr
+}
+
+/*
+advertisedAddress returns the IP and port the miner is registered with on the service machine, empty until registered
+*/
+func (sm *selfMiner) advertisedAddress() (string, string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.advertisedIP, sm.advertisedPort
+}
+
+/*
+setAdvertisedAddress stores the IP and port the miner is registered with
+*/
+func (sm *selfMiner) setAdvertisedAddress(ip string, port string) {
+	sm.mu.Lock()
+	sm.advertisedIP = ip
+	sm.advertisedPort = port
+	sm.mu.Unlock()
+}
+
+/*
+isConnectionAlive reports whether the session still accepts peer traffic
+*/
+func (sm *selfMiner) isConnectionAlive() bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.connectionAlive
+}
+
+/*
+nextNonce returns the nonce for a new transaction and increments it
+*/
+func (sm *selfMiner) nextNonce() int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	nonce := sm.nonce
+	sm.nonce++
+	return nonce
+}
+
+/*
+setChainInfo stores the chain parameters received from the service machine
+*/
+func (sm *selfMiner) setChainInfo(chainID string, chainInfo ChainInfo) {
+	sm.mu.Lock()
+	sm.chainID = chainID
+	sm.blockLength = chainInfo.PowLen
+	sm.powLenght = chainInfo.Proof
+	sm.chainConfig = chainInfo
+	sm.mu.Unlock()
+}
+
+/*
+getChainConfig returns the configuration of the chain received from the service machine (see chainConfig.go)
+*/
+func (sm *selfMiner) getChainConfig() ChainInfo {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.chainConfig
+}
+
+/*
+getChainID returns the ID of the chain, empty until the service machine has answered the registration
+*/
+func (sm *selfMiner) getChainID() string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.chainID
+}
+
+/*
+chainInfo returns the block hash length and the proof of work length
+*/
+func (sm *selfMiner) chainInfo() (int, int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.blockLength, sm.powLenght
+}
+
+/*
+setListener stores the listener accepting peer connections
+*/
+func (sm *selfMiner) setListener(ln net.Listener) {
+	sm.mu.Lock()
+	sm.connListen = ln
+	sm.mu.Unlock()
+}
+
+/*
+acquireMiningSlot blocks until the mining slot is free or ctx is done
+returns false if ctx was done first
+*/
+func (sm *selfMiner) acquireMiningSlot(ctx context.Context) bool {
+	select {
+	case sm.miningSlot <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+/*
+releaseMiningSlot frees the mining slot taken by acquireMiningSlot
+*/
+func (sm *selfMiner) releaseMiningSlot() {
+	<-sm.miningSlot
+}
+
+/*
+startMiningRound derives the context of a new mining round from the session context
+The caller must hold the mining slot and call endMiningRound when the round is over.
+If an incoming block is already waiting for the slot the returned context is cancelled.
+*/
+func (sm *selfMiner) startMiningRound(ctx context.Context) context.Context {
+	roundCtx, cancel := context.WithCancel(ctx)
+	sm.mu.Lock()
+	sm.cancel = cancel
+	if sm.pendingInterrupts > 0 {
+		cancel()
+	}
+	sm.mu.Unlock()
+	return roundCtx
+}
+
+/*
+endMiningRound releases the context of the current mining round
+*/
+func (sm *selfMiner) endMiningRound() {
+	sm.mu.Lock()
+	cancel := sm.cancel
+	sm.cancel = nil
+	sm.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+/*
+interruptMining cancels the running mining round (if any) and waits for the mining slot
+The caller owns the slot afterwards and must call releaseMiningSlot
+*/
+func (sm *selfMiner) interruptMining() {
+	sm.mu.Lock()
+	sm.pendingInterrupts++
+	cancel := sm.cancel
+	sm.mu.Unlock()
+	if cancel != nil {
+		cancel() // it will stop the mining of current block and not move to the next block until released
+	}
+
+	sm.miningSlot <- struct{}{}
+
+	sm.mu.Lock()
+	sm.pendingInterrupts--
+	sm.mu.Unlock()
 }
 
 /*
@@ -108,13 +394,20 @@ func hexToPublicKey(hexStr string) (*ecdsa.PublicKey, error) {
 /*
 newMiner is a function to create a new miner object
  1. conn: connection object
- 2. returns miner object
+ 2. direction: "inbound" if the miner connected to us, "outbound" if we connected to it
+ 3. returns miner object
 */
-func newMiner(conn net.Conn) *Miner {
+func newMiner(conn net.Conn, direction string) *Miner {
 	return &Miner{
-		conn:  conn,
-		write: bufio.NewWriter(conn),
-		read:  bufio.NewReader(conn),
+		direction:      direction,
+		connectedSince: time.Now(),
+		conn:           conn,
+		link:           conn,
+		write:          bufio.NewWriter(conn),
+		read:           bufio.NewReader(conn),
+		blocks:         make(chan []byte, minerBlockQueueSize),
+		transactions:   make(chan []byte, minerTransactionQueueSize),
+		closed:         make(chan struct{}),
 	}
 }
 
@@ -140,14 +433,29 @@ keyToHex is a function to convert public and private key to hex string
 */
 func keyToHex(pub *ecdsa.PublicKey, priv *ecdsa.PrivateKey) (string, string) {
 
-	pubBytes := append([]byte{0x04}, pub.X.Bytes()...)
-	pubBytes = append(pubBytes, pub.Y.Bytes()...)
-	pubHex := hex.EncodeToString(pubBytes)
+	pubHex := publicKeyToHex(pub)
 	privHex := hex.EncodeToString(priv.D.Bytes())
 
 	return pubHex, privHex
 }
 
+/*
+publicKeyToHex is a function to convert a public key to hex string
+ 1. pub: public key, nil gives an empty string
+ 2. returns public key in the same hex format as keyToHex
+*/
+func publicKeyToHex(pub *ecdsa.PublicKey) string {
+	if pub == nil {
+		return ""
+	}
+	// coordinates are padded to 32 bytes so the key matches the uncompressed key registered on the service machine
+	pubBytes := make([]byte, 65)
+	pubBytes[0] = 0x04
+	pub.X.FillBytes(pubBytes[1:33])
+	pub.Y.FillBytes(pubBytes[33:])
+	return hex.EncodeToString(pubBytes)
+}
+
 /*
 keyVerification is a function to verify the public and private key
  1. pub: public key
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+TestMemPoolConcurrentAddTake adds and takes transactions from several goroutines, every transaction is taken once
+*/
+func TestMemPoolConcurrentAddTake(t *testing.T) {
+	memPool := newMemPool()
+
+	const producers, perProducer = 4, 50
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				memPool.add(Transaction{Signature: fmt.Sprintf("%d-%d", p, i)})
+			}
+		}(p)
+	}
+
+	var mu sync.Mutex
+	taken := map[string]int{}
+	done := make(chan struct{})
+	var consumers sync.WaitGroup
+	for c := 0; c < 2; c++ {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			for {
+				transactions := memPool.take(3)
+				mu.Lock()
+				for _, transaction := range transactions {
+					taken[transaction.Signature]++
+				}
+				mu.Unlock()
+				memPool.pending()
+				if len(transactions) == 0 {
+					select {
+					case <-done:
+						return
+					default:
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	consumers.Wait()
+
+	for _, transaction := range memPool.take(producers * perProducer) {
+		taken[transaction.Signature]++
+	}
+	if len(taken) != producers*perProducer {
+		t.Fatalf("took %d transactions, want %d", len(taken), producers*perProducer)
+	}
+	for signature, count := range taken {
+		if count != 1 {
+			t.Fatalf("transaction %s taken %d times", signature, count)
+		}
+	}
+}
+
+/*
+TestMemPoolAddWakesMiner checks that add signals the mining loop without blocking when nobody waits
+*/
+func TestMemPoolAddWakesMiner(t *testing.T) {
+	memPool := newMemPool()
+	memPool.add(Transaction{Signature: "a"})
+	memPool.add(Transaction{Signature: "b"})
+
+	select {
+	case <-memPool.added:
+	default:
+		t.Fatal("add did not signal the mining loop")
+	}
+	if pending := memPool.pending(); len(pending) != 2 {
+		t.Fatalf("mempool has %d transactions, want 2", len(pending))
+	}
+}
+
+/*
+TestInterruptMiningHandoff checks that an incoming block cancels the running mining round and gets the mining slot
+once the round has released it
+*/
+func TestInterruptMiningHandoff(t *testing.T) {
+	sm := &selfMiner{miningSlot: make(chan struct{}, 1)}
+	ctx := context.Background()
+
+	if !sm.acquireMiningSlot(ctx) {
+		t.Fatal("mining slot is not free")
+	}
+	roundCtx := sm.startMiningRound(ctx)
+
+	roundStopped := make(chan struct{})
+	go func() {
+		<-roundCtx.Done()
+		sm.endMiningRound()
+		close(roundStopped)
+		sm.releaseMiningSlot()
+	}()
+
+	interrupted := make(chan struct{})
+	go func() {
+		sm.interruptMining()
+		select {
+		case <-roundStopped:
+		default:
+			t.Error("interruptMining got the slot before the mining round stopped")
+		}
+		close(interrupted)
+		sm.releaseMiningSlot()
+	}()
+
+	select {
+	case <-interrupted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("interruptMining did not get the mining slot")
+	}
+
+	if !sm.acquireMiningSlot(ctx) {
+		t.Fatal("mining slot was not released")
+	}
+	sm.releaseMiningSlot()
+}
+
+/*
+TestInterruptBeforeRound checks that a mining round started while an incoming block waits for the slot is cancelled
+at once, so the block does not wait for a whole round
+*/
+func TestInterruptBeforeRound(t *testing.T) {
+	sm := &selfMiner{miningSlot: make(chan struct{}, 1)}
+	ctx := context.Background()
+	if !sm.acquireMiningSlot(ctx) {
+		t.Fatal("mining slot is not free")
+	}
+
+	interrupted := make(chan struct{})
+	go func() {
+		sm.interruptMining()
+		close(interrupted)
+		sm.releaseMiningSlot()
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sm.mu.Lock()
+		pending := sm.pendingInterrupts
+		sm.mu.Unlock()
+		if pending == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("interruptMining is not waiting for the slot")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	roundCtx := sm.startMiningRound(ctx)
+	if roundCtx.Err() == nil {
+		t.Fatal("mining round started while a block waits for the slot")
+	}
+	sm.endMiningRound()
+	sm.releaseMiningSlot()
+
+	select {
+	case <-interrupted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("interruptMining did not get the mining slot")
+	}
+}
+
+/*
+TestAcquireMiningSlotCancelled checks that waiting for the slot stops with the session
+*/
+func TestAcquireMiningSlotCancelled(t *testing.T) {
+	sm := &selfMiner{miningSlot: make(chan struct{}, 1)}
+	sm.acquireMiningSlot(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if sm.acquireMiningSlot(ctx) {
+		t.Fatal("acquired a mining slot that is taken")
+	}
+}
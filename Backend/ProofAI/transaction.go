@@ -23,6 +23,8 @@ In this file We have defined the functions to handle transactions and blocks in
 	17. InsertBlockInledgerFile: function to insert a block in the ledger file
 	18. cleanDir: function to clean up a directory
 	19. userTransaction: function to create a transaction for the user
+	20. handleIncomingBlock: function to interrupt mining and verify a block received from a miner
+	21. mineNextBlock: function to mine one block from the mempool
 */
 
 import (
@@ -33,15 +35,15 @@ import (
 	"encoding/asn1"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/big"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 	"unsafe"
 )
@@ -71,11 +73,11 @@ type Response struct {
 }
 
 /*
-writeTransaction is a function to write a transaction to the buffer
+writeTransaction is a function to queue a transaction for a miner
  1. miner: miner object
  2. transaction: transaction object
  3. return: error
-    Json format of the transaction is written to the buffer
+    Json format of the transaction is queued and written by the writer goroutine of the miner
 */
 func writeTransaction(miner *Miner, transaction interface{}) error {
 
@@ -86,13 +88,19 @@ func writeTransaction(miner *Miner, transaction interface{}) error {
 	jsonData, err := json.Marshal(transaction)
 
 	if err != nil {
-		fmt.Printf("Error converting transaction to json format: %v", err)
+		return fmt.Errorf("Error converting transaction to json format: %v", err)
 	}
-	_, err = miner.write.WriteString(string(jsonData) + "\n")
+
+	var isBlock bool
+	switch transaction.(type) {
+	case Block, *Block:
+		isBlock = true
+	}
+
+	err = miner.enqueue(append(jsonData, '\n'), isBlock)
 	if err != nil {
 		return fmt.Errorf("Error writing transaction to buffer : %v", err)
 	}
-	miner.write.Flush()
 
 	return nil
 }
@@ -101,34 +109,32 @@ func writeTransaction(miner *Miner, transaction interface{}) error {
 readTransaction is a function to read a transaction from the buffer
  1. miner: miner object
     Read the transaction from the buffer and convert it to a transaction object
+    Drop the transaction if it belongs to another chain
     If the transaction is a block, verify the transactions in the block and add it to the ledger if valid and broadcast it to all miners
 */
-func readTransaction(miner *Miner) {
+func (bf *ProofAIFactory) readTransaction(miner *Miner) {
 
-	defer miner.conn.Close()
-	for ProofAI.selfMiningDetail.connectionAlive {
+	defer miner.disconnect()
+	for bf.selfMiningDetail.isConnectionAlive() {
 		jsonStr, err := miner.read.ReadString('\n')
 
 		if err != nil {
-
-			for i, m := range ProofAI.Miners {
-				if m == *miner {
-					// apply mutex lock below is code
-					ProofAI.selfMiningDetail.mu.Lock()
-					ProofAI.Miners = append(ProofAI.Miners[:i], ProofAI.Miners[i+1:]...)
-					ProofAI.selfMiningDetail.mu.Unlock()
-					fmt.Println("Miner removed from the list")
-					break
-				}
-			}
 			return
 		} else {
 
+			miner.bytesIn.Add(int64(len(jsonStr)))
 			var data map[string]interface{}
 			err = json.Unmarshal([]byte(jsonStr), &data)
 			if err != nil {
 				log.Printf("Error converting Transaction in json format to in Transacton struct ")
 			} else {
+				messageType, _ := data["type"].(string)
+				miner.recordMessage(messageType)
+
+				// messages of another chain are dropped, messages without a chain ID come from nodes before chain IDs
+				if chainID, _ := data["chainId"].(string); chainID != "" && chainID != bf.selfMiningDetail.getChainID() {
+					continue
+				}
 
 				switch data["type"] {
 
@@ -136,11 +142,10 @@ func readTransaction(miner *Miner) {
 
 					var transaction Transaction
 					json.Unmarshal([]byte(jsonStr), &transaction)
-					if _, exists := ProofAI.receivedTransaction[transaction.Signature]; !exists {
-						ProofAI.receivedTransaction[transaction.Signature] = true
-						broadcastTransaction(&ProofAI.Miners, transaction)
-						if ProofAI.selfMiningDetail.role == "Miner" {
-							ProofAI.memPool.transactions = append(ProofAI.memPool.transactions, transaction)
+					if bf.markTransactionReceived(transaction.Signature) {
+						broadcastTransaction(bf.peers(), transaction)
+						if bf.selfMiningDetail.getRole() == "Miner" {
+							bf.memPool.add(transaction)
 							fmt.Println("Transaction Received For mining")
 						} else {
 							fmt.Println("Transaction Received But not for mining")
@@ -150,30 +155,12 @@ func readTransaction(miner *Miner) {
 				case "block":
 					var block Block
 					json.Unmarshal([]byte(jsonStr), &block)
+					miner.recordTipHeight(block.BlockNum)
 					fmt.Println(time.Now())
-					if _, exists := ProofAI.receivedBlock[block.TransactionsHash]; !exists {
-						ProofAI.receivedBlock[block.TransactionsHash] = true
+					if bf.markBlockReceived(block.TransactionsHash) {
 						fmt.Println("Block Received to insert in ledger")
-						if ProofAI.CurrentlyMineBlock != nil {
-
-							if len(ProofAI.ledger.blocks) == 0 || block.BlockNum > ProofAI.ledger.blocks[len(ProofAI.ledger.blocks)-1].BlockNum {
-								fmt.Println(time.Now())
-								if ProofAI.selfMiningDetail.role == "Miner" {
-									ProofAI.selfMiningDetail.cancel() // it will stop the mining of current block and not move to the next block unitl
-									for !ProofAI.selfMiningDetail.interuptStatus {
-										time.Sleep(1 * time.Second)
-									}
-								}
-								fmt.Println("Block Received to insert in ledger 2 ")
-								fmt.Println(time.Now())
-
-								broadcastTransaction(&ProofAI.Miners, block)
-								fmt.Println("Block Received to insert in ledger 3 ")
-
-								IncomingBlockVerfication(&block)
-							} else {
-								fmt.Println("Block is already mined and inserted in ledger")
-							}
+						if bf.miningBlock() != nil {
+							bf.handleIncomingBlock(&block)
 						} else {
 							fmt.Println("Block Skipped due to soon connection open")
 						}
@@ -184,22 +171,50 @@ func readTransaction(miner *Miner) {
 	}
 }
 
+/*
+handleIncomingBlock is a function to handle a block received from a miner
+ 1. block: block object
+    Refuse a block against the block policy or the allowed proposers of the chain (see chainConfig.go)
+    Interrupt the block being mined and wait until the mining round has stopped
+    If the block is newer than the ledger, broadcast it and verify it
+*/
+func (bf *ProofAIFactory) handleIncomingBlock(block *Block) {
+	if err := bf.checkBlockPolicy(block); err != nil {
+		fmt.Printf("Block refused: %v\n", err)
+		return
+	}
+
+	bf.selfMiningDetail.interruptMining()
+	defer bf.selfMiningDetail.releaseMiningSlot()
+	fmt.Println(time.Now())
+
+	if bf.miningBlock() == nil {
+		fmt.Println("Block is already mined and inserted in ledger")
+		return
+	}
+
+	latest, ok := bf.ledger.latest()
+	if ok && block.BlockNum <= latest.BlockNum {
+		fmt.Println("Block is already mined and inserted in ledger")
+		return
+	}
+
+	broadcastTransaction(bf.peers(), block)
+	bf.IncomingBlockVerfication(block)
+}
+
 /*
 broadcastTransaction is a function to broadcast a transaction to all miners
  1. miners: list of miners
  2. transaction: transaction object
-    Write the transaction to all miners
+    Queue the transaction for all miners, it never waits for a slow miner
 */
-func broadcastTransaction(miners *[]Miner, transaction interface{}) {
-	i := 0
-	for i < len(*miners) {
-
-		miner := (*miners)[i]
-		err := writeTransaction(&miner, transaction)
+func broadcastTransaction(miners []*Miner, transaction interface{}) {
+	for _, miner := range miners {
+		err := writeTransaction(miner, transaction)
 		if err != nil {
-			fmt.Printf("Error writing transaction to miner %v:\n", miner)
+			fmt.Printf("Error writing transaction to miner %v: %v\n", miner.conn.RemoteAddr(), err)
 		}
-		i++
 	}
 }
 
@@ -207,12 +222,13 @@ func broadcastTransaction(miners *[]Miner, transaction interface{}) {
 get Latest block and now compare with ledger check hash , and check hash of all miners
 block and choose having highest same hash block
 */
-func updateLedger() {
+func (bf *ProofAIFactory) updateLedger() {
 	// Loop through all miners
 	var latestMinersBlock []Block
-	for _, miner := range ProofAI.Miners {
+	chainQuery := url.QueryEscape(bf.selfMiningDetail.getChainID())
+	for _, miner := range bf.peers() {
 		IP := strings.Split(miner.conn.RemoteAddr().String(), ":")[0]
-		url := "http://" + IP + ":8079/api/latestBlock"
+		url := "http://" + IP + ":8079/api/latestBlock?chainId=" + chainQuery
 		fmt.Println("url", url)
 		res, err := http.Get(url)
 
@@ -251,6 +267,10 @@ func updateLedger() {
 				fmt.Printf("Error unmarshalling block to struct from %s: %v\n", IP, err)
 				continue
 			}
+			if err := bf.checkBlockPolicy(&block); err != nil {
+				fmt.Printf("Block of %s refused: %v\n", IP, err)
+				continue
+			}
 
 			fmt.Println("Block received from miner")
 			latestMinersBlock = append(latestMinersBlock, block)
@@ -264,13 +284,13 @@ func updateLedger() {
 		return
 	}
 
-	verfiyMinersLatestBlock(latestMinersBlock)
+	bf.verfiyMinersLatestBlock(latestMinersBlock)
 }
 
 /*
 find the hash of each block and then pick one block which has the highest same hash
 */
-func verfiyMinersLatestBlock(latestMinerBlock []Block) {
+func (bf *ProofAIFactory) verfiyMinersLatestBlock(latestMinerBlock []Block) {
 	// Get the hash of each block
 	hashes := make(map[string]int)
 	for _, block := range latestMinerBlock {
@@ -297,17 +317,20 @@ func verfiyMinersLatestBlock(latestMinerBlock []Block) {
 		}
 	}
 
-	if ProofAI.ledger.blocks == nil {
-		ProofAI.ledger.blocks = append(ProofAI.ledger.blocks, maxHashBlock)
-		InsertBlockInLedgerFile(&maxHashBlock)
+	bf.ledger.mu.Lock()
+	defer bf.ledger.mu.Unlock()
+
+	if bf.ledger.blocks == nil {
+		bf.ledger.blocks = append(bf.ledger.blocks, maxHashBlock)
+		InsertBlockInLedgerFile(bf.ledger.file, &maxHashBlock)
 		fmt.Println("Ledger Updated Successfully")
 		return
 	}
 
-	latestBlockIndex := len(ProofAI.ledger.blocks) - 1
+	latestBlockIndex := len(bf.ledger.blocks) - 1
 
 	// Compare the block with the ledger
-	ledgerBlock := ProofAI.ledger.blocks[latestBlockIndex]
+	ledgerBlock := bf.ledger.blocks[latestBlockIndex]
 	ledgerHash, err := hashStruct(ledgerBlock)
 	if err != nil {
 		fmt.Printf("Error hashing ledger block: %v\n", err)
@@ -319,22 +342,22 @@ func verfiyMinersLatestBlock(latestMinerBlock []Block) {
 		return
 	}
 
-	if ProofAI.ledger.blocks[latestBlockIndex].BlockNum == maxHashBlock.BlockNum {
+	if bf.ledger.blocks[latestBlockIndex].BlockNum == maxHashBlock.BlockNum {
 		// now compare the both hashes
 		if ledgerHash != maxHashBlockHash {
 			fmt.Println("Ledger block hash does not match with the max hash block")
-			ProofAI.ledger.blocks[latestBlockIndex] = maxHashBlock
+			bf.ledger.blocks[latestBlockIndex] = maxHashBlock
 			fmt.Println("Ledger updated successfully")
 			//	InsertBlockInLedgerFile(&maxHashBlock)
 		}
 	} else {
 
-		if ProofAI.ledger.blocks[latestBlockIndex].BlockNum > maxHashBlock.BlockNum {
+		if bf.ledger.blocks[latestBlockIndex].BlockNum > maxHashBlock.BlockNum {
 			fmt.Println("Ledger is already updated")
 			return
 		}
-		ProofAI.ledger.blocks = append(ProofAI.ledger.blocks, maxHashBlock)
-		InsertBlockInLedgerFile(&maxHashBlock)
+		bf.ledger.blocks = append(bf.ledger.blocks, maxHashBlock)
+		InsertBlockInLedgerFile(bf.ledger.file, &maxHashBlock)
 		fmt.Println("Ledger updated successfully")
 		return
 	}
@@ -384,7 +407,7 @@ transactionHash is a function to compute the hash of a transaction
     Ensure the transaction object is not nil
     Ensure the 'from' field is not empty
     Ensure the input fields are not empty
-    Compute the SHA-256 hash of the transaction data
+    Compute the SHA-256 hash of the transaction data, the chain ID is part of the data so a signed transaction cannot be replayed on another chain
 */
 func transactionHash(transaction *Transaction) string {
 	if transaction == nil {
@@ -401,7 +424,7 @@ func transactionHash(transaction *Transaction) string {
 		return ""
 	}
 
-	txdata := fmt.Sprintf("%s%d%s%s", transaction.From, transaction.Nonce, transaction.Input_dataSet, transaction.Input_model)
+	txdata := fmt.Sprintf("%s%d%s%s%s", transaction.From, transaction.Nonce, transaction.Input_dataSet, transaction.Input_model, transaction.ChainID)
 	hash := sha256.Sum256([]byte(txdata))
 	return hex.EncodeToString(hash[:])
 }
@@ -416,7 +439,7 @@ verifyTransaction is a function to verify the signature of a transaction
 */
 func verifyTransaction(publicKey *ecdsa.PublicKey, transaction *Transaction) (bool, error) {
 
-	txData := fmt.Sprintf("%s%d%s%s", transaction.From, transaction.Nonce, transaction.Input_dataSet, transaction.Input_model)
+	txData := fmt.Sprintf("%s%d%s%s%s", transaction.From, transaction.Nonce, transaction.Input_dataSet, transaction.Input_model, transaction.ChainID)
 
 	hash := sha256.New()
 	hash.Write([]byte(txData))
@@ -453,7 +476,7 @@ func hashStruct(data interface{}) (string, error) {
 
 	jsonBytes, err := json.Marshal(data)
 	if err != nil {
-		return "", fmt.Errorf("Error serializing struct %v")
+		return "", fmt.Errorf("Error serializing struct %v", err)
 	}
 	hash := sha256.Sum256(jsonBytes)
 	return hex.EncodeToString(hash[:]), nil
@@ -468,13 +491,13 @@ findBlockBy_Nonce_From is a function to find a block by nonce and from address
     Iterate through the transactions in the self-mined block
     Check if the transaction with the given nonce and from address exists
 */
-func findBlockBy_Nonce_From(nonce int, from string) bool {
+func (bf *ProofAIFactory) findBlockBy_Nonce_From(nonce int, from string) bool {
 	if nonce < 0 || from == "" {
 		fmt.Println("Invalid nonce or from address provided.")
 		return false
 	}
 
-	for _, transactions := range ProofAI.selfMiningDetail.CurrentlyMineBlock.Transactions {
+	for _, transactions := range bf.selfMiningDetail.CurrentlyMineBlock.Transactions {
 		if transactions.From == from && transactions.Nonce == nonce {
 			return true
 		}
@@ -488,23 +511,24 @@ IncomingBlockVerfication is a function to verify an incoming block
     each miner execute each transaction in the block and find own trained model and then verify the block by hash
     If the block is valid, add it to the ledger
     If the block is invalid, mine the block again where it paused
+    The caller must hold the mining slot
 */
-func IncomingBlockVerfication(block *Block) {
+func (bf *ProofAIFactory) IncomingBlockVerfication(block *Block) {
 
 	fmt.Println("Incoming Block Verification started")
 
-	if ProofAI.selfMiningDetail.role == "Miner" {
+	if bf.selfMiningDetail.getRole() == "Miner" {
 		for _, transaction := range block.Transactions {
 
 			fmt.Printf("Block Transaction nonce: %d, From: %s\n", transaction.Nonce, transaction.From)
-			transactionExist := findBlockBy_Nonce_From(transaction.Nonce, transaction.From)
+			transactionExist := bf.findBlockBy_Nonce_From(transaction.Nonce, transaction.From)
 			if !transactionExist {
 				fmt.Println("Above Transaction is need to be mined.")
-				MineTransaction(&transaction, &ProofAI.selfMiningDetail.CurrentlyMineBlock)
+				bf.MineTransaction(context.Background(), &transaction, &bf.selfMiningDetail.CurrentlyMineBlock)
 			}
 		}
 		fmt.Println("Transaction verification completed")
-		isValidBlock, err := IsIncomingBlockValid(block, ProofAI.selfMiningDetail.CurrentlyMineBlock.Transactions) // error in this
+		isValidBlock, err := bf.IsIncomingBlockValid(block, bf.selfMiningDetail.CurrentlyMineBlock.Transactions) // error in this
 		if err != nil {
 			fmt.Printf("Error during block verification: %v\n", err)
 			return
@@ -514,10 +538,15 @@ func IncomingBlockVerfication(block *Block) {
 			return
 		}
 		fmt.Println("Incoming block is invalid. Mining the block again start .")
-		err = PoW(ProofAI.CurrentlyMineBlock, nil)
+		if err := bf.selfMiningDetail.signBlock(bf.miningBlock()); err != nil {
+			fmt.Printf("Error signing block: %v\n", err)
+			bf.BlockMiningEnd()
+			return
+		}
+		err = PoW(bf.miningBlock(), context.Background())
 		if err != nil {
 			fmt.Printf("Error during Proof of Work for block: %v\n", err)
-			BlockMiningEnd()
+			bf.BlockMiningEnd()
 			return
 		}
 
@@ -527,21 +556,20 @@ func IncomingBlockVerfication(block *Block) {
 		fmt.Println("Block mined successfully. Broadcasting to all miners...")
 
 		// Add to receivedBlock and broadcast
-		ProofAI.receivedBlock[ProofAI.CurrentlyMineBlock.TransactionsHash] = true
+		bf.markBlockReceived(bf.miningBlock().TransactionsHash)
 
-		broadcastTransaction(&ProofAI.Miners, ProofAI.CurrentlyMineBlock)
+		broadcastTransaction(bf.peers(), bf.miningBlock())
 
 		// Log broadcast completion
 		fmt.Printf("Block broadcasted successfully at %s.\n", time.Now().Format(time.RFC3339))
 	} else {
 		fmt.Println("Only verified by POW.")
-		ProofAI.CurrentlyMineBlock = block
-		ProofAI.selfMiningDetail.CurrentlyMineBlock = *block
+		bf.selfMiningDetail.CurrentlyMineBlock = *block
+		bf.setMiningBlock(&bf.selfMiningDetail.CurrentlyMineBlock, bf.miningBlockForUser())
 	}
 
-	ProofAI.ledger.blocks = append(ProofAI.ledger.blocks, *ProofAI.CurrentlyMineBlock)
-	InsertBlockInLedgerFile(ProofAI.CurrentlyMineBlock)
-	BlockMiningEnd()
+	bf.ledger.commit(*bf.miningBlock())
+	bf.BlockMiningEnd()
 }
 
 /*
@@ -552,7 +580,7 @@ IsIncomingBlockValid is function used to verify the incoming block after each tr
     Compute the hash of the current block
     If the hashes match, add the block to the ledger
 */
-func IsIncomingBlockValid(block *Block, transactions []Transaction) (bool, error) {
+func (bf *ProofAIFactory) IsIncomingBlockValid(block *Block, transactions []Transaction) (bool, error) {
 
 	tempSelfMiningBlock := block
 	for i, transaction := range transactions {
@@ -577,9 +605,8 @@ func IsIncomingBlockValid(block *Block, transactions []Transaction) (bool, error
 	}
 
 	fmt.Println("Incoming block is valid and will now be added to the ledger.")
-	ProofAI.ledger.blocks = append(ProofAI.ledger.blocks, *block)
-	InsertBlockInLedgerFile(block)
-	BlockMiningEnd()
+	bf.ledger.commit(*block)
+	bf.BlockMiningEnd()
 
 	return true, nil
 }
@@ -587,8 +614,7 @@ func IsIncomingBlockValid(block *Block, transactions []Transaction) (bool, error
 /*
 generateBlock is a function to generate a block and mine it
 1- transactions: list of transactions
-2- wg: wait group object
-3- ctx: context object
+2- ctx: context of the mining round, cancelled when a block arrives from a miner
 
 	Get the previous block hash
 	If the previous block hash does not have the required prefix, set it to the genesis block hash
@@ -598,80 +624,93 @@ generateBlock is a function to generate a block and mine it
 	Set the transactions
 	Process the transactions
 	Compute the hash of the transactions
+	Set the total resource usage of the transactions
 	Set the block type
 	Set the timestamp
+	Sign the block with the key of the node
 	Perform Proof of Work
+	If the round is interrupted the block is left in place so that IncomingBlockVerfication can reuse the mined transactions
+	The caller must hold the mining slot
 */
-func generateBlock(trans_list []Transaction, wg *sync.WaitGroup, ctx context.Context) {
+func (bf *ProofAIFactory) generateBlock(trans_list []Transaction, ctx context.Context) {
 
-	defer wg.Done()
-	ProofAI.selfMiningDetail.interuptStatus = false
-	ProofAI.difficultyLevel = ProofAI.selfMiningDetail.powLenght
-	updateLedger()
+	_, powLenght := bf.selfMiningDetail.chainInfo()
+	bf.difficultyLevel = powLenght
+	bf.updateLedger()
 
-	ProofAI.selfMiningDetail.CurrentlyMineBlock = Block{}
-	ProofAI.CurrentlyMineBlock = &ProofAI.selfMiningDetail.CurrentlyMineBlock
-	ProofAI.CurrentlyMineBlock.Transactions = trans_list
+	bf.selfMiningDetail.CurrentlyMineBlock = Block{}
+	block := &bf.selfMiningDetail.CurrentlyMineBlock
+	block.Transactions = trans_list
 
-	blockSize := len(ProofAI.ledger.blocks)
 	var prev_blockHash string
 	var err error
-	if blockSize != 0 {
-		ProofAI.CurrentlyMineBlock.BlockNum = ProofAI.ledger.blocks[blockSize-1].BlockNum + 1
+	if lastBlock, ok := bf.ledger.latest(); ok {
+		block.BlockNum = lastBlock.BlockNum + 1
 		// Hash previous block
-		prev_blockHash, err = hashStruct(ProofAI.ledger.blocks[blockSize-1])
+		prev_blockHash, err = hashStruct(lastBlock)
 		if err != nil {
 			fmt.Println("Error constructing previous block hash.")
 			return
 		}
 	} else {
-		prev_blockHash = GenesisBlockHash()
-		ProofAI.CurrentlyMineBlock.BlockNum = 1
+		prev_blockHash = bf.GenesisBlockHash()
+		block.BlockNum = 1
 	}
 
-	if !strings.HasPrefix(prev_blockHash, strings.Repeat("0", ProofAI.difficultyLevel)) {
-		prev_blockHash = GenesisBlockHash()
+	if !strings.HasPrefix(prev_blockHash, strings.Repeat("0", bf.difficultyLevel)) {
+		prev_blockHash = bf.GenesisBlockHash()
 	}
 
-	ProofAI.CurrentlyMineBlock.Prev_Hash = prev_blockHash
-	ProofAI.CurrentlyMineBlock.ProposerId = ProofAI.selfMiningDetail.pubKeyStr
-	ProofAI.CurrentlyMineBlock.Difficulty = ProofAI.difficultyLevel
-	ProofAI.currentlyMiningBlockForUser = *ProofAI.CurrentlyMineBlock
-	ProofAI.CurrentlyMineBlock.Transactions = nil
+	block.Prev_Hash = prev_blockHash
+	block.ProposerId, _ = bf.selfMiningDetail.identity()
+	block.ChainID = bf.selfMiningDetail.getChainID()
+	block.Difficulty = bf.difficultyLevel
+	bf.setMiningBlock(block, *block)
+	block.Transactions = nil
 
 	for _, transaction := range trans_list { // Process transactions
-		transaction.BlockNum = ProofAI.CurrentlyMineBlock.BlockNum
-		MineTransaction(&transaction, ProofAI.CurrentlyMineBlock)
+		if ctx.Err() != nil {
+			break
+		}
+		transaction.BlockNum = block.BlockNum
+		bf.MineTransaction(ctx, &transaction, block)
 	}
 
-	trans_hash, err := hashStruct(ProofAI.CurrentlyMineBlock.Transactions)
+	trans_hash, err := hashStruct(block.Transactions)
 	if err != nil {
 		fmt.Printf("Error constructing block hash of transactions: %v\n", err)
-		BlockMiningEnd()
+		bf.BlockMiningEnd()
 		return
 	}
-	ProofAI.CurrentlyMineBlock.TransactionsHash = trans_hash
-	ProofAI.CurrentlyMineBlock.Type = "block"
-	ProofAI.CurrentlyMineBlock.TimeStamp = time.Now().Format(time.RFC3339)
-	ProofAI.CurrentlyMineBlock.Difficulty = ProofAI.difficultyLevel
+	block.TransactionsHash = trans_hash
+	block.Usage = totalUsage(block.Transactions)
+	block.Type = "block"
+	block.TimeStamp = time.Now().Format(time.RFC3339)
+	block.Difficulty = bf.difficultyLevel
 
 	if ctx.Err() != nil {
-		ProofAI.selfMiningDetail.interuptStatus = true
 		return
 	}
 
-	err = PoW(ProofAI.CurrentlyMineBlock, ctx)
+	if err := bf.selfMiningDetail.signBlock(block); err != nil {
+		fmt.Printf("Error signing block: %v\n", err)
+		bf.BlockMiningEnd()
+		return
+	}
+
+	err = PoW(block, ctx)
 	if err != nil {
 		fmt.Printf("Error during Proof of Work for block: %v\n", err)
-		BlockMiningEnd()
+		if ctx.Err() == nil {
+			bf.BlockMiningEnd()
+		}
 		return
 	}
 
-	ProofAI.receivedBlock[ProofAI.CurrentlyMineBlock.TransactionsHash] = true
-	broadcastTransaction(&ProofAI.Miners, ProofAI.CurrentlyMineBlock)
-	InsertBlockInLedgerFile(ProofAI.CurrentlyMineBlock)
-	ProofAI.ledger.blocks = append(ProofAI.ledger.blocks, *ProofAI.CurrentlyMineBlock)
-	BlockMiningEnd()
+	bf.markBlockReceived(block.TransactionsHash)
+	broadcastTransaction(bf.peers(), block)
+	bf.ledger.commit(*block)
+	bf.BlockMiningEnd()
 }
 
 /*
@@ -680,17 +719,17 @@ BlockMiningEnd is a function to end block mining
 	Set the currently mining block to nil
 	Set the currently mining block for the user to an empty block
 */
-func BlockMiningEnd() {
-	ProofAI.CurrentlyMineBlock = nil
-	ProofAI.currentlyMiningBlockForUser = Block{}
+func (bf *ProofAIFactory) BlockMiningEnd() {
+	bf.setMiningBlock(nil, Block{})
 }
 
 /*
 GenesisBlockHash is a function to generate the hash of the genesis block
  1. return: hash of the genesis block ( 0's of length equal to the block length)
 */
-func GenesisBlockHash() string {
-	requiredPrefix := strings.Repeat("0", ProofAI.selfMiningDetail.blockLength)
+func (bf *ProofAIFactory) GenesisBlockHash() string {
+	blockLength, _ := bf.selfMiningDetail.chainInfo()
+	requiredPrefix := strings.Repeat("0", blockLength)
 	return requiredPrefix
 }
 
@@ -719,7 +758,7 @@ PoW is a function to perform Proof of Work
     Compute the hash of the block
     Check if the hash has the required prefix
     If the hash has the required prefix, set the salt and return nil
-    If the context is canceled, set the interupt status and return an error
+    If the context is canceled, return an error
 */
 func PoW(block *Block, ctx context.Context) error {
 
@@ -744,7 +783,6 @@ func PoW(block *Block, ctx context.Context) error {
 		}
 
 		if ctx.Err() != nil {
-			ProofAI.selfMiningDetail.interuptStatus = true
 			return fmt.Errorf("Interup during POW")
 		}
 	}
@@ -770,94 +808,95 @@ func RemoveByIndex(transaction []Transaction, indices []int) []Transaction {
 
 /*
 BlockMining is a function to mine a block
- 1. ctx: context object
-    Check if the ledger has blocks
-    Get the last block
-    Parse the timestamp of the last block
-    Get the current time and calculate the difference
-    If the difference is greater than 5 minutes, start mining
-    Get only 2 transactions from the mempool if available, otherwise start mining with one transaction
+ 1. ctx: session context, the loop returns when it is done
+    Wake up when a transaction is added to the mempool or every minute
+    Mine blocks while mineNextBlock produces them
 */
-func BlockMining(ctx context.Context) {
+func (bf *ProofAIFactory) BlockMining(ctx context.Context) {
 
-	for ProofAI.selfMiningDetail.role != "Miner" {
-		time.Sleep(1 * time.Second)
-	}
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
 
 	for {
+		for bf.mineNextBlock(ctx) {
+		}
+
 		select {
 		case <-ctx.Done():
 			return
-		default:
+		case <-bf.memPool.added:
+		case <-ticker.C:
+		}
+	}
+}
 
-			if len(ProofAI.ledger.blocks) > 0 {
+/*
+mineNextBlock is a function to mine one block from the mempool
+ 1. ctx: session context
+    Check the role of the node, that it is an allowed proposer of the chain and that the chain has started
+    Check if the ledger has blocks
+    Get the last block
+    Parse the timestamp of the last block
+    Get the current time and calculate the difference
+    If the difference is greater than the block interval of the chain (2 minutes by default), start mining
+    Get at most the transactions of a block of the chain (2 by default) from the mempool
+    Return true if a mining round was run
+*/
+func (bf *ProofAIFactory) mineNextBlock(ctx context.Context) bool {
 
-				lastBlock := ProofAI.ledger.blocks[len(ProofAI.ledger.blocks)-1]
-				lastBlockTime, err := time.Parse(time.RFC3339, lastBlock.TimeStamp)
-				if err != nil {
-					fmt.Printf("Error parsing time: %v\n", err)
-					return
-				}
-				currentTime := time.Now()
-				diff := currentTime.Sub(lastBlockTime)
-				if diff.Minutes() > 2 {
-
-					if len(ProofAI.memPool.transactions) >= 2 {
-
-						var wg sync.WaitGroup
-						ProofAI.selfMiningDetail.context, ProofAI.selfMiningDetail.cancel = context.WithCancel(context.Background())
-						wg.Add(1)
-
-						go generateBlock(ProofAI.memPool.transactions[:2], &wg, ProofAI.selfMiningDetail.context)
-						wg.Wait()
-						removeList := []int{0, 1}
-						ProofAI.memPool.transactions = RemoveByIndex(ProofAI.memPool.transactions, removeList)
-					} else if len(ProofAI.memPool.transactions) == 1 {
-						var wg sync.WaitGroup
-						ProofAI.selfMiningDetail.context, ProofAI.selfMiningDetail.cancel = context.WithCancel(context.Background())
-						wg.Add(1)
-						go generateBlock(ProofAI.memPool.transactions[:1], &wg, ProofAI.selfMiningDetail.context)
-						wg.Wait()
-						removeList := []int{0}
-						ProofAI.memPool.transactions = RemoveByIndex(ProofAI.memPool.transactions, removeList)
-					}
-				} else {
-					time.Sleep(1 * time.Minute)
-				}
-			} else {
+	if bf.selfMiningDetail.getRole() != "Miner" {
+		return false
+	}
+	if pubKeyStr, _ := bf.selfMiningDetail.identity(); !bf.selfMiningDetail.canPropose(pubKeyStr) {
+		return false
+	}
+	if time.Now().Before(bf.selfMiningDetail.genesisTime()) {
+		return false
+	}
 
-				if len(ProofAI.memPool.transactions) >= 2 {
-
-					var wg sync.WaitGroup
-					ProofAI.selfMiningDetail.context, ProofAI.selfMiningDetail.cancel = context.WithCancel(context.Background())
-					wg.Add(1)
-
-					go generateBlock(ProofAI.memPool.transactions[:2], &wg, ProofAI.selfMiningDetail.context)
-					wg.Wait()
-					removeList := []int{0, 1}
-					ProofAI.memPool.transactions = RemoveByIndex(ProofAI.memPool.transactions, removeList)
-				} else if len(ProofAI.memPool.transactions) == 1 {
-					var wg sync.WaitGroup
-					ProofAI.selfMiningDetail.context, ProofAI.selfMiningDetail.cancel = context.WithCancel(context.Background())
-					wg.Add(1)
-					go generateBlock(ProofAI.memPool.transactions[:1], &wg, ProofAI.selfMiningDetail.context)
-					wg.Wait()
-					removeList := []int{0}
-					ProofAI.memPool.transactions = RemoveByIndex(ProofAI.memPool.transactions, removeList)
-				}
-			}
+	maxTransactions, interval := bf.selfMiningDetail.blockPolicy()
+	if lastBlock, ok := bf.ledger.latest(); ok {
+		lastBlockTime, err := time.Parse(time.RFC3339, lastBlock.TimeStamp)
+		if err != nil {
+			fmt.Printf("Error parsing time: %v\n", err)
+			return false
+		}
+		diff := time.Now().Sub(lastBlockTime)
+		if diff <= interval {
+			return false
 		}
 	}
+
+	if !bf.selfMiningDetail.acquireMiningSlot(ctx) {
+		return false
+	}
+	defer bf.selfMiningDetail.releaseMiningSlot()
+
+	roundCtx := bf.selfMiningDetail.startMiningRound(ctx)
+	defer bf.selfMiningDetail.endMiningRound()
+	if roundCtx.Err() != nil {
+		return false
+	}
+
+	transactions := bf.memPool.take(maxTransactions)
+	if len(transactions) == 0 {
+		return false
+	}
+
+	bf.generateBlock(transactions, roundCtx)
+	return true
 }
 
 /*
 MineTransaction is a function to mine a transaction
- 1. transaction: transaction object
- 2. block: block object
+ 1. ctx: context of the mining round, the execution is killed when it ends
+ 2. transaction: transaction object
+ 3. block: block object
     Execute the model
-    Add the transaction to the block
+    Record the status of the execution (succeeded, failed or timeout) and the uploaded outputs
+    Add the transaction to the block, an interrupted transaction is not added
 */
-func MineTransaction(transaction *Transaction, block *Block) {
+func (bf *ProofAIFactory) MineTransaction(ctx context.Context, transaction *Transaction, block *Block) {
 
 	pubkey, err := hexToPublicKey(transaction.From)
 	if err != nil {
@@ -877,29 +916,43 @@ func MineTransaction(transaction *Transaction, block *Block) {
 		fmt.Println("Transaction signature is valid")
 	}
 
-	dirPath := filepath.Join(os.TempDir(), ProofAI.modelExecutionDir+time.Now().Format("20060102150405"))
-
-	if _, err := os.Stat(dirPath); err == nil {
-		if err := os.RemoveAll(dirPath); err != nil {
-			fmt.Printf("Error removing existing directory: %v\n", err)
-			return
-		}
-		fmt.Println("Existing directory removed")
-	} else if !os.IsNotExist(err) {
-		fmt.Printf("Error checking directory existence: %v\n", err)
+	// every execution gets its own directory, so executions never share files
+	executionsDir := nodeConfig.dataPath("executions")
+	if err := os.MkdirAll(executionsDir, 0755); err != nil {
+		fmt.Printf("Error creating directory: %v\n", err)
 		return
 	}
-
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
+	dirPath, err := os.MkdirTemp(executionsDir, bf.modelExecutionDir+"_"+bf.selfMiningDetail.getChainID()+"_")
+	if err != nil {
 		fmt.Printf("Error creating directory: %v\n", err)
-		cleanDir(dirPath)
 		return
 	}
 
-	modelOutput, transactionLog, err := modelExecution(transaction.Input_dataSet, transaction.Input_model, dirPath)
+	chainID := bf.selfMiningDetail.getChainID()
+	logKey := transactionLogKey(chainID, transaction.From, transaction.Nonce)
+	stream := logStreams.open(chainID, logKey)
+	defer logStreams.finish(logKey, stream)
+
+	output, err := modelExecution(withLogStream(ctx, stream), bf, transaction.Input_dataSet, transaction.Input_model, dirPath)
+
+	switch {
+	case err == nil:
+		transaction.Status = ExecutionSucceeded
+	case errors.Is(err, context.DeadlineExceeded):
+		transaction.Status = ExecutionTimedOut
+	case ctx.Err() != nil:
+		fmt.Println("Transaction execution interrupted")
+		cleanDir(dirPath)
+		return
+	default:
+		transaction.Status = ExecutionFailed
+	}
 
-	transaction.Model_output = modelOutput
-	transaction.TransactionLog = transactionLog
+	transaction.Model_output = output.Model
+	transaction.Result = output.Result
+	transaction.TransactionLog = output.Log
+	transaction.Artifacts = output.Artifacts
+	transaction.Usage = output.Usage
 	block.Transactions = append(block.Transactions, *transaction)
 	cleanDir(dirPath)
 }
@@ -927,27 +980,28 @@ userTransaction is a function to create a transaction for the user
     Broadcast the transaction to all miners
     Return the transaction object
 */
-func userTransaction(model_cid string, dataset_cid string) (Transaction, error) {
+func (bf *ProofAIFactory) userTransaction(model_cid string, dataset_cid string) (Transaction, error) {
 
+	pubKeyStr, prvKey := bf.selfMiningDetail.identity()
 	transaction_ := Transaction{
-		From:          ProofAI.selfMiningDetail.pubKeyStr,
-		Nonce:         ProofAI.selfMiningDetail.nonce,
+		From:          pubKeyStr,
+		Nonce:         bf.selfMiningDetail.nextNonce(),
 		Input_dataSet: dataset_cid,
 		Input_model:   model_cid,
 		Type:          "transaction",
+		ChainID:       bf.selfMiningDetail.getChainID(),
 	}
 
 	transHash := transactionHash(&transaction_)
 	var err error
-	transaction_.Signature, err = signTransaction(ProofAI.selfMiningDetail.prvKey, transHash)
+	transaction_.Signature, err = signTransaction(prvKey, transHash)
 	if err != nil {
 		log.Printf("Error Signing transaction: %v\n", err)
 		return Transaction{}, err
 	}
-	ProofAI.selfMiningDetail.nonce += 1
-	ProofAI.receivedTransaction[transaction_.Signature] = true
-	ProofAI.memPool.transactions = append(ProofAI.memPool.transactions, transaction_)
-	broadcastTransaction(&ProofAI.Miners, &transaction_)
+	bf.markTransactionReceived(transaction_.Signature)
+	bf.memPool.add(transaction_)
+	broadcastTransaction(bf.peers(), &transaction_)
 
 	return transaction_, nil
 }
@@ -0,0 +1,269 @@
+package main
+
+/*
+	In this file we account the resources the execution of a transaction cost the miner.
+	The usage is stored in the transaction, the block holds the total of its transactions, and the API sums the usage
+	of the ledger per miner and per submitter.
+	1-		ResourceUsage is a struct to store the resources of an execution.
+	2-		processUsage function which is used to get the CPU time and peak memory of a finished command.
+	3-		measureContainer function which is used to sample the CPU time and peak memory of a running container from its cgroup.
+	4-		handleGetUsage function which is used to get the usage per miner and per submitter.
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ResourceUsage is a struct to store the resources of an execution
+ 1. WallTimeMs is the time of the execution, from the preparation of the environment to the end of the script
+ 2. CPUTimeMs and PeakMemoryBytes are measured on the process of the script and the processes it waited for
+ 3. DiskBytes is the size of the job directory after the execution, DownloadedBytes the size of the dataset and model
+*/
+type ResourceUsage struct {
+	WallTimeMs      int64 `json:"wallTimeMs"`
+	CPUTimeMs       int64 `json:"cpuTimeMs"`
+	PeakMemoryBytes int64 `json:"peakMemoryBytes"`
+	DiskBytes       int64 `json:"diskBytes"`
+	DownloadedBytes int64 `json:"downloadedBytes"`
+}
+
+/*
+add is a function to add the usage of another execution, the peak memory is the largest of both
+*/
+func (u *ResourceUsage) add(other ResourceUsage) {
+	u.WallTimeMs += other.WallTimeMs
+	u.CPUTimeMs += other.CPUTimeMs
+	u.DiskBytes += other.DiskBytes
+	u.DownloadedBytes += other.DownloadedBytes
+	if other.PeakMemoryBytes > u.PeakMemoryBytes {
+		u.PeakMemoryBytes = other.PeakMemoryBytes
+	}
+}
+
+/*
+totalUsage is a function to get the total usage of the transactions of a block, nil if none has a usage
+*/
+func totalUsage(transactions []Transaction) *ResourceUsage {
+	var total *ResourceUsage
+	for _, transaction := range transactions {
+		if transaction.Usage == nil {
+			continue
+		}
+		if total == nil {
+			total = &ResourceUsage{}
+		}
+		total.add(*transaction.Usage)
+	}
+	return total
+}
+
+/*
+processUsage is a function to get the CPU time and peak memory of a finished command
+*/
+func processUsage(state *os.ProcessState) ResourceUsage {
+	if state == nil {
+		return ResourceUsage{}
+	}
+	return ResourceUsage{
+		CPUTimeMs:       (state.UserTime() + state.SystemTime()).Milliseconds(),
+		PeakMemoryBytes: peakMemory(state),
+	}
+}
+
+// cgroupSampleInterval is the time between two reads of the cgroup of a running container
+const cgroupSampleInterval = 500 * time.Millisecond
+
+/*
+measureContainer is a function to sample the CPU time and peak memory of the container name into usage until the
+returned function is called, nil usage measures nothing
+The node reads the cgroup of the container on the host, so the job cannot change the usage it is accounted for. The
+cgroup is removed with the container, the usage is the last sample: the end of the job after it may be missed, and
+nothing is measured where the cgroup is not visible to the node (Docker Desktop, podman machine)
+*/
+func measureContainer(runtime string, name string, usage *ResourceUsage) (stop func()) {
+	if usage == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	measured := make(chan ResourceUsage, 1)
+	go func() {
+		var files cgroupFiles
+		var sample ResourceUsage
+		ticker := time.NewTicker(cgroupSampleInterval)
+		defer ticker.Stop()
+		for {
+			if files == (cgroupFiles{}) {
+				files = containerCgroup(runtime, name)
+			}
+			files.sample(&sample)
+			select {
+			case <-done:
+				measured <- sample
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		*usage = <-measured
+	}
+}
+
+/*
+cgroupFiles is a struct to store the files of a cgroup giving its usage
+  - cpuUsage is cpu.stat (usage_usec) on cgroup v2 and cpuacct.usage (nanoseconds) on cgroup v1
+  - peakMemory is memory.peak on cgroup v2 and memory.max_usage_in_bytes on cgroup v1
+  - memory is the current memory, sampled on kernels without memory.peak
+*/
+type cgroupFiles struct {
+	cpuUsage   string
+	peakMemory string
+	memory     string
+}
+
+/*
+containerCgroup is a function to get the cgroup files of a running container, empty while it is not running
+*/
+func containerCgroup(runtime string, name string) cgroupFiles {
+	out, err := exec.Command(runtime, "inspect", "--format", "{{.State.Pid}}", name).Output()
+	if err != nil {
+		return cgroupFiles{}
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil || pid <= 0 {
+		return cgroupFiles{}
+	}
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return cgroupFiles{}
+	}
+	return parseCgroupFiles(string(data), "/sys/fs/cgroup")
+}
+
+/*
+parseCgroupFiles is a function to get the cgroup files of a process from its /proc/<pid>/cgroup
+The cgroup v1 controllers are used when they are mounted, the unified hierarchy otherwise
+*/
+func parseCgroupFiles(procCgroup string, root string) cgroupFiles {
+	var files, unified cgroupFiles
+	for _, line := range strings.Split(strings.TrimSpace(procCgroup), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		controllers, path := fields[1], fields[2]
+		if fields[0] == "0" && controllers == "" {
+			unified = cgroupFiles{
+				cpuUsage:   filepath.Join(root, path, "cpu.stat"),
+				peakMemory: filepath.Join(root, path, "memory.peak"),
+				memory:     filepath.Join(root, path, "memory.current"),
+			}
+		}
+		for _, controller := range strings.Split(controllers, ",") {
+			switch controller {
+			case "cpuacct":
+				files.cpuUsage = filepath.Join(root, "cpuacct", path, "cpuacct.usage")
+			case "memory":
+				files.peakMemory = filepath.Join(root, "memory", path, "memory.max_usage_in_bytes")
+				files.memory = filepath.Join(root, "memory", path, "memory.usage_in_bytes")
+			}
+		}
+	}
+	if files.cpuUsage == "" && files.memory == "" {
+		return unified
+	}
+	return files
+}
+
+/*
+sample is a function to update usage with the cgroup, the CPU time only grows and the peak memory is the largest
+read, files that cannot be read are skipped
+*/
+func (files cgroupFiles) sample(usage *ResourceUsage) {
+	if files.cpuUsage != "" {
+		if data, err := os.ReadFile(files.cpuUsage); err == nil {
+			var cpuTimeMs int64
+			if filepath.Base(files.cpuUsage) == "cpu.stat" {
+				for _, line := range strings.Split(string(data), "\n") {
+					if value, found := strings.CutPrefix(line, "usage_usec "); found {
+						usec, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+						cpuTimeMs = usec / 1000
+					}
+				}
+			} else {
+				nsec, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+				cpuTimeMs = nsec / 1000000
+			}
+			usage.CPUTimeMs = max(usage.CPUTimeMs, cpuTimeMs)
+		}
+	}
+	for _, file := range []string{files.peakMemory, files.memory} {
+		if file == "" {
+			continue
+		}
+		if data, err := os.ReadFile(file); err == nil {
+			memory, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+			usage.PeakMemoryBytes = max(usage.PeakMemoryBytes, memory)
+		}
+	}
+}
+
+/*
+AccountUsage is a struct to store the usage of a miner or a submitter
+*/
+type AccountUsage struct {
+	Transactions int           `json:"transactions"`
+	Usage        ResourceUsage `json:"usage"`
+}
+
+/*
+  - handleGetUsage gets the resources spent on the transactions of the ledger
+    Output : usage per miner (the proposer of the block) and per submitter (the sender of the transaction)
+    logic : Transactions mined before the usage was recorded are not counted.
+*/
+func handleGetUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		response := map[string]string{"error": "Invalid Get method"}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	chain, ok := chainFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	miners := map[string]*AccountUsage{}
+	submitters := map[string]*AccountUsage{}
+	account := func(accounts map[string]*AccountUsage, key string, usage ResourceUsage) {
+		if accounts[key] == nil {
+			accounts[key] = &AccountUsage{}
+		}
+		accounts[key].Transactions++
+		accounts[key].Usage.add(usage)
+	}
+	for _, block := range chain.ledger.snapshot() {
+		for _, transaction := range block.Transactions {
+			if transaction.Usage == nil {
+				continue
+			}
+			account(miners, block.ProposerId, *transaction.Usage)
+			account(submitters, transaction.From, *transaction.Usage)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	response := map[string]interface{}{"miners": miners, "submitters": submitters}
+	json.NewEncoder(w).Encode(response)
+}
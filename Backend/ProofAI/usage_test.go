@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+TestParseCgroupFiles checks the cgroup files of a container on cgroup v2 and on cgroup v1
+*/
+func TestParseCgroupFiles(t *testing.T) {
+	unified := parseCgroupFiles("0::/system.slice/docker-abc.scope\n", "/sys/fs/cgroup")
+	if unified.cpuUsage != "/sys/fs/cgroup/system.slice/docker-abc.scope/cpu.stat" || unified.peakMemory != "/sys/fs/cgroup/system.slice/docker-abc.scope/memory.peak" {
+		t.Fatalf("cgroup v2 files %+v", unified)
+	}
+
+	v1 := parseCgroupFiles("12:memory:/docker/abc\n4:cpu,cpuacct:/docker/abc\n0::/\n", "/sys/fs/cgroup")
+	if v1.cpuUsage != "/sys/fs/cgroup/cpuacct/docker/abc/cpuacct.usage" || v1.peakMemory != "/sys/fs/cgroup/memory/docker/abc/memory.max_usage_in_bytes" {
+		t.Fatalf("cgroup v1 files %+v", v1)
+	}
+}
+
+/*
+TestCgroupSample checks that the CPU time is read from cpu.stat and the peak memory is the largest memory read
+*/
+func TestCgroupSample(t *testing.T) {
+	dir := t.TempDir()
+	files := parseCgroupFiles("0::/job\n", dir)
+	if err := os.MkdirAll(filepath.Join(dir, "job"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, content string) {
+		if err := os.WriteFile(filepath.Join(dir, "job", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var usage ResourceUsage
+	write("cpu.stat", "usage_usec 2500000\nuser_usec 2000000\nsystem_usec 500000\n")
+	write("memory.current", "4096\n")
+	files.sample(&usage)
+	write("memory.current", "1024\n")
+	files.sample(&usage)
+	if usage.CPUTimeMs != 2500 || usage.PeakMemoryBytes != 4096 {
+		t.Fatalf("usage %+v, want 2500ms and 4096 bytes", usage)
+	}
+}
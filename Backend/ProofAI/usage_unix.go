@@ -0,0 +1,28 @@
+//go:build !windows
+
+package main
+
+/*
+	In this file we read the peak memory of a finished command on Linux and macOS.
+*/
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+/*
+peakMemory is a function to get the peak resident memory of a finished command in bytes
+ru_maxrss is in bytes on macOS and in kilobytes on the other systems
+*/
+func peakMemory(state *os.ProcessState) int64 {
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	if runtime.GOOS == "darwin" {
+		return int64(rusage.Maxrss)
+	}
+	return int64(rusage.Maxrss) * 1024
+}
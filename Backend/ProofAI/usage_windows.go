@@ -0,0 +1,17 @@
+//go:build windows
+
+package main
+
+/*
+	In this file we read the peak memory of a finished command on Windows.
+*/
+
+import "os"
+
+/*
+peakMemory is a function to get the peak memory of a finished command
+Windows does not report it once the process has exited, so it is not measured
+*/
+func peakMemory(state *os.ProcessState) int64 {
+	return 0
+}
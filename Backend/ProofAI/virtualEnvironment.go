@@ -2,24 +2,30 @@ package main
 
 /*		In this file we run the model in a virtual environment.
 1-		ModelOuput is a struct to parse the output of the Python model script.
-2-		downloadFromIPFS function which is used to download files from the given URL. ( IPFS can be used to store the model and dataset )
-3-		modelExecution function which is used to create a virtual environment and execute the model.
+2-		The dataset and model are downloaded with fetchContent, from the other miners or the content store of the node (see peerContent.go).
+3-		modelExecution function which is used to download the dataset and model and execute the model with the configured Executor.
 4-    	readLogFileToBytes function which is used to read the log file into a byte array.
-5-		changeDir function which is used to change the current working directory.
-6-		runCommand function which is used to run a command in the command prompt.
-7-		runPythonFile function which is used to run a Python file in the command prompt.
+5-		runCommand function which is used to run a program with its arguments in a directory.
+6-		runPythonFile function which is used to run a Python file with the python of the virtual environment.
+7-		The working directory of the node is never changed, every path is absolute and commands run with cmd.Dir.
+		parseModelOutput function which is used to check the legacy output of the Python model script (see result.go).
+8-		pythonLauncher and venvPython functions which are used to find the python binaries on Windows, Linux and macOS.
+		runCommand and runPythonFile kill the whole process tree when their context ends (see processTree_unix.go and processTree_windows.go).
 */
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"time"
 )
 
@@ -34,175 +40,158 @@ type ModelOuput struct {
 }
 
 /*
-downloadFromIPFS is a function to download files from IPFS
- 1. cid: content identifier of the file
- 2. outputDir: output directory to save the files
-    Create the output directory
-    Prepare the request
-    Check the status code
-    Parse the response
-    Save each file
+ExecutionOutput is a struct to store what the execution of a transaction gives back
+ 1. Result is the result file of the job, Model the legacy ModelOuput of scripts without one
+ 2. Log is the transaction log, also set when the execution failed
+ 3. Artifacts are the uploaded outputs of the job
+ 4. Usage is the resources the execution cost, also set when the script failed
 */
-func downloadFromIPFS(cid string, outputDir string) error {
-	err := os.MkdirAll(outputDir, 0755)
-	if err != nil {
-		return fmt.Errorf("failed to create directory: %v", err)
-	}
-	serviceMachineURl := "http://" + ProofAI.selfMiningDetail.serviceMachineAddr
-
-	data := bytes.NewBufferString(fmt.Sprintf("cid=%s", cid))
-	resp, err := http.Post(serviceMachineURl+"/fetch", "application/x-www-form-urlencoded", data)
-	if err != nil {
-		return fmt.Errorf("failed to make request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	// Check status code
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned status: %d", resp.StatusCode)
-	}
-
-	// Parse response
-	var response Response
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&response); err != nil {
-		return fmt.Errorf("failed to decode response: %v", err)
-	}
-
-	if !response.Success {
-		return fmt.Errorf("server error: %s", response.Message)
-	}
-
-	for _, file := range response.Files {
-		filePath := filepath.Join(outputDir, file.Name)
-
-		// Write the content directly without base64 decoding
-		err = os.WriteFile(filePath, []byte(file.Content), 0644)
-		if err != nil {
-			return fmt.Errorf("failed to save file %s: %v", file.Name, err)
-		}
-	}
-
-	return nil
+type ExecutionOutput struct {
+	Result    *ModelResult
+	Model     []byte
+	Log       []byte
+	Artifacts []Artifact
+	Usage     *ResourceUsage
 }
 
 /*
-modelExecution is a function to create a virtual environment and execute the model
+modelExecution is a function to download the dataset and model and execute the model with the configured Executor
+the dataset and model are downloaded with fetchContent of chain, from the other miners or the service machine of the chain
+the execution stops when ctx ends or the timeout of the job is reached, the error then wraps context.Canceled or context.DeadlineExceeded
+the result file of the job is validated and gets the hashes of the downloaded dataset and model (see result.go)
+the declared outputs are uploaded through the service machine and returned as artifacts
+the log and the output of the commands are also written to the log stream of ctx, see logStream.go
 */
-func modelExecution(CID_Input_dataSet string, CID_Input_model string, dirPath string) ([]byte, []byte, error) {
+func modelExecution(ctx context.Context, chain *ProofAIFactory, CID_Input_dataSet string, CID_Input_model string, dirPath string) (ExecutionOutput, error) {
 
-	// create log file
-	timestamp := time.Now().Format("02_01_15_04_05")
-	logFileName := fmt.Sprintf("%s_TransactionLog.txt", timestamp)
-	currentdir, err := os.Getwd()
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get current working directory: %w", err)
-	}
-	logFilePath := filepath.Join(currentdir, logFileName)
+	// create log file in the job directory, it is removed with the directory once the log is in the transaction
+	// every line is also written to the log stream of the execution so it can be followed live
+	logFilePath := filepath.Join(dirPath, "TransactionLog.txt")
 	logFile, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create or open log file: %w", err)
+		return ExecutionOutput{}, fmt.Errorf("failed to create or open log file: %w", err)
 	}
 	defer logFile.Close()
-	logger := log.New(logFile, "", 0)
+	logger := log.New(io.MultiWriter(logFile, logStreamFrom(ctx)), "", 0)
+
+	// usage is measured once the script has run
+	var usage *ResourceUsage
+
+	// failed returns the log of the transaction with the error of the failed step
+	failed := func(err error) (ExecutionOutput, error) {
+		logData, logErr := readLogFileToBytes(logFilePath)
+		if logErr != nil {
+			logger.Printf("Error reading log file to bytes: %v", logErr)
+			return ExecutionOutput{}, err
+		}
+		return ExecutionOutput{Log: logData, Usage: usage}, err
+	}
 
-	// Download the dataset and model from IPFS
-	err = downloadFromIPFS(CID_Input_dataSet, filepath.Join(dirPath, "dataset"))
+	// Download the dataset and model from the miners or the service machine
+	err = chain.fetchContent(CID_Input_dataSet, filepath.Join(dirPath, "dataset"))
 	if err != nil {
 		logger.Printf("Error downloading dataset from IPFS: %v", err)
-		logData, err := readLogFileToBytes(logFilePath)
-		if err != nil {
-			logger.Printf("Error reading log file to bytes: %v", err)
-			return nil, nil, err
-		}
-		return nil, logData, err
+		return failed(err)
 	}
-	err = downloadFromIPFS(CID_Input_model, filepath.Join(dirPath, "model"))
+	err = chain.fetchContent(CID_Input_model, filepath.Join(dirPath, "model"))
 	if err != nil {
 		logger.Printf("Error downloading model from IPFS: %v", err)
-		logData, err := readLogFileToBytes(logFilePath)
-		if err != nil {
-			logger.Printf("Error reading log file to bytes: %v", err)
-			return nil, nil, err
-		}
-		return nil, logData, err
+		return failed(err)
 	}
 
-	virtualEnvDir := filepath.Join(dirPath, "virtualEnvironment")
+	downloaded := dirSize(filepath.Join(dirPath, "dataset")) + dirSize(filepath.Join(dirPath, "model"))
 
-	if err := os.Mkdir(virtualEnvDir, 0777); err != nil {
-		logger.Printf("Failed to create directory: %v", err)
-		return nil, nil, err
+	// hash the inputs before the script can change them
+	datasetHash, err := hashDir(filepath.Join(dirPath, "dataset"))
+	if err != nil {
+		logger.Printf("Failed to hash the dataset: %v", err)
+		return failed(err)
 	}
-	if err := os.Chdir(virtualEnvDir); err != nil {
-		logger.Printf("Failed to change directory: %v", err)
-		return nil, nil, err
+	modelHash, err := hashDir(filepath.Join(dirPath, "model"))
+	if err != nil {
+		logger.Printf("Failed to hash the model: %v", err)
+		return failed(err)
 	}
-	defer func() {
-		if err := os.Chdir(currentdir); err != nil {
-			logger.Printf("Failed to return to original directory: %v", err)
-		}
-	}()
-	//	logger.Printf("Directory %s is created and in use\n", virtualEnvDir)
 
-	// Execute commands for virtual environment setup and model execution
-	if _, err := runCommand("python -m venv Env"); err != nil {
-		logger.Printf("Failed to create virtual environment : %v", err)
-		logData, err := readLogFileToBytes(logFilePath)
-		if err != nil {
-			logger.Printf("Error reading log file to bytes: %v", err)
-			return nil, nil, err
-		}
-		return nil, logData, err
+	executor, err := newExecutor(nodeConfig)
+	if err != nil {
+		logger.Printf("Failed to create the executor: %v", err)
+		return failed(err)
 	}
-	logger.Printf("Virtual environment created\n")
 
-	if _, err := runCommand(".\\Env\\Scripts\\activate"); err != nil {
-		logger.Printf("Failed to activate virtual environment: %v", err)
-		logData, err := readLogFileToBytes(logFilePath)
-		if err != nil {
-			logger.Printf("Error reading log file to bytes: %v", err)
-			return nil, nil, err
-		}
-		return nil, logData, err
+	var timeout time.Duration
+	manifest, err := loadJobManifest(filepath.Join(dirPath, "model"))
+	if err == nil {
+		timeout, err = nodeConfig.timeLimit()
+	}
+	if err == nil {
+		timeout, err = manifest.timeoutFor(timeout)
+	}
+	if err == nil {
+		err = os.Mkdir(filepath.Join(dirPath, "output"), 0777)
+	}
+	if err != nil {
+		logger.Printf("Failed to prepare the job: %v", err)
+		return failed(err)
 	}
-	logger.Printf("Virtual environment activated\n")
 
-	if _, err := runCommand(".\\Env\\Scripts\\activate && pip install -r ../model/requirements.txt"); err != nil {
-		logger.Printf("Failed to install required packages: %v", err)
-		logData, err := readLogFileToBytes(logFilePath)
+	// Execute the model with the configured executor and check the declared outputs
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	scriptOutput, scriptUsage, err := executor.Execute(ctx, dirPath, manifest, logger)
+	scriptUsage.WallTimeMs = time.Since(start).Milliseconds()
+	scriptUsage.DiskBytes = dirSize(dirPath)
+	scriptUsage.DownloadedBytes = downloaded
+	usage = &scriptUsage
+	logger.Printf("Resources used: wall time %dms, CPU time %dms, peak memory %d bytes, disk %d bytes, downloaded %d bytes\n",
+		usage.WallTimeMs, usage.CPUTimeMs, usage.PeakMemoryBytes, usage.DiskBytes, usage.DownloadedBytes)
+	if errors.Is(err, context.DeadlineExceeded) {
+		logger.Printf("Execution timed out after %v", timeout)
+	} else if errors.Is(err, context.Canceled) {
+		logger.Printf("Execution interrupted")
+	}
+	var result *ModelResult
+	var model []byte
+	if err == nil {
+		result, model, err = readModelResult(dirPath, manifest, scriptOutput)
 		if err != nil {
-			logger.Printf("Error reading log file to bytes: %v", err)
-			return nil, nil, err
+			logger.Printf("Failed to read the result of the Python model script: %v", err)
 		}
-		return nil, logData, err
 	}
-	logger.Printf("Required packages installed\n")
-
-	// Execute the Python model script
-	model, err := runPythonFile(".\\Env\\Scripts\\activate && python ../model/model.py ../dataset/ ../model/knn_model.pkl")
-	if err != nil {
-		logger.Printf("Failed to execute the Python model script: %v", err)
-		logData, err := readLogFileToBytes(logFilePath)
+	if err == nil {
+		err = manifest.checkOutputs(filepath.Join(dirPath, "output"))
 		if err != nil {
-			logger.Printf("Error reading log file to bytes: %v", err)
-			return nil, nil, err
+			logger.Printf("Failed to collect the outputs: %v", err)
 		}
-		return nil, logData, err
+	}
+	if err != nil {
+		return failed(err)
+	}
+	if result != nil {
+		result.DatasetHash, result.ModelHash = datasetHash, modelHash
 	}
 
 	logger.Printf("Model executed successfully\n")
 
-	// Log file debugging
+	// Upload the declared outputs so the user can fetch them after the temporary directory is removed
+	artifacts, err := uploadArtifacts(filepath.Join(dirPath, "output"), manifest.Outputs, chain.selfMiningDetail.serviceMachineURL())
+	if err != nil {
+		logger.Printf("Failed to upload the outputs: %v", err)
+		return failed(err)
+	}
+	if len(artifacts) > 0 {
+		logger.Printf("Outputs uploaded: %s\n", artifacts[0].CID)
+	}
 
 	// Read the log file into a byte array
 	logData, err := readLogFileToBytes(logFilePath)
 	if err != nil {
 		logger.Printf("Error reading log file to bytes: %v", err)
-		return nil, nil, err
+		return ExecutionOutput{}, err
 	}
 
-	return model, logData, nil
+	return ExecutionOutput{Result: result, Model: model, Log: logData, Artifacts: artifacts, Usage: usage}, nil
 }
 
 /* Function to read log file into a byte array
@@ -225,34 +214,54 @@ func readLogFileToBytes(logFilePath string) ([]byte, error) {
 }
 
 /*
-changeDir is a function to change the current working directory
+pythonLauncher is a function to get the python used to create the virtual environment
+Windows installs python as python, Linux and macOS usually install python3 and may not have python at all
+*/
+func pythonLauncher() string {
+	if runtime.GOOS != "windows" {
+		if _, err := exec.LookPath("python3"); err == nil {
+			return "python3"
+		}
+	}
+	return "python"
+}
+
+/*
+venvPython is a function to get the path of the python binary of a virtual environment
+Env\Scripts\python.exe on Windows, Env/bin/python on Linux and macOS
 */
-func changeDir(dirPath string) error {
-	if err := os.Chdir(dirPath); err != nil {
-		return err
+func venvPython(envDir string) string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(envDir, "Scripts", "python.exe")
 	}
-	return nil
+	return filepath.Join(envDir, "bin", "python")
 }
 
 /*
-runCommand is a function to run a command in the command prompt
- 1. command is the command to be executed
+runCommand is a function to run a program with its arguments, no shell is involved
+ 1. name is the program to be executed in dir and args are its arguments
  2. logger is used to log the output of the command in a file so that every transaction can be logged and give to the user
  3. Return the output of the command
 */
-func runCommand(command string) (string, error) {
+func runCommand(ctx context.Context, dir string, name string, args ...string) (string, error) {
 
-	cmd := exec.Command("cmd", "/C", command)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	killProcessTree(cmd)
+	command := strings.Join(cmd.Args, " ")
 
 	var out bytes.Buffer
 	var stderr bytes.Buffer
 
-	// Capture both stdout and stderr
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
+	// Capture both stdout and stderr, and stream them live
+	cmd.Stdout = io.MultiWriter(&out, logStreamFrom(ctx))
+	cmd.Stderr = io.MultiWriter(&stderr, logStreamFrom(ctx))
 
 	// Run the command
 	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return out.String(), fmt.Errorf("command stopped: %s: %w", command, ctx.Err())
+		}
 		return out.String(), fmt.Errorf("failed to execute command: %s, error: %w, stderr: %s", command, err, stderr.String())
 	}
 
@@ -260,32 +269,61 @@ func runCommand(command string) (string, error) {
 }
 
 /*
-runPythonFile is a function to run a Python file in the command prompt
- 1. command is the command to be executed
- 2. logger is used to log the output of the command in a file so that every transaction can be logged and give to the user
- 3. Return the output of the command
+runPythonFile is a function to run a Python file with the given python binary
+ 1. python is the python binary of the virtual environment run in dir and args are the script and its arguments
+ 2. env is added to the environment of the node
+ 3. Return the output of the command and its CPU time and peak memory
 */
-func runPythonFile(command string) ([]byte, error) {
-	cmd := exec.Command("cmd", "/C", command)
+func runPythonFile(ctx context.Context, dir string, env []string, python string, args ...string) ([]byte, ResourceUsage, error) {
+	cmd := exec.CommandContext(ctx, python, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	killProcessTree(cmd)
+	command := strings.Join(cmd.Args, " ")
 
 	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &out
+	cmd.Stdout = io.MultiWriter(&out, logStreamFrom(ctx))
+	cmd.Stderr = cmd.Stdout
 
 	err := cmd.Run()
+	usage := processUsage(cmd.ProcessState)
+	if err != nil && ctx.Err() != nil {
+		return nil, usage, fmt.Errorf("Command stopped: %s: %w", command, ctx.Err())
+	}
 	if err != nil {
-		return nil, fmt.Errorf("Command failed: %s\nError: %v\nOutput: %s", command, err, out.String())
+		return nil, usage, fmt.Errorf("Command failed: %s\nError: %v\nOutput: %s", command, err, out.String())
 	}
 
+	return out.Bytes(), usage, nil
+}
+
+/*
+parseModelOutput is a function to check the legacy output of a Python model script without a result file
+ 1. out is everything the script wrote to stdout and stderr
+ 2. The ModelOuput is the whole output, or its last line that is a ModelOuput, so other prints are ignored
+ 3. Return the ModelOuput if it has no error
+*/
+func parseModelOutput(out []byte) ([]byte, error) {
 	var modelOutput ModelOuput
-	err = json.Unmarshal(out.Bytes(), &modelOutput)
+	output := bytes.TrimSpace(out)
+	err := json.Unmarshal(output, &modelOutput)
+	if err != nil {
+		lines := bytes.Split(output, []byte("\n"))
+		for i := len(lines) - 1; i >= 0; i-- {
+			line := bytes.TrimSpace(lines[i])
+			if json.Unmarshal(line, &modelOutput) == nil && (modelOutput.Model != "" || modelOutput.Error != "") {
+				output, err = line, nil
+				break
+			}
+		}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("Failed to parse Python script output: %v\nOutput: %s\n", err, out.String())
+		return nil, fmt.Errorf("Failed to parse Python script output: %v\nOutput: %s\n", err, out)
 	}
 
 	if modelOutput.Error != "" {
 		return nil, fmt.Errorf("Python script error: %s", modelOutput.Error)
 	}
 
-	return out.Bytes(), nil
+	return output, nil
 }
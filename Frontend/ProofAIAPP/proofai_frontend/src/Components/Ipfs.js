@@ -4,7 +4,7 @@ import { Upload, Copy, ArrowLeft } from 'lucide-react';
 import useIpfs from '../hooks/useIpfs';
 
 const IPFS = ({ setipfsCont }) => {
-    const { uploadResponse, waitingIcon, handleUpload, handleCopyCID, handleBackButton } = useIpfs({ setipfsCont });
+    const { uploadResponse, waitingIcon, uploadProgress, handleUpload, handleCopyCID, handleBackButton } = useIpfs({ setipfsCont });
 
     return (
         <div className="min-h-screen flex items-center justify-center pb-16">
@@ -52,8 +52,9 @@ const IPFS = ({ setipfsCont }) => {
 
 
                         {waitingIcon && (
-                            <div className="flex justify-center py-4">
+                            <div className="flex flex-col items-center gap-2 py-4">
                                 <ClipLoader color="#94a3b8" loading={true} size={40} />
+                                <p className="text-sm text-slate-300">Uploaded {uploadProgress}%</p>
                             </div>
                         )}
 
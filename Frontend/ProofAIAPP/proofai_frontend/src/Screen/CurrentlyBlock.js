@@ -4,7 +4,7 @@ import { ArrowLeft } from "lucide-react";
 import useScreenCurrentlyBlock from "../hooks/useScreenCurrentlyBlock";
 
 const CurrentlyBlock = () => {
-    const { block, handleBack } = useScreenCurrentlyBlock();
+    const { block, logs, logsFinished, handleBack } = useScreenCurrentlyBlock();
 
     return (
         <div className="min-h-screen  p-6">
@@ -65,6 +65,20 @@ const CurrentlyBlock = () => {
                 </div>
 
 
+                <div className="overflow-hidden rounded-lg bg-slate-800/50 backdrop-blur-lg">
+                    <div className="border-b border-slate-700 bg-slate-800 p-4">
+                        <h2 className="text-sm font-medium text-slate-300">
+                            Training Log {logsFinished ? "(finished)" : ""}
+                        </h2>
+                    </div>
+                    <div className="p-6">
+                        <pre className="max-h-96 overflow-auto rounded-lg bg-slate-900 p-4 text-sm text-slate-200">
+                            {logs.length > 0 ? logs.join("\n") : "No transaction is being executed"}
+                        </pre>
+                    </div>
+                </div>
+
+
                 <button
                     onClick={handleBack}
                     className="flex items-center gap-2 rounded-lg bg-emerald-600 px-4 py-2 text-sm font-medium text-white transition-colors hover:bg-emerald-500 focus:outline-none focus:ring-2 focus:ring-emerald-500 focus:ring-offset-2 focus:ring-offset-slate-800"
@@ -148,6 +148,18 @@ class ProofAiService {
         }
     }
 
+    // follow the log of the transaction being executed, returns the EventSource so the caller can close it
+    followTransactionLogs(onLine, onEnd) {
+        const source = new EventSource(`${this.baseUrl}/transactionLogs`);
+        source.onmessage = (event) => onLine(event.data);
+        source.addEventListener("end", () => {
+            source.close();
+            onEnd();
+        });
+        source.onerror = () => source.close();
+        return source;
+    }
+
     async login_using_key(PubKey, PrvKey) {
         try {
             const params = new URLSearchParams();
@@ -221,24 +233,67 @@ class ProofAiService {
         }
     }
 
-    async uploadDataOnIPfs(data) {
+    // Uploads the files of a folder in resumable chunks, a failed chunk is retried from the progress of the
+    // upload session kept by the service machine. onProgress gets the percentage of bytes uploaded.
+    async uploadDataOnIPfs(files, onProgress = () => {}) {
         const machineAddr = await this.getServiceMachineAddr();
         const url = `http://${machineAddr}/upload`;
+        const maxRetries = 5;
+
+        // paths are relative to the selected folder
+        const uploads = Array.from(files).map(file => ({
+            file,
+            path: file.webkitRelativePath ? file.webkitRelativePath.split('/').slice(1).join('/') : file.name,
+        }));
+        const total = uploads.reduce((sum, upload) => sum + upload.file.size, 0);
 
         try {
-            const response = await axios.post(url, data, {
-                headers: {
-                    'Content-Type': 'multipart/form-data',
-                },
+            const { data: session } = await axios.post(`${url}/session`, {
+                files: uploads.map(upload => ({ path: upload.path, size: upload.file.size })),
             });
 
-            // Assuming the response has a "cid" field, adjust according to your response
+            let done = 0;
+            for (const { file, path } of uploads) {
+                let offset = 0;
+                let failures = 0;
+                while (offset < file.size) {
+                    try {
+                        const chunk = file.slice(offset, offset + session.chunkSize);
+                        const response = await axios.put(`${url}/chunk`, chunk, {
+                            params: { id: session.id, path, offset },
+                            headers: { 'Content-Type': 'application/octet-stream' },
+                        });
+                        offset = response.data.received;
+                        failures = 0;
+                    } catch (error) {
+                        if (++failures > maxRetries) throw error;
+                        await new Promise(resolve => setTimeout(resolve, 2000 * failures));
+                        const progress = await axios.get(`${url}/session`, { params: { id: session.id } });
+                        offset = progress.data.uploads.find(upload => upload.path === path).received;
+                    }
+                    onProgress(Math.floor(100 * (done + offset) / Math.max(total, 1)));
+                }
+                done += file.size;
+            }
+
+            // the node signs the claim of the upload, so the content is pinned for its key
+            let claim = {};
+            try {
+                const params = new URLSearchParams();
+                params.append('id', session.id);
+                claim = (await axios.post(`${this.baseUrl}/pins/claim`, params)).data;
+            } catch (error) {
+                console.error("Upload is not claimed:", error);
+            }
+            const response = await axios.post(`${url}/finalize`, null, {
+                params: { id: session.id, owner: claim.owner, nonce: claim.nonce, signature: claim.signature },
+            });
+            onProgress(100);
             return response.data.message;
         } catch (error) {
             // Log the error if something goes wrong
             console.error("Upload failed:", error);
-            alert(error)
-            return error.response ? error.response.data : { error: "An unknown error occurred" };
+            return { error: error.response ? error.response.data : error.message };
         }
     }
 
@@ -8,6 +8,7 @@ const useIpfs = ({ setipfsCont }) => {
     const [uploadResponse, setUploadResponse] = useState("");
     const [ipfsContent, setIpfsContent] = useState(false);
     const [waitingIcon, setWaitingIcon] = useState(false);
+    const [uploadProgress, setUploadProgress] = useState(0);
 
     const ProofAiService = useProofAiService();
     const { showAlert } = useAlert();
@@ -18,12 +19,11 @@ const useIpfs = ({ setipfsCont }) => {
         setUploadResponse("");
         const files = event.target.files;
         if (!files.length) return;
-        const data = new FormData();
-        Array.from(files).forEach(file => data.append("files", file));
+        setUploadProgress(0);
         setWaitingIcon(true);
 
         try {
-            const response = await ProofAiService.uploadDataOnIPfs(data);
+            const response = await ProofAiService.uploadDataOnIPfs(files, setUploadProgress);
             setWaitingIcon(false);
 
             if (response.error) {
@@ -47,6 +47,7 @@ const useIpfs = ({ setipfsCont }) => {
         uploadResponse,
         ipfsContent,
         waitingIcon,
+        uploadProgress,
         handleUpload,
         handleCopyCID,
         handleBackButton
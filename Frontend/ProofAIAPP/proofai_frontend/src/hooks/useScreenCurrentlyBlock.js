@@ -9,6 +9,8 @@ const useScreenCurrentlyBlock = () => {
 
     const [showTransaction, setShowTransaction] = React.useState(false);
     const [block, setBlock] = React.useState([]);
+    const [logs, setLogs] = React.useState([]);
+    const [logsFinished, setLogsFinished] = React.useState(false);
 
     //  const alert = useAlert()
     const ProofAiService = useProofAiService()
@@ -34,12 +36,22 @@ const useScreenCurrentlyBlock = () => {
         getBlock()
     }, [])
 
+    React.useEffect(() => {
+        const source = ProofAiService.followTransactionLogs(
+            (line) => setLogs((previous) => [...previous, line]),
+            () => setLogsFinished(true)
+        )
+        return () => source.close()
+    }, [])
+
 
     return {
         showTransaction,
         setShowTransaction,
         block,
         setBlock,
+        logs,
+        logsFinished,
         ProofAiService,
         handleBack,
         getBlock
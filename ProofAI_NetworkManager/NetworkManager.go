@@ -3,17 +3,25 @@ package main
 /*
 This file contains the code for the service machine. The service machine is used to provide the service to the miner machines.
 The service machine is used to provide the following services:
-1. Upload and pin data on IPFS
-2. Fetch the files from IPFS CID
-3. Add the miner machine
-4. Get the list of miner machines
+1. Upload and pin data on the content store (IPFS by default, see contentStore.go), in one request or resumable chunks (see upload.go)
+2. Fetch the files of a CID (/fetch/archive streams them as a tar archive, /fetch/hash gives their hash, see fetchArchive.go)
+3. Add the miner machine, the miners are kept on disk and replicated to the peer service machines (see machines.go)
+   registration, heartbeat and logout are signed by the miner (see minerAuth.go)
+4. Get the list of miner machines with their liveness (/machines?state=live)
 5. Remove the miner machine
-6. Check if the miner machine is live or not
+6. Remove the miner machines without heartbeat for the miner TTL and list the joins and leaves (/machines/events, see liveness.go)
 7. Get the IPFS CID from the miner machine
+8. Tell the miner machine the address it connects from (/whoami)
+9. Get the configuration of the chain served by the service machine and its hash (/chain, see chainConfig.go)
+10. Name and version the uploaded datasets and models in the registry (/registry, see registry.go)
+11. List and unpin the uploaded content and remove the content nobody uses (/pins, see pins.go)
 
 */
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -25,8 +33,6 @@ import (
 	"strings"
 	"sync"
 	"time"
-
-	shell "github.com/ipfs/go-ipfs-api"
 )
 
 /*
@@ -42,9 +48,10 @@ type FileInfo struct {
 Response struct is used to store the response of the request for the files
 */
 type Response struct {
-	Success bool       `json:"success"`
-	Message string     `json:"message"`
-	Files   []FileInfo `json:"files"`
+	Success  bool         `json:"success"`
+	Message  string       `json:"message"`
+	Files    []FileInfo   `json:"files"`
+	Uploaded []StoredFile `json:"uploaded,omitempty"` // files of an upload with their CID and size
 }
 
 /*
@@ -54,25 +61,23 @@ type MachineDetail struct {
 	IP        string    `json:"ip"`
 	Port      string    `json:"port"`
 	PubKey    string    `json:"pubKey"`
-	Timestamp time.Time `json:"timestamp"`
+	Role      string    `json:"role,omitempty"`  // role of the miner given by its heartbeats
+	Height    int       `json:"height"`          // height of the tip of the ledger of the miner given by its heartbeats
+	Timestamp time.Time `json:"timestamp"`       // time of the registration or of the last heartbeat
+	State     string    `json:"state,omitempty"` // liveness of the miner, only set in the list of the miners (see liveness.go)
 }
 
 /*
 Server struct is used to store the information of the server
+machines are keyed by public key, removed keeps the time of the removed miners (see machines.go)
 */
 type Server struct {
 	machines map[string]MachineDetail
+	removed  map[string]time.Time
+	file     string
 	mutex    sync.RWMutex
 }
 
-/*
-ChainInfo struct is used to store the information of the chain . And it is used to store the PoW length and proof
-*/
-type ChainInfo struct {
-	PowLen int `json:"powLen"`
-	Proof  int `json:"proof"`
-}
-
 /*
 printTitle function is used to print the title of the service machine
 */
@@ -86,49 +91,19 @@ func printTitle(text string) {
 	fmt.Println(strings.Repeat(" ", padding) + boldBlue + text + reset + "\n\n")
 }
 
-/*
-getRadminIPv4 function is used to get the IPv4 address of the RadminVPN. Reason to use RadminVPN is to connect in same network
-*/
-func getRadminIPv4() (string, error) {
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		return "", fmt.Errorf("failed to get network interfaces: %v", err)
-	}
-
-	for _, iface := range interfaces {
-
-		if strings.Contains(iface.Name, "Radmin") {
-			addrs, err := iface.Addrs()
-			if err != nil {
-				continue
-			}
-			for _, addr := range addrs {
-				ipNet, ok := addr.(*net.IPNet)
-				if !ok {
-					continue
-				}
-
-				ipv4 := ipNet.IP.To4()
-				if ipv4 != nil {
-					return ipv4.String(), nil
-				}
-			}
-		}
-	}
-	return "", fmt.Errorf("RadminVPN IPv4 address not found")
-}
-
 /*
 NewServer function is used to create a new server instance
 */
 func NewServer() *Server {
 	return &Server{
 		machines: make(map[string]MachineDetail),
+		removed:  make(map[string]time.Time),
 	}
 }
 
 /*
 handleGetMachines function is used to handle the get request for the machines
+Every miner is given with its liveness state, state= only lists the miners in this state
 */
 func (s *Server) handleGetMachines(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -136,10 +111,15 @@ func (s *Server) handleGetMachines(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	state := r.URL.Query().Get("state")
+	now := time.Now()
 	s.mutex.RLock()
 	machines := make([]MachineDetail, 0, len(s.machines))
 	for _, machine := range s.machines {
-		machines = append(machines, machine)
+		machine.State = machineState(machine, now)
+		if state == "" || machine.State == state {
+			machines = append(machines, machine)
+		}
 	}
 	s.mutex.RUnlock()
 
@@ -156,27 +136,35 @@ func (s *Server) handleAddMachine(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var machine MachineDetail
-	if err := json.NewDecoder(r.Body).Decode(&machine); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	// The miner signs its address with a nonce of /nonce (see minerAuth.go)
+	request, ok := decodeMinerRequest(w, r, "register", func(request MinerRequest) []string {
+		return []string{request.IP, request.Port}
+	})
+	if !ok {
 		return
 	}
+	machine := request.MachineDetail
 
+	// A miner that does not know its own address is registered with the address it connects from
+	if machine.IP == "" {
+		machine.IP = remoteIP(r)
+	}
+	// Role and height are only taken from the signed heartbeats
+	machine.Role, machine.Height, machine.State = "", 0, ""
 	machine.Timestamp = time.Now()
-
-	s.mutex.Lock()
-	s.machines[machine.IP] = machine
-	s.mutex.Unlock()
+	s.putMachine(machine, "register")
 
 	fmt.Println("Machine is added")
 
-	w.WriteHeader(http.StatusCreated)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(chainInfo)
 }
 
 /*
 handleRequest function is used to handle the request for the files from IPFS CID
+The content is sent as JSON strings, which only works for text files of the top directory. It is kept for miners
+that do not use /fetch/archive yet.
 */
 func handleRequest(w http.ResponseWriter, r *http.Request) {
 
@@ -187,34 +175,27 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Connect to IPFS
-	sh := shell.NewShell("localhost:5001")
-
-	// List all files in directory
-	files, err := sh.List(cid)
-	if err != nil {
-		http.Error(w, "Failed to list IPFS directory", http.StatusInternalServerError)
-		return
-	}
-
-	// Get content for each file
+	// Get content for each file of the top directory
 	var fileInfos []FileInfo
-	for _, file := range files {
-		reader, err := sh.Cat(file.Hash)
+	err := contentStore.Walk(r.Context(), cid, func(name string, size int64, reader io.Reader) error {
+		if strings.Contains(name, "/") {
+			return nil
+		}
+		content, err := io.ReadAll(reader)
 		if err != nil {
-			continue
+			return err
 		}
-
-		// Read content
-		content := make([]byte, file.Size)
-		reader.Read(content)
-		reader.Close()
-
+		hash := sha256.Sum256(content)
 		fileInfos = append(fileInfos, FileInfo{
-			Name:    file.Name,
-			Hash:    file.Hash,
+			Name:    name,
+			Hash:    hex.EncodeToString(hash[:]),
 			Content: string(content),
 		})
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Failed to list content directory", http.StatusInternalServerError)
+		return
 	}
 
 	// Send response
@@ -228,68 +209,12 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-/*
-IsMinerLive function is used to check if the miner is live or not by pinging the miner machine and remove the offline machines
-*/
-func (s *Server) IsMinerLive() {
-	for {
-		s.mutex.RLock()
-		// Collect IPs of offline miners to remove
-		var offlineMachines []string
-
-		for ip, machine := range s.machines {
-			resp, err := http.Get("http://" + machine.IP + ":8079/ping")
-
-			if err != nil {
-				// Check if the error indicates a connection refusal
-				if isConnectionRefused(err) {
-					//	fmt.Printf("Error pinging miner %s: %v\n", machine.IP, err)
-					offlineMachines = append(offlineMachines, ip) // Mark as offline
-				} else {
-					//fmt.Printf("Unexpected error for miner %s: %v\n", machine.IP, err)
-				}
-				continue
-			}
-
-			// Check the response status code
-			resp.Body.Close()
-			if resp.StatusCode == http.StatusNotFound { // 404 indicates the miner is live
-				//fmt.Printf("Miner %s returned status: 404 (Miner is live)\n", machine.IP)
-			} else {
-				//fmt.Printf("Miner %s returned status: %d (Unexpected)\n", machine.IP, resp.StatusCode)
-			}
-		}
-		s.mutex.RUnlock()
-
-		// Remove offline machines outside the read lock
-		if len(offlineMachines) > 0 {
-			s.mutex.Lock()
-			for _, ip := range offlineMachines {
-				delete(s.machines, ip)
-				fmt.Printf("Removed offline miner: %s\n", ip)
-			}
-			s.mutex.Unlock()
-		}
-
-		time.Sleep(1 * time.Second) // Wait 1 second before the next check
-	}
-}
-
-/*
-isConnectionRefused function is used to check if the connection is refused
-*/
-func isConnectionRefused(err error) bool {
-	if opErr, ok := err.(*net.OpError); ok {
-		if syscallErr, ok := opErr.Err.(*net.OpError); ok {
-			return strings.Contains(syscallErr.Error(), "connection refused")
-		}
-	}
-	return strings.Contains(err.Error(), "connection refused") ||
-		strings.Contains(err.Error(), "actively refused")
-}
-
 /*
 handleuploadAndPinData function is used to handle the upload and pin data on IPFS request
+The files of the multipart request are streamed to a temporary directory, their paths are checked with sanitizeUploadPath
+The answer is the CID of the directory and the CID and size of every file
+The content has no owner, it is kept while the ledger references it or for the retention period (see pins.go)
+Large uploads should use the resumable upload sessions (see upload.go)
 */
 func handleuploadAndPinData(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -297,18 +222,12 @@ func handleuploadAndPinData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := r.ParseMultipartForm(5 * 1024 << 20) // Max upload size:
+	reader, err := r.MultipartReader()
 	if err != nil {
 		http.Error(w, "Failed to parse form data", http.StatusBadRequest)
 		return
 	}
 
-	files := r.MultipartForm.File["files"]
-	if len(files) == 0 {
-		http.Error(w, "No files provided in the request", http.StatusBadRequest)
-		return
-	}
-
 	tempDir, err := os.MkdirTemp("", "ipfs-upload-*")
 	if err != nil {
 		http.Error(w, "Failed to create temporary directory", http.StatusInternalServerError)
@@ -316,100 +235,134 @@ func handleuploadAndPinData(w http.ResponseWriter, r *http.Request) {
 	}
 	defer os.RemoveAll(tempDir) // Clean up after use
 
-	for _, fileHeader := range files {
-		file, err := fileHeader.Open()
+	var size int64
+	count := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to open file %s: %v", fileHeader.Filename, err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Failed to read form data: %v", err), http.StatusBadRequest)
 			return
 		}
-		defer file.Close()
+		if part.FormName() != "files" {
+			continue
+		}
 
-		destPath := filepath.Join(tempDir, fileHeader.Filename)
+		name, err := sanitizeUploadPath(part.FileName())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		destPath := filepath.Join(tempDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create file %s: %v", name, err), http.StatusInternalServerError)
+			return
+		}
 		destFile, err := os.Create(destPath)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to create file %s: %v", fileHeader.Filename, err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Failed to create file %s: %v", name, err), http.StatusInternalServerError)
 			return
 		}
-		defer destFile.Close()
-
-		_, err = io.Copy(destFile, file)
+		n, err := io.Copy(destFile, io.LimitReader(part, maxUploadSize-size+1))
+		destFile.Close()
+		size += n
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to save file %s: %v", fileHeader.Filename, err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Failed to save file %s: %v", name, err), http.StatusInternalServerError)
+			return
+		}
+		if size > maxUploadSize {
+			http.Error(w, fmt.Sprintf("Upload is larger than %d bytes", maxUploadSize), http.StatusRequestEntityTooLarge)
 			return
 		}
+		count++
+	}
+	if count == 0 {
+		http.Error(w, "No files provided in the request", http.StatusBadRequest)
+		return
 	}
 
-	sh := shell.NewShell("localhost:5001")
-	if !sh.IsUp() {
-		http.Error(w, "IPFS node is not running on localhost:5001", http.StatusInternalServerError)
+	if err := contentStore.Ping(r.Context()); err != nil {
+		http.Error(w, fmt.Sprintf("Content store is not available: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	cid, err := sh.AddDir(tempDir)
+	cid, err := contentStore.Add(r.Context(), tempDir)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to upload directory to IPFS: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to upload directory to the content store: %v", err), http.StatusInternalServerError)
 		return
 	}
+	files, err := contentStore.List(r.Context(), cid)
+	if err != nil {
+		fmt.Printf("Error listing the files of %s: %v\n", cid, err)
+	}
+	pins.add(cid, "", size)
 	response := Response{
-		Success: true,
-		Message: cid,
+		Success:  true,
+		Message:  cid,
+		Uploaded: files,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-/*
-isIPFSRuning function is used to check if the IPFS is running on localhost:5001
-*/
-func isIPFSRuning() bool {
-	sh := shell.NewShell("localhost:5001")
-	return sh.IsUp()
-}
-
-/*
-waitToCloseWindow function is used to wait for the user to close the window by pressing any key
-*/
-func waitToCloseWindow() {
-	fmt.Println("")
-	fmt.Println("Press any key to close the window")
-	var input string
-	fmt.Scanln(&input)
-}
-
 /*
 handleLogout function is used to handle the logout request from the machine
+The request is signed by the miner with a nonce of /nonce (see minerAuth.go), only its machine is removed
 */
 func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
-	addr := r.RemoteAddr
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	// Loop through machines to find the matching IP
-	for _, machine := range s.machines {
-		if machine.IP == strings.Split(addr, ":")[0] {
-			s.mutex.Lock()
-			delete(s.machines, machine.IP) // Remove the machine entry
-			s.mutex.Unlock()
-
-			// Log the removal and send a success response
-			fmt.Printf("Machine with IP %s is removed successfully.\n", machine.IP)
-			w.WriteHeader(http.StatusOK) // Send HTTP 200 OK response
-			w.Write([]byte("Logout successful, machine removed."))
-			return
-		}
+	request, ok := decodeMinerRequest(w, r, "logout", nil)
+	if !ok {
+		return
+	}
+
+	s.mutex.RLock()
+	machine, found := s.machines[request.PubKey]
+	s.mutex.RUnlock()
+
+	if found {
+		s.removeMachine("logout", request.PubKey)
+
+		// Log the removal and send a success response
+		fmt.Printf("Machine with IP %s is removed successfully.\n", machine.IP)
+		w.WriteHeader(http.StatusOK) // Send HTTP 200 OK response
+		w.Write([]byte("Logout successful, machine removed."))
+		return
 	}
 
 	// If no machine is found, log and send an error response
-	fmt.Printf("Logout request from %s, but machine not found.\n", addr)
+	fmt.Printf("Logout request from %s, but machine not found.\n", r.RemoteAddr)
 	w.WriteHeader(http.StatusNotFound) // Send HTTP 404 Not Found response
 	w.Write([]byte("Logout failed, machine not found."))
 }
 
-// Global variable to store the chain information (PoW length and proof)
+/*
+handleGetChain function is used to get the information of the chain served by the service machine
+Miners read it before connecting to other miners so they only join miners of the same chain
+*/
+func handleGetChain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chainInfo)
+}
+
+// Global variable to store the configuration of the chain, loaded once in main (see chainConfig.go)
 var chainInfo ChainInfo
 
 /*
 main function is the entry point of the program
-Precondition: The IPFS node should be running on localhost:5001
-Postcondition: The service machine is started and listening on the RadminVPN IP address
+Precondition: The content store should be available (the IPFS node on localhost:5001 by default)
+Postcondition: The service machine is started and listening on the configured address (the RadminVPN IP address by default)
 Creates a new server instance and starts the service machine
 */
 
@@ -418,39 +371,78 @@ func main() {
 	text := "ProofAI Service Machine is starting..."
 	printTitle(text)
 
-	IP, err := getRadminIPv4()
+	config, err := loadServiceConfig(os.Args[1:])
 	if err != nil {
-		log.Printf("Failed to get RadminVPN IPv4 address:  %v", err)
-		waitToCloseWindow()
-		return
+		log.Fatalf("Failed to load configuration:  %v", err)
 	}
+	serviceConfig = config
 
-	if !isIPFSRuning() {
-		log.Printf("IPFS node is not running on localhost:5001")
-		waitToCloseWindow()
-		return
+	chainInfo, err = loadChainConfig(serviceConfig.ChainConfig, serviceConfig.ChainID)
+	if err != nil {
+		log.Fatalf("Failed to load the chain configuration:  %v", err)
+	}
+
+	IP, err := advertiseAddress()
+	if err != nil {
+		log.Fatalf("Failed to get the service machine address:  %v", err)
+	}
+
+	contentStore, err = newContentStore(serviceConfig)
+	if err == nil {
+		err = contentStore.Ping(context.Background())
+	}
+	if err != nil {
+		log.Fatalf("Content store is not available:  %v", err)
+	}
+
+	registry, err = loadRegistry(serviceConfig.dataPath("registry.json"))
+	if err != nil {
+		log.Fatalf("Failed to load the registry:  %v", err)
+	}
+
+	pins, err = loadPins(serviceConfig.dataPath("pins.json"))
+	if err != nil {
+		log.Fatalf("Failed to load the pins:  %v", err)
 	}
 
 	server := NewServer()
-	go server.IsMinerLive()
+	if err := server.loadMachines(serviceConfig.dataPath("machines.json")); err != nil {
+		log.Fatalf("Failed to load the miner machines:  %v", err)
+	}
+	go server.runReplication()
+	go server.expireMachines()
+	go expireUploads()
+	go runGarbageCollector(server)
 
 	http.HandleFunc("/fetch", handleRequest)
+	http.HandleFunc("/fetch/archive", handleFetchArchive)
+	http.HandleFunc("/fetch/hash", handleFetchHash)
 	http.HandleFunc("/upload", handleuploadAndPinData)
+	http.HandleFunc("/upload/session", handleUploadSession)
+	http.HandleFunc("/upload/chunk", handleUploadChunk)
+	http.HandleFunc("/upload/finalize", handleUploadFinalize)
+	http.HandleFunc("/registry", handleRegistry)
+	http.HandleFunc("/registry/resolve", handleRegistryResolve)
+	http.HandleFunc("/pins", handlePins)
+	http.HandleFunc("/pins/unpin", handleUnpin)
 	http.HandleFunc("/logout", server.handleLogout)
 	http.HandleFunc("/machines", server.handleGetMachines)
 	http.HandleFunc("/machine", server.handleAddMachine)
-
-	fmt.Printf("Enter the blockHash Size       : ")
-	fmt.Scanln(&chainInfo.PowLen)
-
-	fmt.Printf("Enter the Proof of Work length : ")
-	fmt.Scanln(&chainInfo.Proof)
-
-	fmt.Println("\n\nService Machine Address  =  ", IP+":8050 \n\n")
-	if err := http.ListenAndServe(IP+":8050", nil); err != nil {
-		log.Printf("Failed to start Service Machine : %v", err)
-		waitToCloseWindow()
-		return
+	http.HandleFunc("/machines/replicate", server.handleReplicate)
+	http.HandleFunc("/machines/events", handleMinerEvents)
+	http.HandleFunc("/nonce", handleNonce)
+	http.HandleFunc("/heartbeat", server.handleHeartbeat)
+	http.HandleFunc("/whoami", handleWhoAmI)
+	http.HandleFunc("/chain", handleGetChain)
+
+	fmt.Printf("Chain ID                       : %s\n", chainInfo.ChainID)
+	fmt.Printf("blockHash Size                 : %d\n", chainInfo.PowLen)
+	fmt.Printf("Proof of Work length           : %d\n", chainInfo.Proof)
+	fmt.Printf("Chain config hash              : %s\n", chainInfo.ConfigHash)
+
+	fmt.Printf("\n\nService Machine Address  =   %s \n\n\n", net.JoinHostPort(IP, serviceConfig.Port))
+	if err := http.ListenAndServe(net.JoinHostPort(bindAddress(), serviceConfig.Port), nil); err != nil {
+		log.Fatalf("Failed to start Service Machine : %v", err)
 	}
 
 }
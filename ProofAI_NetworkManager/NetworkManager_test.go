@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+signedMinerRequest builds a request of a new miner for action signed with a nonce of /nonce
+*/
+func signedMinerRequest(t *testing.T, action string, machine MachineDetail, fields func(MinerRequest) []string) []byte {
+	t.Helper()
+	prvKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := prvKey.PublicKey.ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine.PubKey = hex.EncodeToString(pubKey.Bytes())
+
+	recorder := httptest.NewRecorder()
+	handleNonce(recorder, httptest.NewRequest(http.MethodGet, "/nonce?pubKey="+machine.PubKey, nil))
+	var answer map[string]string
+	if err := json.NewDecoder(recorder.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+
+	request := MinerRequest{MachineDetail: machine, Nonce: answer["nonce"]}
+	hash := sha256.Sum256([]byte(minerMessage(action, machine.PubKey, request.Nonce, fields(request)...)))
+	signature, err := ecdsa.SignASN1(rand.Reader, prvKey, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Signature = hex.EncodeToString(signature)
+	data, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestAddMachineAnswersJSON(t *testing.T) {
+	server := NewServer()
+	body := signedMinerRequest(t, "register", MachineDetail{IP: "10.0.0.1", Port: "8090"}, func(request MinerRequest) []string {
+		return []string{request.IP, request.Port}
+	})
+
+	recorder := httptest.NewRecorder()
+	server.handleAddMachine(recorder, httptest.NewRequest(http.MethodPost, "/machine", bytes.NewReader(body)))
+
+	response := recorder.Result()
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", response.StatusCode, http.StatusCreated, recorder.Body.String())
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("Content-Type = %q, want application/json", contentType)
+	}
+	var answer ChainInfo
+	if err := json.NewDecoder(response.Body).Decode(&answer); err != nil {
+		t.Fatalf("answer is not the chain information: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+/*
+This file contains the configuration of the chain served by the service machine (the genesis of the chain).
+The chain config file (chain.json by default, see serviceConfig.go) gives the chain ID, the block hash size, the
+difficulty, the block policy, the consensus engine, the miners allowed to propose blocks and the genesis time. It is
+served to the miners as ChainInfo together with the hash of the config, service machines of one chain use the same
+file and the miners refuse a service machine or a miner with another hash.
+1. ChainInfo struct is used to store the configuration of the chain
+2. loadChainConfig function is used to read and check the chain config file
+3. chainConfigHash function is used to compute the hash of the configuration
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Consensus engines known by the miners
+const consensusPoW = "pow"
+
+// chainIDPattern is the format of a chain ID, the miners use it in the name of their ledger file and refuse other IDs
+var chainIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+/*
+ChainInfo struct is used to store the configuration of the chain, it is served to the miners on /chain and /machine
+Miners keep a separate ledger for every chain ID, so two service machines with the same chain ID serve the same chain
+PowLen and Proof keep their names for the miners started before the chain config file
+*/
+type ChainInfo struct {
+	ChainID              string   `json:"chainId"`              // ID of the chain, <proof>_<powLen> when empty
+	PowLen               int      `json:"powLen"`               // size of the block hash prefix of the genesis block
+	Proof                int      `json:"proof"`                // Proof of Work difficulty, leading zeros of the block hash
+	MaxBlockTransactions int      `json:"maxBlockTransactions"` // transactions of a block, 2 by default
+	BlockInterval        string   `json:"blockInterval"`        // time between two blocks, e.g. 2m (the default)
+	Consensus            string   `json:"consensus"`            // consensus engine, only pow
+	AllowedProposers     []string `json:"allowedProposers"`     // public keys of the miners allowed to propose blocks, empty allows every miner
+	GenesisTime          string   `json:"genesisTime"`          // time the chain starts, RFC 3339
+	ConfigHash           string   `json:"configHash"`           // hash of the fields above, computed by the service machine
+}
+
+/*
+loadChainConfig function is used to read the chain config file, chainID replaces the chain ID of the file when set
+The missing fields get their defaults, the proposers are sorted so the hash does not depend on their order
+*/
+func loadChainConfig(file string, chainID string) (ChainInfo, error) {
+	var chain ChainInfo
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return chain, fmt.Errorf("chain config file %s not found, give it with -chain-config (see chain.example.json)", file)
+	}
+	if err != nil {
+		return chain, fmt.Errorf("failed to read chain config file %s: %v", file, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&chain); err != nil {
+		return chain, fmt.Errorf("failed to parse chain config file %s: %v", file, err)
+	}
+
+	if chainID != "" {
+		chain.ChainID = chainID
+	}
+	if chain.PowLen < 0 || chain.PowLen > 64 {
+		return chain, fmt.Errorf("powLen must be between 0 and 64")
+	}
+	if chain.Proof < 0 || chain.Proof > 64 {
+		return chain, fmt.Errorf("proof must be between 0 and 64")
+	}
+	if chain.ChainID == "" {
+		chain.ChainID = fmt.Sprintf("%d_%d", chain.Proof, chain.PowLen)
+	}
+	if !chainIDPattern.MatchString(chain.ChainID) {
+		return chain, fmt.Errorf("invalid chainId %q, use 1 to 64 letters, digits, '.', '_' or '-' starting with a letter or digit", chain.ChainID)
+	}
+
+	if chain.MaxBlockTransactions == 0 {
+		chain.MaxBlockTransactions = 2
+	}
+	if chain.MaxBlockTransactions < 0 {
+		return chain, fmt.Errorf("maxBlockTransactions must be positive")
+	}
+	if chain.BlockInterval == "" {
+		chain.BlockInterval = "2m"
+	}
+	interval, err := time.ParseDuration(chain.BlockInterval)
+	if err != nil || interval < 0 {
+		return chain, fmt.Errorf("invalid blockInterval %q, use a duration like 2m", chain.BlockInterval)
+	}
+	chain.BlockInterval = interval.String()
+
+	if chain.Consensus == "" {
+		chain.Consensus = consensusPoW
+	}
+	if chain.Consensus != consensusPoW {
+		return chain, fmt.Errorf("unknown consensus engine %q, the miners only run %q", chain.Consensus, consensusPoW)
+	}
+
+	proposers := map[string]bool{}
+	for _, pubKey := range chain.AllowedProposers {
+		if _, err := hexToPublicKey(pubKey); err != nil {
+			return chain, fmt.Errorf("invalid allowed proposer %q: %v", pubKey, err)
+		}
+		proposers[pubKey] = true
+	}
+	chain.AllowedProposers = make([]string, 0, len(proposers))
+	for pubKey := range proposers {
+		chain.AllowedProposers = append(chain.AllowedProposers, pubKey)
+	}
+	sort.Strings(chain.AllowedProposers)
+
+	genesis, err := time.Parse(time.RFC3339, chain.GenesisTime)
+	if err != nil {
+		return chain, fmt.Errorf("invalid genesisTime %q, use a time like 2025-01-01T00:00:00Z", chain.GenesisTime)
+	}
+	chain.GenesisTime = genesis.UTC().Format(time.RFC3339)
+
+	chain.ConfigHash = chainConfigHash(chain)
+	return chain, nil
+}
+
+/*
+chainConfigHash function is used to compute the hash of the configuration of the chain
+The fields are joined with NUL bytes in a fixed order, the miners compute the same hash (see chainConfig.go of the miner)
+*/
+func chainConfigHash(chain ChainInfo) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{
+		chain.ChainID,
+		strconv.Itoa(chain.PowLen),
+		strconv.Itoa(chain.Proof),
+		strconv.Itoa(chain.MaxBlockTransactions),
+		chain.BlockInterval,
+		chain.Consensus,
+		strings.Join(chain.AllowedProposers, ","),
+		chain.GenesisTime,
+	}, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
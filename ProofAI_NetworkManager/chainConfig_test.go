@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeChainConfig(t *testing.T, chainID string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "chain.json")
+	config := `{"chainId": "` + chainID + `", "powLen": 4, "proof": 1, "genesisTime": "2025-01-01T00:00:00Z"}`
+	if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadChainConfigChainID(t *testing.T) {
+	for _, chainID := range []string{"proofai-main", "chain_2.test", "A", strings.Repeat("a", 64)} {
+		chain, err := loadChainConfig(writeChainConfig(t, chainID), "")
+		if err != nil {
+			t.Fatalf("chain ID %q was refused: %v", chainID, err)
+		}
+		if chain.ChainID != chainID {
+			t.Fatalf("chain ID = %q, want %q", chain.ChainID, chainID)
+		}
+	}
+	for _, chainID := range []string{"../main", "main/test", "-main", ".main", "main chain", `main\\test`, strings.Repeat("a", 65)} {
+		if _, err := loadChainConfig(writeChainConfig(t, chainID), ""); err == nil {
+			t.Fatalf("chain ID %q was accepted", chainID)
+		}
+	}
+}
+
+func TestLoadChainConfigChainIDOverride(t *testing.T) {
+	file := writeChainConfig(t, "")
+	chain, err := loadChainConfig(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain.ChainID != "1_4" {
+		t.Fatalf("default chain ID = %q, want 1_4", chain.ChainID)
+	}
+	if _, err := loadChainConfig(file, "../other"); err == nil {
+		t.Fatal("unsafe chain ID of the command line was accepted")
+	}
+}
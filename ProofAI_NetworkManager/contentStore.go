@@ -0,0 +1,461 @@
+package main
+
+/*
+This file contains the stores the service machine keeps the datasets, models and outputs in.
+The store is selected by the store setting: the IPFS HTTP API (default), a directory on disk, or an S3-compatible
+object store such as MinIO. The directory and S3 stores need no IPFS daemon and address content by the SHA-256
+hash of its files (contentID), so the same files always get the same ID.
+1. ContentStore interface is used by the handlers to add and read content
+2. newContentStore function is used to create the store of the configuration
+3. ipfsStore, fsStore and s3Store are the implementations
+4. contentID function is used to compute the ID of a directory for the fs and s3 stores
+*/
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+/*
+ContentStore interface is used to store content by ID
+  - Ping checks that the store can be used
+  - Add stores the files of dir and returns the ID of the content
+  - Walk calls fn for every file of the content, with its path relative to the content and in path order
+  - List gives the path, ID and size of every file of the content without reading it
+  - Remove deletes the content, the ipfs store unpins it and its blocks are freed by collectGarbage
+*/
+type ContentStore interface {
+	Ping(ctx context.Context) error
+	Add(ctx context.Context, dir string) (string, error)
+	Walk(ctx context.Context, cid string, fn func(name string, size int64, content io.Reader) error) error
+	List(ctx context.Context, cid string) ([]StoredFile, error)
+	Remove(ctx context.Context, cid string) error
+}
+
+/*
+StoredFile struct is used to describe a file of a content
+CID is the IPFS CID of the file for the ipfs store, <content ID>/<path> for the fs and s3 stores
+*/
+type StoredFile struct {
+	Path string `json:"path"`
+	CID  string `json:"cid"`
+	Size int64  `json:"size"`
+}
+
+// Global variable to store the content store of the service machine, created once in main
+var contentStore ContentStore
+
+/*
+newContentStore function is used to create the content store of the configuration
+*/
+func newContentStore(config ServiceConfig) (ContentStore, error) {
+	switch config.Store {
+	case "", "ipfs":
+		return ipfsStore{shell: shell.NewShell(config.IPFSAPI), address: config.IPFSAPI}, nil
+	case "fs":
+		if config.StoreDir == "" {
+			return nil, fmt.Errorf("fs store needs a store directory")
+		}
+		if err := os.MkdirAll(config.StoreDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create store directory %s: %v", config.StoreDir, err)
+		}
+		return fsStore{root: config.StoreDir}, nil
+	case "s3":
+		endpoint, err := url.Parse(config.S3Endpoint)
+		if err != nil || endpoint.Host == "" || config.S3Bucket == "" {
+			return nil, fmt.Errorf("s3 store needs an endpoint URL like http://localhost:9000 and a bucket")
+		}
+		client, err := minio.New(endpoint.Host, &minio.Options{
+			Creds:  credentials.NewStaticV4(config.S3AccessKey, config.S3SecretKey, ""),
+			Secure: endpoint.Scheme == "https",
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create s3 client: %v", err)
+		}
+		return s3Store{client: client, bucket: config.S3Bucket}, nil
+	default:
+		return nil, fmt.Errorf("unknown store %q, use ipfs, fs or s3", config.Store)
+	}
+}
+
+/*
+ipfsStore is a ContentStore using the HTTP API of an IPFS node, the ID is the IPFS CID
+*/
+type ipfsStore struct {
+	shell   *shell.Shell
+	address string
+}
+
+func (s ipfsStore) Ping(ctx context.Context) error {
+	if !s.shell.IsUp() {
+		return fmt.Errorf("IPFS node is not running on %s", s.address)
+	}
+	return nil
+}
+
+func (s ipfsStore) Add(ctx context.Context, dir string) (string, error) {
+	return s.shell.AddDir(dir)
+}
+
+/*
+Walk reads the tar archive the IPFS node answers for the CID, its paths start with the CID
+a CID of a single file keeps the CID as file name
+*/
+func (s ipfsStore) Walk(ctx context.Context, cid string, fn func(name string, size int64, content io.Reader) error) error {
+	resp, err := s.shell.Request("get", cid).Send(ctx)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	if resp.Error != nil {
+		return fmt.Errorf("%s", resp.Error.Message)
+	}
+
+	reader := tar.NewReader(resp.Output)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(strings.TrimPrefix(path.Clean(header.Name), cid+"/"), header.Size, reader); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+List lists the directories of the CID recursively with the ls command of the IPFS node
+*/
+func (s ipfsStore) List(ctx context.Context, cid string) ([]StoredFile, error) {
+	var files []StoredFile
+	var list func(dir string) error
+	list = func(dir string) error {
+		links, err := s.shell.List(path.Join(cid, dir))
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			name := path.Join(dir, link.Name)
+			if link.Type == shell.TDirectory {
+				if err := list(name); err != nil {
+					return err
+				}
+				continue
+			}
+			files = append(files, StoredFile{Path: name, CID: link.Hash, Size: int64(link.Size)})
+		}
+		return nil
+	}
+	if err := list(""); err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+func (s ipfsStore) Remove(ctx context.Context, cid string) error {
+	err := s.shell.Unpin(cid)
+	if err != nil && strings.Contains(err.Error(), "not pinned") {
+		return nil
+	}
+	return err
+}
+
+/*
+collectGarbage runs the garbage collection of the IPFS node, which deletes the blocks of the unpinned content
+*/
+func (s ipfsStore) collectGarbage(ctx context.Context) error {
+	resp, err := s.shell.Request("repo/gc").Send(ctx)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	if resp.Error != nil {
+		return fmt.Errorf("%s", resp.Error.Message)
+	}
+	_, err = io.Copy(io.Discard, resp.Output)
+	return err
+}
+
+// contentIDPattern is the format of the IDs of the fs and s3 stores
+var contentIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+/*
+contentID function is used to compute the ID of the files of a directory for the fs and s3 stores
+the relative path and the SHA-256 hash of every file are hashed in path order
+Returns the ID and the relative paths of the files
+*/
+func contentID(dir string) (string, []string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			rel, _ := filepath.Rel(dir, p)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	sort.Strings(files)
+
+	hash := sha256.New()
+	for _, name := range files {
+		file, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return "", nil, err
+		}
+		fileHash := sha256.New()
+		_, err = io.Copy(fileHash, file)
+		file.Close()
+		if err != nil {
+			return "", nil, err
+		}
+		fmt.Fprintf(hash, "%s\x00%s\n", name, hex.EncodeToString(fileHash.Sum(nil)))
+	}
+	return hex.EncodeToString(hash.Sum(nil)), files, nil
+}
+
+/*
+fsStore is a ContentStore keeping every content in the directory <root>/<ID>
+*/
+type fsStore struct {
+	root string
+}
+
+func (s fsStore) Ping(ctx context.Context) error {
+	_, err := os.Stat(s.root)
+	return err
+}
+
+/*
+Add copies dir to a temporary directory of the store and renames it to its ID, so readers never see a partial content
+*/
+func (s fsStore) Add(ctx context.Context, dir string) (string, error) {
+	cid, files, err := contentID(dir)
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(s.root, cid)
+	if _, err := os.Stat(target); err == nil {
+		return cid, nil
+	}
+
+	temp, err := os.MkdirTemp(s.root, ".add-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(temp)
+	for _, name := range files {
+		if err := copyFileTo(filepath.Join(temp, filepath.FromSlash(name)), filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(temp, target); err != nil && !os.IsExist(err) {
+		if _, statErr := os.Stat(target); statErr != nil {
+			return "", err
+		}
+	}
+	return cid, nil
+}
+
+func (s fsStore) Walk(ctx context.Context, cid string, fn func(name string, size int64, content io.Reader) error) error {
+	if !contentIDPattern.MatchString(cid) {
+		return fmt.Errorf("invalid content ID %q", cid)
+	}
+	dir := filepath.Join(s.root, cid)
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("content %s not found", cid)
+	}
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		rel, _ := filepath.Rel(dir, p)
+		return fn(filepath.ToSlash(rel), info.Size(), file)
+	})
+}
+
+func (s fsStore) List(ctx context.Context, cid string) ([]StoredFile, error) {
+	if !contentIDPattern.MatchString(cid) {
+		return nil, fmt.Errorf("invalid content ID %q", cid)
+	}
+	dir := filepath.Join(s.root, cid)
+	var files []StoredFile
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		files = append(files, StoredFile{Path: filepath.ToSlash(rel), CID: cid + "/" + filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("content %s not found", cid)
+	}
+	return files, nil
+}
+
+func (s fsStore) Remove(ctx context.Context, cid string) error {
+	if !contentIDPattern.MatchString(cid) {
+		return fmt.Errorf("invalid content ID %q", cid)
+	}
+	return os.RemoveAll(filepath.Join(s.root, cid))
+}
+
+/*
+copyFileTo function is used to copy the file src to dst, creating the directory of dst
+*/
+func copyFileTo(dst string, src string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+/*
+s3Store is a ContentStore keeping every file of a content as the object <ID>/<path> of a bucket
+*/
+type s3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+func (s s3Store) Ping(ctx context.Context) error {
+	exists, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", s.bucket)
+	}
+	return nil
+}
+
+func (s s3Store) Add(ctx context.Context, dir string) (string, error) {
+	cid, files, err := contentID(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range files {
+		_, err := s.client.FPutObject(ctx, s.bucket, cid+"/"+name, filepath.Join(dir, filepath.FromSlash(name)), minio.PutObjectOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to upload %s: %v", name, err)
+		}
+	}
+	return cid, nil
+}
+
+/*
+Walk lists the objects of the content, S3 lists them in key order
+*/
+func (s s3Store) Walk(ctx context.Context, cid string, fn func(name string, size int64, content io.Reader) error) error {
+	if !contentIDPattern.MatchString(cid) {
+		return fmt.Errorf("invalid content ID %q", cid)
+	}
+	// cancelling the context stops the listing when fn fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	found := false
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: cid + "/", Recursive: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+		found = true
+		reader, err := s.client.GetObject(ctx, s.bucket, object.Key, minio.GetObjectOptions{})
+		if err != nil {
+			return err
+		}
+		err = fn(strings.TrimPrefix(object.Key, cid+"/"), object.Size, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("content %s not found", cid)
+	}
+	return nil
+}
+
+func (s s3Store) List(ctx context.Context, cid string) ([]StoredFile, error) {
+	if !contentIDPattern.MatchString(cid) {
+		return nil, fmt.Errorf("invalid content ID %q", cid)
+	}
+	var files []StoredFile
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: cid + "/", Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		files = append(files, StoredFile{Path: strings.TrimPrefix(object.Key, cid+"/"), CID: object.Key, Size: object.Size})
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("content %s not found", cid)
+	}
+	return files, nil
+}
+
+func (s s3Store) Remove(ctx context.Context, cid string) error {
+	if !contentIDPattern.MatchString(cid) {
+		return fmt.Errorf("invalid content ID %q", cid)
+	}
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: cid + "/", Recursive: true})
+	for result := range s.client.RemoveObjects(ctx, s.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if result.Err != nil {
+			return fmt.Errorf("failed to remove %s: %v", result.ObjectName, result.Err)
+		}
+	}
+	return nil
+}
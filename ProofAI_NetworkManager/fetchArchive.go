@@ -0,0 +1,156 @@
+package main
+
+/*
+In this file we stream the files of a content ID to the miners as a tar archive.
+The archive keeps the directory structure and the binary content of the files, nothing is held in memory.
+The SHA-256 hash of every file is computed while it is streamed and sent in a PAX global header at the end of the
+archive, the miner checks the files it extracted against it. An archive without this header was cut off.
+1. handleFetchArchive: stream the files of a content ID from the content store
+2. writeArchive: write the files of a content as a tar archive
+3. handleFetchHash: the hash of the files of a content ID, the miners check content fetched from other miners with it
+*/
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// contentHashes keeps the hashes computed by handleFetchHash, the content of an ID never changes
+var (
+	contentHashesMu sync.Mutex
+	contentHashes   = map[string]string{}
+)
+
+// checksumRecord is the PAX record of the last header of the archive, one "<sha256> <path>" line per file
+const checksumRecord = "PROOFAI.sha256sums"
+
+/*
+handleFetchArchive function is used to stream the files of a content ID as a tar archive
+An error before the first file is answered with 404, later errors cut the archive off
+*/
+func handleFetchArchive(w http.ResponseWriter, r *http.Request) {
+	cid := r.FormValue("cid")
+	if cid == "" {
+		http.Error(w, "CID is required", http.StatusBadRequest)
+		return
+	}
+
+	started := false
+	err := writeArchive(w, func(fn func(name string, size int64, content io.Reader) error) error {
+		return contentStore.Walk(r.Context(), cid, func(name string, size int64, content io.Reader) error {
+			if !started {
+				started = true
+				w.Header().Set("Content-Type", "application/x-tar")
+			}
+			return fn(name, size, content)
+		})
+	})
+	if err != nil && !started {
+		http.Error(w, fmt.Sprintf("Failed to get content %s: %v", cid, err), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		// the status is already sent, the miner sees an archive without hashes
+		fmt.Printf("Error streaming %s: %v\n", cid, err)
+	}
+}
+
+/*
+writeArchive function is used to write the files given by walk as a tar archive
+  - every file is hashed while it is written
+  - the hashes of the files are written in a PAX global header at the end
+  - nothing is written if walk fails before its first file
+*/
+func writeArchive(w io.Writer, walk func(fn func(name string, size int64, content io.Reader) error) error) error {
+	writer := tar.NewWriter(w)
+	sums := map[string]string{}
+
+	err := walk(func(name string, size int64, content io.Reader) error {
+		if strings.ContainsAny(name, "\n\x00") {
+			return fmt.Errorf("invalid file name %q", name)
+		}
+		if err := writer.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: size}); err != nil {
+			return err
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(writer, hash), content); err != nil {
+			return err
+		}
+		sums[name] = hex.EncodeToString(hash.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&lines, "%s %s\n", sums[name], name)
+	}
+
+	err = writer.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		Name:       "checksums",
+		PAXRecords: map[string]string{checksumRecord: lines.String()},
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+/*
+handleFetchHash function is used to get the hash of the files of a content ID
+The hash is the SHA-256 of the sorted "<path>\x00<sha256>\n" lines of the files, the ID of the fs and s3 stores,
+so a miner can check a content it downloaded from another miner without downloading it from the service machine
+*/
+func handleFetchHash(w http.ResponseWriter, r *http.Request) {
+	cid := r.FormValue("cid")
+	if cid == "" {
+		http.Error(w, "CID is required", http.StatusBadRequest)
+		return
+	}
+
+	contentHashesMu.Lock()
+	hash, ok := contentHashes[cid]
+	contentHashesMu.Unlock()
+
+	if !ok {
+		var lines []string
+		err := contentStore.Walk(r.Context(), cid, func(name string, size int64, content io.Reader) error {
+			fileHash := sha256.New()
+			if _, err := io.Copy(fileHash, content); err != nil {
+				return err
+			}
+			lines = append(lines, fmt.Sprintf("%s\x00%s\n", name, hex.EncodeToString(fileHash.Sum(nil))))
+			return nil
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get content %s: %v", cid, err), http.StatusNotFound)
+			return
+		}
+		sort.Strings(lines)
+		sum := sha256.Sum256([]byte(strings.Join(lines, "")))
+		hash = hex.EncodeToString(sum[:])
+
+		contentHashesMu.Lock()
+		contentHashes[cid] = hash
+		contentHashesMu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"cid": cid, "hash": hash})
+}
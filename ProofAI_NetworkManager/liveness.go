@@ -0,0 +1,157 @@
+package main
+
+/*
+This file contains the liveness of the miner machines.
+Miners send a signed heartbeat every 30 seconds with their address, the height of the tip of their ledger and their
+role (see minerAuth.go). A miner is live while its last heartbeat is younger than half the miner TTL, late until the
+TTL, and is removed from the registry once its last heartbeat is older than the TTL.
+Every miner joining or leaving the registry is recorded as an event, the last maxMinerEvents events are kept.
+1. MinerEvent struct is used to store a join or leave of a miner
+2. machineState function is used to get the liveness state of a miner
+3. recordEvent function is used to record an event
+4. expireMachines function is used to remove the miners without heartbeat for the TTL
+5. handleMinerEvents function is used to list the events after a sequence number
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxMinerEvents = 1000            // events kept for /machines/events
+	expiryInterval = 5 * time.Second // time between two checks of the TTL of the miners
+)
+
+// Liveness states of a miner
+const (
+	MinerLive = "live"
+	MinerLate = "late"
+)
+
+/*
+MinerEvent struct is used to store a join or leave of a miner
+Reason is register, heartbeat (a miner joining again after it expired), logout, expired or replicated
+*/
+type MinerEvent struct {
+	Seq    int64     `json:"seq"`
+	Type   string    `json:"type"`
+	Reason string    `json:"reason"`
+	PubKey string    `json:"pubKey"`
+	IP     string    `json:"ip"`
+	Port   string    `json:"port"`
+	Role   string    `json:"role,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// minerEvents are the last events, in sequence order
+var (
+	minerEventsMu sync.Mutex
+	minerEvents   []MinerEvent
+	minerEventSeq int64
+)
+
+/*
+machineState function is used to get the liveness state of a miner from its last heartbeat
+*/
+func machineState(machine MachineDetail, now time.Time) string {
+	if now.Sub(machine.Timestamp) < serviceConfig.minerTTL/2 {
+		return MinerLive
+	}
+	return MinerLate
+}
+
+/*
+recordEvent function is used to record the join or leave of a miner
+*/
+func recordEvent(eventType string, reason string, machine MachineDetail) {
+	minerEventsMu.Lock()
+	minerEventSeq++
+	event := MinerEvent{
+		Seq:    minerEventSeq,
+		Type:   eventType,
+		Reason: reason,
+		PubKey: machine.PubKey,
+		IP:     machine.IP,
+		Port:   machine.Port,
+		Role:   machine.Role,
+		Time:   time.Now(),
+	}
+	minerEvents = append(minerEvents, event)
+	if len(minerEvents) > maxMinerEvents {
+		minerEvents = minerEvents[len(minerEvents)-maxMinerEvents:]
+	}
+	minerEventsMu.Unlock()
+
+	fmt.Printf("Miner %s %s:%s %s (%s)\n", event.Type, event.IP, event.Port, shortKey(event.PubKey), event.Reason)
+}
+
+/*
+shortKey function is used to print the beginning of a public key
+*/
+func shortKey(pubKey string) string {
+	if len(pubKey) > 16 {
+		return pubKey[:16]
+	}
+	return pubKey
+}
+
+/*
+expireMachines function is used to remove the miners whose last heartbeat is older than the TTL
+It replaces the polling of the miners, a miner behind NAT or a firewall stays registered while it sends heartbeats
+*/
+func (s *Server) expireMachines() {
+	for {
+		time.Sleep(expiryInterval)
+
+		now := time.Now()
+		var expired []string
+		s.mutex.RLock()
+		for pubKey, machine := range s.machines {
+			if now.Sub(machine.Timestamp) > serviceConfig.minerTTL {
+				expired = append(expired, pubKey)
+			}
+		}
+		s.mutex.RUnlock()
+
+		// the TTL is checked again under the write lock, a heartbeat may have arrived since
+		s.removeMachineIf("expired", func(machine MachineDetail) bool {
+			return time.Since(machine.Timestamp) > serviceConfig.minerTTL
+		}, expired...)
+	}
+}
+
+/*
+handleMinerEvents function is used to list the events with a sequence number greater than since= (0 by default)
+*/
+func handleMinerEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var since int64
+	if value := r.URL.Query().Get("since"); value != "" {
+		var err error
+		if since, err = strconv.ParseInt(value, 10, 64); err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+
+	minerEventsMu.Lock()
+	events := []MinerEvent{}
+	for _, event := range minerEvents {
+		if event.Seq > since {
+			events = append(events, event)
+		}
+	}
+	minerEventsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireKeepsMinerWithNewHeartbeat(t *testing.T) {
+	oldTTL := serviceConfig.minerTTL
+	serviceConfig.minerTTL = 90 * time.Second
+	defer func() { serviceConfig.minerTTL = oldTTL }()
+
+	server := NewServer()
+	stale := time.Now().Add(-2 * serviceConfig.minerTTL)
+	server.putMachine(MachineDetail{IP: "10.0.0.1", Port: "8090", PubKey: "alive", Timestamp: stale}, "register")
+	server.putMachine(MachineDetail{IP: "10.0.0.2", Port: "8090", PubKey: "dead", Timestamp: stale}, "register")
+
+	// both miners are chosen, then a heartbeat of one arrives before the removal
+	expired := []string{"alive", "dead"}
+	server.putMachine(MachineDetail{IP: "10.0.0.1", Port: "8090", PubKey: "alive", Timestamp: time.Now()}, "heartbeat")
+	server.removeMachineIf("expired", func(machine MachineDetail) bool {
+		return time.Since(machine.Timestamp) > serviceConfig.minerTTL
+	}, expired...)
+
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	if _, ok := server.machines["alive"]; !ok {
+		t.Fatal("miner with a new heartbeat was removed")
+	}
+	if _, ok := server.removed["alive"]; ok {
+		t.Fatal("miner with a new heartbeat was recorded as removed")
+	}
+	if _, ok := server.machines["dead"]; ok {
+		t.Fatal("expired miner was kept")
+	}
+	if _, ok := server.removed["dead"]; !ok {
+		t.Fatal("expired miner was not recorded as removed")
+	}
+}
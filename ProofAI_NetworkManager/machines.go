@@ -0,0 +1,334 @@
+package main
+
+/*
+This file contains the persistence and the replication of the registry of the miner machines.
+Miners are keyed by their public key, so miners behind one IP address do not overwrite each other. The registry is
+kept in <data dir>/machines.json and read again when the service machine starts.
+Service machines given as peers replicate their registries: every change is pushed to the peers, and the registries of
+the peers are pulled every replicationInterval to catch up with missed changes. The most recent change of a miner
+wins, a removed miner is remembered (tombstone) for tombstoneTTL so an older registration does not bring it back.
+Replication requests carry the replication token of the service machines, replication is disabled without token.
+1. MachineRegistry struct is the state kept on disk and exchanged with the peers
+2. loadMachines and save functions are used to read and write the registry
+3. putMachine and removeMachine functions are used to change the registry, record the event and push the change to
+   the peers
+4. merge function is used to apply the registry of a peer
+5. handleReplicate function is used to send (GET) and receive (POST) the registry from the peers
+6. runReplication function is used to pull the registries of the peers periodically
+*/
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	replicationInterval = time.Minute      // time between two pulls of the registries of the peers
+	tombstoneTTL        = 24 * time.Hour   // time a removed miner is remembered
+	replicationTimeout  = 10 * time.Second // timeout of the requests to the peers
+)
+
+/*
+MachineRegistry struct is used to store the registry on disk and to exchange it with the peers
+Removed gives the time every removed miner was removed at, by public key
+*/
+type MachineRegistry struct {
+	Machines []MachineDetail      `json:"machines"`
+	Removed  map[string]time.Time `json:"removed"`
+}
+
+// replicationClient is the HTTP client used to reach the peers
+var replicationClient = &http.Client{Timeout: replicationTimeout}
+
+/*
+loadMachines function is used to read the registry kept in file, a missing file is an empty registry
+*/
+func (s *Server) loadMachines(file string) error {
+	s.file = file
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read machines %s: %v", file, err)
+	}
+	var state MachineRegistry
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse machines %s: %v", file, err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, machine := range state.Machines {
+		s.machines[machine.PubKey] = machine
+	}
+	for pubKey, removedAt := range state.Removed {
+		s.removed[pubKey] = removedAt
+	}
+	return nil
+}
+
+/*
+state function is used to get a copy of the registry, the caller holds the lock
+Tombstones older than tombstoneTTL are dropped
+*/
+func (s *Server) state() MachineRegistry {
+	state := MachineRegistry{Machines: make([]MachineDetail, 0, len(s.machines)), Removed: map[string]time.Time{}}
+	for _, machine := range s.machines {
+		state.Machines = append(state.Machines, machine)
+	}
+	for pubKey, removedAt := range s.removed {
+		if time.Since(removedAt) > tombstoneTTL {
+			delete(s.removed, pubKey)
+			continue
+		}
+		state.Removed[pubKey] = removedAt
+	}
+	return state
+}
+
+/*
+save function is used to write the registry to its file, the caller holds the lock
+*/
+func (s *Server) save() {
+	if s.file == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s.state(), "", "  ")
+	if err == nil {
+		temp := s.file + ".tmp"
+		if err = os.WriteFile(temp, data, 0644); err == nil {
+			err = os.Rename(temp, s.file)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Error saving machines: %v\n", err)
+	}
+}
+
+/*
+putMachine function is used to add or update a miner and push it to the peers
+A join event is recorded with reason when the miner was not registered
+*/
+func (s *Server) putMachine(machine MachineDetail, reason string) {
+	s.mutex.Lock()
+	_, found := s.machines[machine.PubKey]
+	s.machines[machine.PubKey] = machine
+	delete(s.removed, machine.PubKey)
+	s.save()
+	s.mutex.Unlock()
+
+	if !found {
+		recordEvent("join", reason, machine)
+	}
+	go s.push(MachineRegistry{Machines: []MachineDetail{machine}})
+}
+
+/*
+removeMachine function is used to remove miners and push their removal to the peers
+A leave event is recorded with reason for every registered miner removed
+*/
+func (s *Server) removeMachine(reason string, pubKeys ...string) {
+	s.removeMachineIf(reason, nil, pubKeys...)
+}
+
+/*
+removeMachineIf function is used to remove the miners for which remove is true, every miner when remove is nil
+remove is called with the write lock held, so a heartbeat received after the miners were chosen keeps its miner
+*/
+func (s *Server) removeMachineIf(reason string, remove func(MachineDetail) bool, pubKeys ...string) {
+	if len(pubKeys) == 0 {
+		return
+	}
+	now := time.Now()
+	change := MachineRegistry{Removed: map[string]time.Time{}}
+	var left []MachineDetail
+
+	s.mutex.Lock()
+	for _, pubKey := range pubKeys {
+		machine, ok := s.machines[pubKey]
+		if remove != nil && (!ok || !remove(machine)) {
+			continue
+		}
+		if ok {
+			left = append(left, machine)
+		}
+		delete(s.machines, pubKey)
+		s.removed[pubKey] = now
+		change.Removed[pubKey] = now
+	}
+	if len(change.Removed) == 0 {
+		s.mutex.Unlock()
+		return
+	}
+	s.save()
+	s.mutex.Unlock()
+
+	for _, machine := range left {
+		recordEvent("leave", reason, machine)
+	}
+	go s.push(change)
+}
+
+/*
+merge function is used to apply the registry of a peer, the most recent change of every miner wins
+Returns the number of miners changed
+*/
+func (s *Server) merge(state MachineRegistry) int {
+	var joined, left []MachineDetail
+	defer func() {
+		for _, machine := range joined {
+			recordEvent("join", "replicated", machine)
+		}
+		for _, machine := range left {
+			recordEvent("leave", "replicated", machine)
+		}
+	}()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	changed := 0
+	for pubKey, removedAt := range state.Removed {
+		if machine, ok := s.machines[pubKey]; ok && machine.Timestamp.Before(removedAt) {
+			delete(s.machines, pubKey)
+			left = append(left, machine)
+			changed++
+		}
+		if removedAt.After(s.removed[pubKey]) {
+			s.removed[pubKey] = removedAt
+		}
+	}
+	for _, machine := range state.Machines {
+		if machine.PubKey == "" || !machine.Timestamp.After(s.removed[machine.PubKey]) {
+			continue
+		}
+		current, ok := s.machines[machine.PubKey]
+		if ok && !machine.Timestamp.After(current.Timestamp) {
+			continue
+		}
+		if !ok {
+			joined = append(joined, machine)
+		}
+		s.machines[machine.PubKey] = machine
+		changed++
+	}
+	if changed > 0 {
+		s.save()
+	}
+	return changed
+}
+
+/*
+push function is used to send a change of the registry to every peer
+*/
+func (s *Server) push(change MachineRegistry) {
+	if serviceConfig.ReplicationToken == "" {
+		return
+	}
+	data, err := json.Marshal(change)
+	if err != nil {
+		return
+	}
+	for _, peer := range serviceConfig.Peers {
+		request, err := http.NewRequest(http.MethodPost, peerURL(peer)+"/machines/replicate", bytes.NewReader(data))
+		if err != nil {
+			continue
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", "Bearer "+serviceConfig.ReplicationToken)
+		resp, err := replicationClient.Do(request)
+		if err != nil {
+			fmt.Printf("Error replicating to %s: %v\n", peer, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+/*
+pull function is used to merge the registry of every peer
+*/
+func (s *Server) pull() {
+	for _, peer := range serviceConfig.Peers {
+		request, err := http.NewRequest(http.MethodGet, peerURL(peer)+"/machines/replicate", nil)
+		if err != nil {
+			continue
+		}
+		request.Header.Set("Authorization", "Bearer "+serviceConfig.ReplicationToken)
+		resp, err := replicationClient.Do(request)
+		if err != nil {
+			fmt.Printf("Error replicating from %s: %v\n", peer, err)
+			continue
+		}
+		var state MachineRegistry
+		err = json.NewDecoder(resp.Body).Decode(&state)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || err != nil {
+			fmt.Printf("Error replicating from %s: status %d\n", peer, resp.StatusCode)
+			continue
+		}
+		if changed := s.merge(state); changed > 0 {
+			fmt.Printf("Replicated %d miners from %s\n", changed, peer)
+		}
+	}
+}
+
+/*
+runReplication function is used to pull the registries of the peers when the service machine starts and every
+replicationInterval
+*/
+func (s *Server) runReplication() {
+	if serviceConfig.ReplicationToken == "" || len(serviceConfig.Peers) == 0 {
+		return
+	}
+	for {
+		s.pull()
+		time.Sleep(replicationInterval)
+	}
+}
+
+/*
+peerURL function is used to get the base URL of a peer given as host:port or URL
+*/
+func peerURL(peer string) string {
+	if strings.Contains(peer, "://") {
+		return strings.TrimSuffix(peer, "/")
+	}
+	return "http://" + peer
+}
+
+/*
+handleReplicate function is used to send the registry to a peer (GET) or merge a change of a peer (POST)
+*/
+func (s *Server) handleReplicate(w http.ResponseWriter, r *http.Request) {
+	token := serviceConfig.ReplicationToken
+	if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		http.Error(w, "Replication is not allowed", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.mutex.Lock()
+		state := s.state()
+		s.mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	case http.MethodPost:
+		var state MachineRegistry
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<20)).Decode(&state); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to parse the registry: %v", err), http.StatusBadRequest)
+			return
+		}
+		s.merge(state)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+/*
+This file contains the authentication of the requests of the miners that change the registry of the miner machines.
+A miner first asks a nonce for its public key (GET /nonce?pubKey=), then signs the action, its public key, the nonce
+and the fields of the request with its key (see signature.go). A nonce is valid for nonceTTL and can be used once,
+so a signed request cannot be replayed. A public key has at most maxNoncesPerKey nonces, a new request replaces the
+oldest, and an IP address has at most maxNoncesPerIP nonces, so one client cannot fill the nonces of every miner.
+1. MinerRequest struct is used to store a signed request of a miner
+2. handleNonce function is used to issue a nonce to a public key
+3. minerMessage function is used to build the message signed by the miner
+4. verifyMinerRequest function is used to check the signature and use the nonce of a request, useNonce to use a nonce
+5. handleHeartbeat function is used to refresh the registration and the liveness of a miner
+*/
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	nonceTTL        = 2 * time.Minute // time a nonce can be used
+	maxNonces       = 10000           // nonces waiting to be used
+	maxNoncesPerIP  = 64              // nonces waiting to be used, issued to one IP address
+	maxNoncesPerKey = 4               // nonces waiting to be used by one public key, e.g. a heartbeat and an unpin
+)
+
+/*
+MinerRequest struct is used to store a signed request of a miner, the machine fields are only used by the registration
+*/
+type MinerRequest struct {
+	MachineDetail
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
+}
+
+// issuedNonce is a nonce waiting to be used by the miner of pubKey, issued to the IP address ip
+type issuedNonce struct {
+	pubKey  string
+	ip      string
+	expires time.Time
+}
+
+// nonces are the nonces issued and not used yet, by nonce, with the nonces of every public key (oldest first) and the count by IP
+var (
+	noncesMu    sync.Mutex
+	nonces      = map[string]issuedNonce{}
+	noncesOfKey = map[string][]string{}
+	noncesPerIP = map[string]int{}
+)
+
+/*
+dropNonce function is used to remove a nonce, the caller holds noncesMu
+*/
+func dropNonce(nonce string) {
+	issued, ok := nonces[nonce]
+	if !ok {
+		return
+	}
+	delete(nonces, nonce)
+	keyNonces := noncesOfKey[issued.pubKey]
+	for i, keyNonce := range keyNonces {
+		if keyNonce == nonce {
+			keyNonces = append(keyNonces[:i:i], keyNonces[i+1:]...)
+			break
+		}
+	}
+	if len(keyNonces) == 0 {
+		delete(noncesOfKey, issued.pubKey)
+	} else {
+		noncesOfKey[issued.pubKey] = keyNonces
+	}
+	if noncesPerIP[issued.ip]--; noncesPerIP[issued.ip] <= 0 {
+		delete(noncesPerIP, issued.ip)
+	}
+}
+
+/*
+dropExpiredNonces function is used to remove the expired nonces, the caller holds noncesMu
+*/
+func dropExpiredNonces(now time.Time) {
+	for nonce, issued := range nonces {
+		if now.After(issued.expires) {
+			dropNonce(nonce)
+		}
+	}
+}
+
+/*
+handleNonce function is used to issue a nonce to the public key given by pubKey=, the answer is {"nonce": "..."}
+The nonce replaces the oldest nonce of a key with maxNoncesPerKey nonces, an IP address with maxNoncesPerIP nonces gets 429
+*/
+func handleNonce(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pubKey := r.URL.Query().Get("pubKey")
+	if _, err := hexToPublicKey(pubKey); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid public key: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	ip := remoteIP(r)
+	noncesMu.Lock()
+	now := time.Now()
+	if keyNonces := noncesOfKey[pubKey]; len(keyNonces) >= maxNoncesPerKey {
+		dropNonce(keyNonces[0])
+	}
+	if len(nonces) >= maxNonces || noncesPerIP[ip] >= maxNoncesPerIP {
+		dropExpiredNonces(now)
+	}
+	if noncesPerIP[ip] >= maxNoncesPerIP {
+		noncesMu.Unlock()
+		http.Error(w, "Too many pending requests from this address, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if len(nonces) >= maxNonces {
+		noncesMu.Unlock()
+		http.Error(w, "Too many pending requests, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	nonce := hex.EncodeToString(buf)
+	nonces[nonce] = issuedNonce{pubKey: pubKey, ip: ip, expires: now.Add(nonceTTL)}
+	noncesOfKey[pubKey] = append(noncesOfKey[pubKey], nonce)
+	noncesPerIP[ip]++
+	noncesMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"nonce": nonce})
+}
+
+/*
+minerMessage function is used to build the message a miner signs for action with the fields of its request
+*/
+func minerMessage(action string, pubKey string, nonce string, fields ...string) string {
+	return strings.Join(append([]string{action, pubKey, nonce}, fields...), "\x00")
+}
+
+/*
+verifyMinerRequest function is used to check a request of a miner for action
+The signature is checked first, so the nonce of a miner is only used by a request signed by the miner
+*/
+func verifyMinerRequest(action string, request MinerRequest, fields ...string) error {
+	message := minerMessage(action, request.PubKey, request.Nonce, fields...)
+	if err := verifySignature(request.PubKey, message, request.Signature); err != nil {
+		return err
+	}
+	return useNonce(request.PubKey, request.Nonce)
+}
+
+/*
+useNonce function is used to use a nonce issued to pubKey, the signature of the request must be checked before
+The owners of uploads and registry names sign their requests over a nonce too (see pins.go and registry.go)
+*/
+func useNonce(pubKey string, nonce string) error {
+	noncesMu.Lock()
+	defer noncesMu.Unlock()
+	issued, ok := nonces[nonce]
+	if !ok || issued.pubKey != pubKey {
+		return fmt.Errorf("unknown nonce, ask a new one on /nonce")
+	}
+	dropNonce(nonce)
+	if time.Now().After(issued.expires) {
+		return fmt.Errorf("nonce expired, ask a new one on /nonce")
+	}
+	return nil
+}
+
+/*
+decodeMinerRequest function is used to read and check the signed request of a miner for action
+The fields of the request are part of the signed message, an error is answered to the miner
+*/
+func decodeMinerRequest(w http.ResponseWriter, r *http.Request, action string, fields func(MinerRequest) []string) (MinerRequest, bool) {
+	var request MinerRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return request, false
+	}
+	var signed []string
+	if fields != nil {
+		signed = fields(request)
+	}
+	if err := verifyMinerRequest(action, request, signed...); err != nil {
+		fmt.Printf("Rejected %s request of %.16s: %v\n", action, request.PubKey, err)
+		http.Error(w, fmt.Sprintf("Invalid signature of the miner: %v", err), http.StatusUnauthorized)
+		return request, false
+	}
+	return request, true
+}
+
+/*
+handleHeartbeat function is used to refresh the registration of a miner, signed like the registration
+The heartbeat gives the address, the height of the tip of the ledger and the role of the miner, a miner removed after
+the miner TTL (see liveness.go) joins again with its next heartbeat
+*/
+func (s *Server) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	request, ok := decodeMinerRequest(w, r, "heartbeat", func(request MinerRequest) []string {
+		return []string{request.IP, request.Port, strconv.Itoa(request.Height), request.Role}
+	})
+	if !ok {
+		return
+	}
+	if request.IP == "" || request.Port == "" || request.Height < 0 {
+		http.Error(w, "Heartbeat requires the address and the height of the miner", http.StatusBadRequest)
+		return
+	}
+
+	machine := request.MachineDetail
+	machine.State = ""
+	machine.Timestamp = time.Now()
+	s.putMachine(machine, "heartbeat")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func resetNonces() {
+	noncesMu.Lock()
+	nonces = map[string]issuedNonce{}
+	noncesOfKey = map[string][]string{}
+	noncesPerIP = map[string]int{}
+	noncesMu.Unlock()
+}
+
+func newTestPubKey(t *testing.T) string {
+	t.Helper()
+	prvKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := prvKey.PublicKey.ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(pubKey.Bytes())
+}
+
+func requestNonce(pubKey string, ip string) (int, string) {
+	request := httptest.NewRequest(http.MethodGet, "/nonce?pubKey="+pubKey, nil)
+	request.RemoteAddr = ip + ":40000"
+	recorder := httptest.NewRecorder()
+	handleNonce(recorder, request)
+	var answer map[string]string
+	json.NewDecoder(recorder.Body).Decode(&answer)
+	return recorder.Code, answer["nonce"]
+}
+
+func TestNonceReplacedForSameKey(t *testing.T) {
+	resetNonces()
+	defer resetNonces()
+	pubKey := newTestPubKey(t)
+
+	_, first := requestNonce(pubKey, "10.0.0.1")
+	_, second := requestNonce(pubKey, "10.0.0.1")
+	for i := 0; i < 2*maxNoncesPerIP; i++ {
+		if code, _ := requestNonce(pubKey, "10.0.0.1"); code != http.StatusOK {
+			t.Fatalf("nonce %d of the same key refused with %d", i, code)
+		}
+	}
+
+	noncesMu.Lock()
+	defer noncesMu.Unlock()
+	if len(nonces) != maxNoncesPerKey || noncesPerIP["10.0.0.1"] != maxNoncesPerKey {
+		t.Fatalf("%d nonces and %d for the IP, want %d", len(nonces), noncesPerIP["10.0.0.1"], maxNoncesPerKey)
+	}
+	if _, ok := nonces[first]; ok {
+		t.Fatal("oldest nonce of the key is still valid")
+	}
+	if _, ok := nonces[second]; ok {
+		t.Fatal("old nonce of the key is still valid")
+	}
+}
+
+func TestNonceLimitPerIP(t *testing.T) {
+	resetNonces()
+	defer resetNonces()
+
+	for i := 0; i < maxNoncesPerIP; i++ {
+		if code, _ := requestNonce(newTestPubKey(t), "10.0.0.1"); code != http.StatusOK {
+			t.Fatalf("nonce %d refused with %d", i, code)
+		}
+	}
+	if code, _ := requestNonce(newTestPubKey(t), "10.0.0.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("nonce past the limit of the IP answered %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code, _ := requestNonce(newTestPubKey(t), "10.0.0.2"); code != http.StatusOK {
+		t.Fatalf("nonce of another IP refused with %d", code)
+	}
+}
+
+func TestUsedNonceReleasesIP(t *testing.T) {
+	resetNonces()
+	defer resetNonces()
+	pubKey := newTestPubKey(t)
+	_, nonce := requestNonce(pubKey, "10.0.0.1")
+
+	noncesMu.Lock()
+	dropNonce(nonce)
+	left := len(nonces) + len(noncesOfKey) + len(noncesPerIP)
+	noncesMu.Unlock()
+	if left != 0 {
+		t.Fatalf("%d entries left after the nonce was used", left)
+	}
+}
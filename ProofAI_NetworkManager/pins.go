@@ -0,0 +1,407 @@
+package main
+
+/*
+This file contains the management of the content pinned in the content store and its garbage collection.
+Every upload is recorded as a pin. An upload claimed by a key (the submitter signs "pin" and the session ID, see
+signature.go) is owned by that key, counts against its quota and is kept until the owner unpins it. Content without
+owner is kept while a transaction of the ledger or the registry references it, and removed from the store once it
+has been neither owned nor referenced for the retention period.
+The pins are kept in <data dir>/pins.json.
+1. Pin struct is used to store a content of the store with its owner
+2. PinSet struct is used to store the pins, loadPins function is used to read it
+3. handlePins function is used to list the pins and the quota of an owner
+4. handleUnpin function is used to release a pin, signed by its owner
+5. runGarbageCollector function is used to remove the released content periodically
+6. contentReferences function is used to get the CIDs referenced by the ledger from the miners
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Pin struct is used to store a content of the store
+  - Owner is the public key owning the content, empty once it is released or when nobody claimed it
+  - ReleasedAt is when the content lost its owner, ReferencedAt the last garbage collection it was referenced at
+*/
+type Pin struct {
+	CID          string    `json:"cid"`
+	Owner        string    `json:"owner,omitempty"`
+	Size         int64     `json:"size"`
+	PinnedAt     time.Time `json:"pinnedAt"`
+	ReleasedAt   time.Time `json:"releasedAt"`
+	ReferencedAt time.Time `json:"referencedAt"`
+}
+
+/*
+expired function is used to check if a pin can be removed from the store at now
+*/
+func (p Pin) expired(now time.Time, retention time.Duration) bool {
+	if p.Owner != "" {
+		return false
+	}
+	last := p.ReleasedAt
+	if p.ReferencedAt.After(last) {
+		last = p.ReferencedAt
+	}
+	return now.Sub(last) >= retention
+}
+
+/*
+PinSet struct is used to store the pins by CID
+mu guards pins and serialises the writes to file
+*/
+type PinSet struct {
+	mu   sync.Mutex
+	pins map[string]*Pin
+	file string
+}
+
+// Global variable to store the pins of the content store, loaded once in main
+var pins = &PinSet{pins: map[string]*Pin{}}
+
+/*
+PinList struct is used to answer the pins of an owner with the bytes they use and the quota, 0 is no limit
+*/
+type PinList struct {
+	Pins  []Pin `json:"pins"`
+	Used  int64 `json:"used"`
+	Quota int64 `json:"quota"`
+}
+
+/*
+loadPins function is used to read the pins kept in file, a missing file is an empty set
+*/
+func loadPins(file string) (*PinSet, error) {
+	set := &PinSet{pins: map[string]*Pin{}, file: file}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return set, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pins %s: %v", file, err)
+	}
+	var list []*Pin
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse pins %s: %v", file, err)
+	}
+	for _, pin := range list {
+		set.pins[pin.CID] = pin
+	}
+	return set, nil
+}
+
+/*
+save function is used to write the pins to their file, the caller holds the lock
+*/
+func (s *PinSet) save() error {
+	if s.file == "" {
+		return nil
+	}
+	list := make([]*Pin, 0, len(s.pins))
+	for _, pin := range s.pins {
+		list = append(list, pin)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CID < list[j].CID })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp := s.file + ".tmp"
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, s.file)
+}
+
+/*
+used function is used to get the bytes pinned by owner, the caller holds the lock
+*/
+func (s *PinSet) used(owner string) int64 {
+	var total int64
+	for _, pin := range s.pins {
+		if pin.Owner == owner {
+			total += pin.Size
+		}
+	}
+	return total
+}
+
+/*
+checkQuota function is used to check that owner can pin size more bytes, before the content is added to the store
+*/
+func (s *PinSet) checkQuota(owner string, size int64) error {
+	if owner == "" || serviceConfig.pinQuota == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if used := s.used(owner); used+size > serviceConfig.pinQuota {
+		return fmt.Errorf("quota exceeded: %d of %d bytes pinned, %d more requested", used, serviceConfig.pinQuota, size)
+	}
+	return nil
+}
+
+/*
+add function is used to record a content added to the store
+  - owner claims the content when it has no owner, content owned by another key keeps its owner
+  - content added again without owner starts its retention period again
+  - the quota of owner is checked again, as other uploads may have finished since checkQuota, content over the
+    quota is recorded without owner
+*/
+func (s *PinSet) add(cid string, owner string, size int64) (Pin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	pin, found := s.pins[cid]
+	if !found {
+		pin = &Pin{CID: cid, Size: size, PinnedAt: now, ReleasedAt: now}
+		s.pins[cid] = pin
+	}
+
+	var err error
+	switch {
+	case pin.Owner != "":
+		// already owned, by owner or by another key
+	case owner != "" && serviceConfig.pinQuota > 0 && s.used(owner)+pin.Size > serviceConfig.pinQuota:
+		err = fmt.Errorf("quota exceeded: %d of %d bytes pinned", s.used(owner), serviceConfig.pinQuota)
+		pin.ReleasedAt = now
+	case owner != "":
+		pin.Owner = owner
+	default:
+		pin.ReleasedAt = now
+	}
+	if saveErr := s.save(); saveErr != nil {
+		fmt.Printf("Error saving pins: %v\n", saveErr)
+	}
+	return *pin, err
+}
+
+/*
+release function is used to remove the owner of a pin, the content is removed by the garbage collection
+*/
+func (s *PinSet) release(cid string, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pin, found := s.pins[cid]
+	if !found || pin.Owner == "" {
+		return fmt.Errorf("%s is not pinned", cid)
+	}
+	if pin.Owner != owner {
+		return fmt.Errorf("%s is pinned by another key", cid)
+	}
+	pin.Owner = ""
+	pin.ReleasedAt = time.Now().UTC()
+	return s.save()
+}
+
+/*
+list function is used to get the pins of owner, all the pins when owner is empty, newest first
+*/
+func (s *PinSet) list(owner string) PinList {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := PinList{Pins: []Pin{}, Quota: serviceConfig.pinQuota}
+	for _, pin := range s.pins {
+		if owner == "" || pin.Owner == owner {
+			result.Pins = append(result.Pins, *pin)
+			result.Used += pin.Size
+		}
+	}
+	sort.Slice(result.Pins, func(i, j int) bool { return result.Pins[i].PinnedAt.After(result.Pins[j].PinnedAt) })
+	return result
+}
+
+/*
+collect function is used to remove the expired pins from the store
+  - refs are the CIDs referenced by the ledger and the registry, they are never removed
+  - a pin claimed or added again since the expired pins were selected is kept
+
+Returns the number of pins removed
+*/
+func (s *PinSet) collect(ctx context.Context, refs map[string]bool, retention time.Duration) int {
+	now := time.Now().UTC()
+	var expired []string
+	s.mu.Lock()
+	for cid, pin := range s.pins {
+		if refs[cid] {
+			pin.ReferencedAt = now
+			continue
+		}
+		if pin.expired(now, retention) {
+			expired = append(expired, cid)
+		}
+	}
+	s.mu.Unlock()
+
+	removed := 0
+	for _, cid := range expired {
+		s.mu.Lock()
+		pin, found := s.pins[cid]
+		if !found || !pin.expired(now, retention) {
+			s.mu.Unlock()
+			continue
+		}
+		delete(s.pins, cid)
+		s.mu.Unlock()
+
+		if err := contentStore.Remove(ctx, cid); err != nil {
+			fmt.Printf("Error removing %s from the content store: %v\n", cid, err)
+			s.mu.Lock()
+			if _, added := s.pins[cid]; !added {
+				s.pins[cid] = pin
+			}
+			s.mu.Unlock()
+			continue
+		}
+		fmt.Printf("Garbage collection: removed %s (%d bytes)\n", cid, pin.Size)
+		removed++
+	}
+
+	s.mu.Lock()
+	if err := s.save(); err != nil {
+		fmt.Printf("Error saving pins: %v\n", err)
+	}
+	s.mu.Unlock()
+	return removed
+}
+
+/*
+handlePins function is used to list the pins, of the owner given by owner= or all of them
+*/
+func handlePins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pins.list(r.URL.Query().Get("owner")))
+}
+
+/*
+handleUnpin function is used to release a pin, it takes the JSON {"cid", "owner", "nonce", "signature"}
+the owner signs "unpin", the CID and a nonce of /nonce, so an unpin cannot be replayed once the CID is pinned again
+*/
+func handleUnpin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		CID       string `json:"cid"`
+		Owner     string `json:"owner"`
+		Nonce     string `json:"nonce"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse the request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := verifySignature(request.Owner, pinMessage("unpin", request.CID, request.Nonce), request.Signature); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid signature of the owner: %v", err), http.StatusUnauthorized)
+		return
+	}
+	if err := useNonce(request.Owner, request.Nonce); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid signature of the owner: %v", err), http.StatusUnauthorized)
+		return
+	}
+	if err := pins.release(request.CID, request.Owner); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	fmt.Printf("Unpinned %s\n", request.CID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{Success: true, Message: request.CID})
+}
+
+/*
+pinMessage function is used to build the message an owner signs to claim an upload session or unpin a CID with a
+nonce of /nonce
+*/
+func pinMessage(action string, id string, nonce string) string {
+	return action + "\x00" + id + "\x00" + nonce
+}
+
+/*
+runGarbageCollector function is used to collect the garbage of the content store every gc interval
+Nothing is removed while no miner tells the references of the ledger
+*/
+func runGarbageCollector(server *Server) {
+	if serviceConfig.gcInterval == 0 {
+		return
+	}
+	for {
+		time.Sleep(serviceConfig.gcInterval)
+
+		refs, err := contentReferences(server)
+		if err != nil {
+			fmt.Printf("Garbage collection skipped: %v\n", err)
+			continue
+		}
+		ctx := context.Background()
+		if removed := pins.collect(ctx, refs, serviceConfig.pinRetention); removed > 0 {
+			if collector, ok := contentStore.(interface{ collectGarbage(context.Context) error }); ok {
+				if err := collector.collectGarbage(ctx); err != nil {
+					fmt.Printf("Error collecting the garbage of the content store: %v\n", err)
+				}
+			}
+		}
+	}
+}
+
+// contentRefsClient is the HTTP client used to get the references of the ledger from the miners
+var contentRefsClient = &http.Client{Timeout: 30 * time.Second}
+
+/*
+contentReferences function is used to get the CIDs referenced by the ledger, the registry and the pending transactions
+Every registered miner is asked for its references on /api/contentRefs, an error is returned if no miner answers
+*/
+func contentReferences(server *Server) (map[string]bool, error) {
+	refs := map[string]bool{}
+	for _, entry := range registry.search("", "", "", false) {
+		refs[entry.CID] = true
+	}
+
+	server.mutex.RLock()
+	var addresses []string
+	for _, machine := range server.machines {
+		addresses = append(addresses, machine.IP)
+	}
+	server.mutex.RUnlock()
+
+	answered := 0
+	for _, address := range addresses {
+		resp, err := contentRefsClient.Get("http://" + address + ":8079/api/contentRefs?chainId=" + url.QueryEscape(chainInfo.ChainID))
+		if err != nil {
+			continue
+		}
+		var cids []string
+		err = json.NewDecoder(resp.Body).Decode(&cids)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || err != nil {
+			continue
+		}
+		for _, cid := range cids {
+			refs[cid] = true
+		}
+		answered++
+	}
+	if answered == 0 {
+		return nil, fmt.Errorf("no miner answered with the references of the ledger")
+	}
+	return refs, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+testOwner is the key of an owner of uploads and registry names
+*/
+type testOwner struct {
+	prvKey *ecdsa.PrivateKey
+	pubKey string
+}
+
+func newTestOwner(t *testing.T) testOwner {
+	t.Helper()
+	prvKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := prvKey.PublicKey.ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testOwner{prvKey: prvKey, pubKey: hex.EncodeToString(pubKey.Bytes())}
+}
+
+func (o testOwner) nonce(t *testing.T) string {
+	t.Helper()
+	code, nonce := requestNonce(o.pubKey, "10.0.0.1")
+	if code != http.StatusOK {
+		t.Fatalf("nonce refused with %d", code)
+	}
+	return nonce
+}
+
+func (o testOwner) sign(t *testing.T, message string) string {
+	t.Helper()
+	hash := sha256.Sum256([]byte(message))
+	signature, err := ecdsa.SignASN1(rand.Reader, o.prvKey, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(signature)
+}
+
+func postJSON(handler http.HandlerFunc, target string, body []byte) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	request.RemoteAddr = "10.0.0.1:40000"
+	handler(recorder, request)
+	return recorder
+}
+
+func TestUnpinCannotBeReplayed(t *testing.T) {
+	resetNonces()
+	defer resetNonces()
+	oldPins := pins
+	pins = &PinSet{pins: map[string]*Pin{}}
+	defer func() { pins = oldPins }()
+
+	owner := newTestOwner(t)
+	const cid = "0000000000000000000000000000000000000000000000000000000000000001"
+	pins.add(cid, owner.pubKey, 10)
+
+	nonce := owner.nonce(t)
+	body, _ := json.Marshal(map[string]string{"cid": cid, "owner": owner.pubKey, "nonce": nonce, "signature": owner.sign(t, pinMessage("unpin", cid, nonce))})
+	if recorder := postJSON(handleUnpin, "/pins/unpin", body); recorder.Code != http.StatusOK {
+		t.Fatalf("unpin answered %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// the owner pins the content again, the unpin seen before must not release it
+	pins.add(cid, owner.pubKey, 10)
+	if recorder := postJSON(handleUnpin, "/pins/unpin", body); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("replayed unpin answered %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+	if pins.list(owner.pubKey).Used != 10 {
+		t.Fatal("replayed unpin released the content")
+	}
+}
+
+func TestRegistryPublishCannotBeReplayed(t *testing.T) {
+	resetNonces()
+	defer resetNonces()
+	oldStore, oldRegistry := contentStore, registry
+	contentStore, registry = fsStore{root: t.TempDir()}, &Registry{}
+	defer func() { contentStore, registry = oldStore, oldRegistry }()
+
+	addContent := func(content string) string {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "data.csv"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cid, err := contentStore.Add(context.Background(), dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cid
+	}
+	owner := newTestOwner(t)
+	publish := func(cid string) []byte {
+		nonce := owner.nonce(t)
+		body, _ := json.Marshal(map[string]string{
+			"name": "cleaned-data", "kind": "dataset", "cid": cid, "owner": owner.pubKey, "nonce": nonce,
+			"signature": owner.sign(t, registryMessage("cleaned-data", "dataset", cid, "", "", nonce)),
+		})
+		return body
+	}
+
+	first := publish(addContent("a,b\n"))
+	if recorder := postJSON(handleRegistry, "/registry", first); recorder.Code != http.StatusCreated {
+		t.Fatalf("version 1 answered %d: %s", recorder.Code, recorder.Body.String())
+	}
+	second := addContent("a,b\n1,2\n")
+	if recorder := postJSON(handleRegistry, "/registry", publish(second)); recorder.Code != http.StatusCreated {
+		t.Fatalf("version 2 answered %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	if recorder := postJSON(handleRegistry, "/registry", first); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("replayed version 1 answered %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+	registry.mu.Lock()
+	latest, _ := registry.find("cleaned-data", 0)
+	registry.mu.Unlock()
+	if latest.Version != 2 || latest.CID != second {
+		t.Fatalf("latest is %s@%d, want version 2 of %s", latest.CID, latest.Version, second)
+	}
+}
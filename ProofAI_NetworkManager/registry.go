@@ -0,0 +1,309 @@
+package main
+
+/*
+This file contains the registry of the datasets and models uploaded to the service machine.
+An entry gives a name and a version to a CID, so users do not have to remember CIDs: "cleaned-data@3" is version 3 of
+cleaned-data and "cleaned-data" its latest version. The first publisher of a name owns it, only the owner can publish
+new versions, and a publish request is signed with the key of the owner over a nonce of /nonce (see minerAuth.go), so
+a signature seen once cannot publish the same CID again as a newer version.
+The registry is kept in <data dir>/registry.json.
+1. RegistryEntry struct is used to store a version of a dataset or model
+2. Registry struct is used to store the entries, loadRegistry function is used to read it
+3. handleRegistry function is used to publish (POST) and search (GET) entries
+4. handleRegistryResolve function is used to get the entry of a name or name@version
+5. registryMessage function is used to build the message signed by the owner
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+RegistryEntry struct is used to store a version of a dataset or model
+Size is the size of the files of the CID, computed by the service machine
+*/
+type RegistryEntry struct {
+	Name        string    `json:"name"`
+	Version     int       `json:"version"`
+	Kind        string    `json:"kind"`
+	Owner       string    `json:"owner"`
+	CID         string    `json:"cid"`
+	Size        int64     `json:"size"`
+	Description string    `json:"description,omitempty"`
+	License     string    `json:"license,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+/*
+Registry struct is used to store the entries of the registry
+mu guards entries and serialises the writes to file
+*/
+type Registry struct {
+	mu      sync.RWMutex
+	entries []RegistryEntry
+	file    string
+}
+
+// registryNamePattern is the format of the names of the registry, @ separates the version
+var registryNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// Global variable to store the registry of the service machine, loaded once in main
+var registry = &Registry{}
+
+/*
+loadRegistry function is used to read the registry kept in file, a missing file is an empty registry
+*/
+func loadRegistry(file string) (*Registry, error) {
+	r := &Registry{file: file}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry %s: %v", file, err)
+	}
+	if err := json.Unmarshal(data, &r.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse registry %s: %v", file, err)
+	}
+	return r, nil
+}
+
+/*
+save function is used to write the registry to its file, the caller holds the write lock
+*/
+func (r *Registry) save() error {
+	if r.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp := r.file + ".tmp"
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, r.file)
+}
+
+/*
+publish function is used to add a new version of a name
+  - the owner of the first version owns the name
+  - publishing the CID of the latest version again answers the latest version
+*/
+func (r *Registry) publish(entry RegistryEntry) (RegistryEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	latest, found := r.find(entry.Name, 0)
+	if found {
+		if latest.Owner != entry.Owner {
+			return RegistryEntry{}, fmt.Errorf("name %s is owned by another key", entry.Name)
+		}
+		if latest.Kind != entry.Kind {
+			return RegistryEntry{}, fmt.Errorf("name %s is a %s", entry.Name, latest.Kind)
+		}
+		if latest.CID == entry.CID {
+			return latest, nil
+		}
+	}
+
+	entry.Version = latest.Version + 1
+	entry.CreatedAt = time.Now().UTC()
+	r.entries = append(r.entries, entry)
+	if err := r.save(); err != nil {
+		r.entries = r.entries[:len(r.entries)-1]
+		return RegistryEntry{}, fmt.Errorf("failed to save registry: %v", err)
+	}
+	return entry, nil
+}
+
+/*
+find function is used to get a version of a name, version 0 is the latest version, the caller holds the lock
+*/
+func (r *Registry) find(name string, version int) (RegistryEntry, bool) {
+	var result RegistryEntry
+	found := false
+	for _, entry := range r.entries {
+		if entry.Name != name {
+			continue
+		}
+		if version == entry.Version || (version == 0 && entry.Version > result.Version) {
+			result, found = entry, true
+		}
+	}
+	return result, found
+}
+
+/*
+resolve function is used to get the entry of a reference name or name@version
+*/
+func (r *Registry) resolve(ref string) (RegistryEntry, error) {
+	name, version := ref, 0
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		var err error
+		name = ref[:i]
+		version, err = strconv.Atoi(ref[i+1:])
+		if err != nil || version <= 0 {
+			return RegistryEntry{}, fmt.Errorf("invalid version in %q", ref)
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry, found := r.find(name, version)
+	if !found {
+		return RegistryEntry{}, fmt.Errorf("%s is not in the registry", ref)
+	}
+	return entry, nil
+}
+
+/*
+search function is used to list the entries matching the filters, by name and newest version first
+  - query matches the name or the description, case insensitive
+  - kind and owner must be equal when set
+  - latest keeps only the latest version of every name
+*/
+func (r *Registry) search(query string, kind string, owner string, latest bool) []RegistryEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	query = strings.ToLower(query)
+	newest := map[string]int{}
+	for _, entry := range r.entries {
+		newest[entry.Name] = max(newest[entry.Name], entry.Version)
+	}
+
+	entries := []RegistryEntry{}
+	for _, entry := range r.entries {
+		if kind != "" && entry.Kind != kind || owner != "" && entry.Owner != owner {
+			continue
+		}
+		if latest && entry.Version != newest[entry.Name] {
+			continue
+		}
+		if query != "" && !strings.Contains(strings.ToLower(entry.Name), query) && !strings.Contains(strings.ToLower(entry.Description), query) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Version > entries[j].Version
+	})
+	return entries
+}
+
+/*
+registryMessage function is used to build the message the owner signs to publish an entry with a nonce of /nonce
+*/
+func registryMessage(name string, kind string, cid string, description string, license string, nonce string) string {
+	return strings.Join([]string{"registry", name, kind, cid, description, license, nonce}, "\x00")
+}
+
+/*
+handleRegistry function is used to publish an entry (POST) or search the registry (GET)
+POST takes the JSON {"name", "kind", "cid", "description", "license", "owner", "nonce", "signature"}, kind is dataset or model
+GET takes the optional query parameters q, kind, owner and latest=true
+*/
+func handleRegistry(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		entries := registry.search(query.Get("q"), query.Get("kind"), query.Get("owner"), query.Get("latest") == "true")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	case http.MethodPost:
+		publishRegistryEntry(w, r)
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+publishRegistryEntry function is used to check and add a signed entry
+The CID must be in the content store, its size is recorded
+*/
+func publishRegistryEntry(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		RegistryEntry
+		Nonce     string `json:"nonce"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse the entry: %v", err), http.StatusBadRequest)
+		return
+	}
+	entry := request.RegistryEntry
+	if !registryNamePattern.MatchString(entry.Name) {
+		http.Error(w, "Name must be 1 to 128 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	if entry.Kind != "dataset" && entry.Kind != "model" {
+		http.Error(w, "Kind must be dataset or model", http.StatusBadRequest)
+		return
+	}
+	if entry.CID == "" || len(entry.Description) > 4096 || len(entry.License) > 256 {
+		http.Error(w, "CID is required, description and license are limited to 4096 and 256 characters", http.StatusBadRequest)
+		return
+	}
+	message := registryMessage(entry.Name, entry.Kind, entry.CID, entry.Description, entry.License, request.Nonce)
+	if err := verifySignature(entry.Owner, message, request.Signature); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid signature of the owner: %v", err), http.StatusUnauthorized)
+		return
+	}
+	if err := useNonce(entry.Owner, request.Nonce); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid signature of the owner: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	files, err := contentStore.List(r.Context(), entry.CID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Content %s not found: %v", entry.CID, err), http.StatusNotFound)
+		return
+	}
+	entry.Size = 0
+	for _, file := range files {
+		entry.Size += file.Size
+	}
+
+	entry, err = registry.publish(entry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	fmt.Printf("Registry: %s@%d is %s\n", entry.Name, entry.Version, entry.CID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
+
+/*
+handleRegistryResolve function is used to get the entry of ref=name or ref=name@version
+*/
+func handleRegistryResolve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entry, err := registry.resolve(r.URL.Query().Get("ref"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
@@ -0,0 +1,353 @@
+package main
+
+/*
+This file contains the configuration of the service machine and the selection of its network addresses.
+Every setting is read from (later ones win): defaults, the JSON config file, environment variables, command line flags.
+1. ServiceConfig struct is used to store the configuration of the service machine
+2. loadServiceConfig function is used to load the configuration
+3. getInterfaceIPv4 function is used to get the IPv4 address of a network interface by name
+4. bindAddress and advertiseAddress functions are used to select the addresses of the service machine
+5. dataPath function is used to get the path of a file in the data directory, parseSize function is used to parse sizes like 20g
+6. handleWhoAmI function is used to tell a miner the address it connects from, so miners behind NAT can advertise it
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ServiceConfig struct is used to store the configuration of the service machine
+*/
+type ServiceConfig struct {
+	BindAddress      string   `json:"bindAddress"`      // IP the service machine listens on, empty selects it automatically
+	AdvertiseAddress string   `json:"advertiseAddress"` // IP or host name printed for the miners, empty detects it automatically
+	Interface        string   `json:"interface"`        // part of the name of the preferred network interface (RadminVPN by default)
+	Port             string   `json:"port"`             // port the service machine listens on
+	ChainConfig      string   `json:"chainConfig"`      // path of the chain config file (see chainConfig.go)
+	ChainID          string   `json:"chainId"`          // ID of the chain served to the miners, replaces the chain ID of the chain config file
+	Store            string   `json:"store"`            // content store: ipfs, fs or s3 (see contentStore.go)
+	IPFSAPI          string   `json:"ipfsApi"`          // address of the HTTP API of the IPFS node
+	StoreDir         string   `json:"storeDir"`         // directory of the fs store
+	S3Endpoint       string   `json:"s3Endpoint"`       // URL of the S3-compatible server, e.g. http://localhost:9000
+	S3Bucket         string   `json:"s3Bucket"`         // bucket of the s3 store
+	S3AccessKey      string   `json:"s3AccessKey"`      // access key of the s3 store
+	S3SecretKey      string   `json:"s3SecretKey"`      // secret key of the s3 store
+	UploadDir        string   `json:"uploadDir"`        // directory of the resumable upload sessions, empty uses the temporary directory
+	DataDir          string   `json:"dataDir"`          // directory of the files kept by the service machine (registry, pins), the working directory by default
+	PinQuota         string   `json:"pinQuota"`         // bytes of content an owner may keep pinned, e.g. 20g, 0 is no limit
+	PinRetention     string   `json:"pinRetention"`     // time content without owner nor reference is kept, e.g. 168h
+	GCInterval       string   `json:"gcInterval"`       // time between two garbage collections of the content store, 0 disables it
+	MinerTTL         string   `json:"minerTtl"`         // time a miner stays registered after its last heartbeat, e.g. 90s
+	Peers            []string `json:"peers"`            // addresses of the service machines the miner registry is replicated with
+	ReplicationToken string   `json:"replicationToken"` // secret shared by the replicated service machines, empty disables the replication
+
+	pinQuota     int64         // PinQuota in bytes
+	pinRetention time.Duration // PinRetention
+	gcInterval   time.Duration // GCInterval
+	minerTTL     time.Duration // MinerTTL
+}
+
+// Global variable to store the configuration of the service machine, loaded once in main
+var serviceConfig = defaultServiceConfig()
+
+/*
+defaultServiceConfig function is used to get the configuration used when nothing is set
+*/
+func defaultServiceConfig() ServiceConfig {
+	return ServiceConfig{Interface: "Radmin", Port: "8050", Store: "ipfs", IPFSAPI: "localhost:5001", ChainConfig: "chain.json", DataDir: ".", PinQuota: "20g", PinRetention: "168h", GCInterval: "1h", MinerTTL: "90s"}
+}
+
+/*
+loadServiceConfig function is used to load the configuration of the service machine
+The config file is given by -config or PROOFAI_NM_CONFIG (NetworkManager_config.json if present)
+The environment variables are PROOFAI_NM_BIND_ADDRESS, PROOFAI_NM_ADVERTISE_ADDRESS, PROOFAI_NM_INTERFACE, PROOFAI_NM_PORT, PROOFAI_NM_CHAIN_CONFIG, PROOFAI_NM_CHAIN_ID,
+PROOFAI_NM_STORE, PROOFAI_NM_IPFS_API, PROOFAI_NM_STORE_DIR, PROOFAI_NM_S3_ENDPOINT, PROOFAI_NM_S3_BUCKET, PROOFAI_NM_S3_ACCESS_KEY, PROOFAI_NM_S3_SECRET_KEY, PROOFAI_NM_UPLOAD_DIR, PROOFAI_NM_DATA_DIR,
+PROOFAI_NM_PIN_QUOTA, PROOFAI_NM_PIN_RETENTION, PROOFAI_NM_GC_INTERVAL, PROOFAI_NM_MINER_TTL, PROOFAI_NM_PEERS (comma separated) and PROOFAI_NM_REPLICATION_TOKEN
+The data directory is made absolute and created
+*/
+func loadServiceConfig(args []string) (ServiceConfig, error) {
+	config := defaultServiceConfig()
+
+	flags := flag.NewFlagSet("ProofAI_NetworkManager", flag.ContinueOnError)
+	configFile := flags.String("config", envOr("PROOFAI_NM_CONFIG", "NetworkManager_config.json"), "path of the JSON config file")
+	bind := flags.String("bind", "", "IP the service machine listens on")
+	advertise := flags.String("advertise", "", "IP or host name printed for the miners")
+	iface := flags.String("interface", "", "part of the name of the preferred network interface")
+	port := flags.String("port", "", "port the service machine listens on")
+	chainConfig := flags.String("chain-config", "", "path of the chain config file")
+	chainID := flags.String("chain-id", "", "ID of the chain served to the miners")
+	store := flags.String("store", "", "content store: ipfs, fs or s3")
+	ipfsAPI := flags.String("ipfs-api", "", "address of the HTTP API of the IPFS node")
+	storeDir := flags.String("store-dir", "", "directory of the fs store")
+	s3Endpoint := flags.String("s3-endpoint", "", "URL of the S3-compatible server")
+	s3Bucket := flags.String("s3-bucket", "", "bucket of the s3 store")
+	uploadDir := flags.String("upload-dir", "", "directory of the resumable upload sessions")
+	dataDir := flags.String("data-dir", "", "directory of the files kept by the service machine")
+	pinQuota := flags.String("pin-quota", "", "bytes of content an owner may keep pinned, e.g. 20g, 0 is no limit")
+	pinRetention := flags.String("pin-retention", "", "time content without owner nor reference is kept, e.g. 168h")
+	gcInterval := flags.String("gc-interval", "", "time between two garbage collections of the content store, 0 disables it")
+	minerTTL := flags.String("miner-ttl", "", "time a miner stays registered after its last heartbeat, e.g. 90s")
+	peers := flags.String("peers", "", "comma separated addresses of the service machines the miner registry is replicated with")
+	if err := flags.Parse(args); err != nil {
+		return config, err
+	}
+
+	data, err := os.ReadFile(*configFile)
+	if err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return config, fmt.Errorf("failed to parse config file %s: %v", *configFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return config, fmt.Errorf("failed to read config file %s: %v", *configFile, err)
+	}
+
+	config.BindAddress = envOr("PROOFAI_NM_BIND_ADDRESS", config.BindAddress)
+	config.AdvertiseAddress = envOr("PROOFAI_NM_ADVERTISE_ADDRESS", config.AdvertiseAddress)
+	config.Interface = envOr("PROOFAI_NM_INTERFACE", config.Interface)
+	config.Port = envOr("PROOFAI_NM_PORT", config.Port)
+	config.ChainConfig = envOr("PROOFAI_NM_CHAIN_CONFIG", config.ChainConfig)
+	config.ChainID = envOr("PROOFAI_NM_CHAIN_ID", config.ChainID)
+	config.Store = envOr("PROOFAI_NM_STORE", config.Store)
+	config.IPFSAPI = envOr("PROOFAI_NM_IPFS_API", config.IPFSAPI)
+	config.StoreDir = envOr("PROOFAI_NM_STORE_DIR", config.StoreDir)
+	config.S3Endpoint = envOr("PROOFAI_NM_S3_ENDPOINT", config.S3Endpoint)
+	config.S3Bucket = envOr("PROOFAI_NM_S3_BUCKET", config.S3Bucket)
+	config.S3AccessKey = envOr("PROOFAI_NM_S3_ACCESS_KEY", config.S3AccessKey)
+	config.S3SecretKey = envOr("PROOFAI_NM_S3_SECRET_KEY", config.S3SecretKey)
+	config.UploadDir = envOr("PROOFAI_NM_UPLOAD_DIR", config.UploadDir)
+	config.DataDir = envOr("PROOFAI_NM_DATA_DIR", config.DataDir)
+	config.PinQuota = envOr("PROOFAI_NM_PIN_QUOTA", config.PinQuota)
+	config.PinRetention = envOr("PROOFAI_NM_PIN_RETENTION", config.PinRetention)
+	config.GCInterval = envOr("PROOFAI_NM_GC_INTERVAL", config.GCInterval)
+	config.MinerTTL = envOr("PROOFAI_NM_MINER_TTL", config.MinerTTL)
+	if value := envOr("PROOFAI_NM_PEERS", ""); value != "" {
+		config.Peers = splitList(value)
+	}
+	config.ReplicationToken = envOr("PROOFAI_NM_REPLICATION_TOKEN", config.ReplicationToken)
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "bind":
+			config.BindAddress = *bind
+		case "advertise":
+			config.AdvertiseAddress = *advertise
+		case "interface":
+			config.Interface = *iface
+		case "port":
+			config.Port = *port
+		case "chain-config":
+			config.ChainConfig = *chainConfig
+		case "chain-id":
+			config.ChainID = *chainID
+		case "store":
+			config.Store = *store
+		case "ipfs-api":
+			config.IPFSAPI = *ipfsAPI
+		case "store-dir":
+			config.StoreDir = *storeDir
+		case "s3-endpoint":
+			config.S3Endpoint = *s3Endpoint
+		case "s3-bucket":
+			config.S3Bucket = *s3Bucket
+		case "upload-dir":
+			config.UploadDir = *uploadDir
+		case "data-dir":
+			config.DataDir = *dataDir
+		case "pin-quota":
+			config.PinQuota = *pinQuota
+		case "pin-retention":
+			config.PinRetention = *pinRetention
+		case "gc-interval":
+			config.GCInterval = *gcInterval
+		case "miner-ttl":
+			config.MinerTTL = *minerTTL
+		case "peers":
+			config.Peers = splitList(*peers)
+		}
+	})
+
+	if config.pinQuota, err = parseSize(config.PinQuota); err != nil {
+		return config, fmt.Errorf("invalid pin quota %q: %v", config.PinQuota, err)
+	}
+	if config.pinRetention, err = time.ParseDuration(config.PinRetention); err != nil || config.pinRetention < 0 {
+		return config, fmt.Errorf("invalid pin retention %q, use a duration like 168h", config.PinRetention)
+	}
+	if config.gcInterval, err = time.ParseDuration(config.GCInterval); err != nil || config.gcInterval < 0 {
+		return config, fmt.Errorf("invalid garbage collection interval %q, use a duration like 1h", config.GCInterval)
+	}
+	if config.minerTTL, err = time.ParseDuration(config.MinerTTL); err != nil || config.minerTTL <= 0 {
+		return config, fmt.Errorf("invalid miner TTL %q, use a duration like 90s", config.MinerTTL)
+	}
+
+	if config.DataDir == "" {
+		return config, fmt.Errorf("data directory is required")
+	}
+	dir, err := filepath.Abs(config.DataDir)
+	if err != nil {
+		return config, fmt.Errorf("invalid data directory %q: %v", config.DataDir, err)
+	}
+	config.DataDir = dir
+	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+		return config, fmt.Errorf("failed to create data directory %s: %v", config.DataDir, err)
+	}
+	return config, nil
+}
+
+/*
+dataPath function is used to get the absolute path of a file in the data directory
+*/
+func (config ServiceConfig) dataPath(elem ...string) string {
+	return filepath.Join(append([]string{config.DataDir}, elem...)...)
+}
+
+/*
+parseSize function is used to parse a size in bytes with an optional k, m, g or t suffix (powers of 1024)
+*/
+func parseSize(value string) (int64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	value = strings.TrimSuffix(value, "b")
+	multiplier := int64(1)
+	if i := strings.IndexAny(value, "kmgt"); i >= 0 && i == len(value)-1 {
+		multiplier = int64(1) << (10 * (strings.IndexByte("kmgt", value[i]) + 1))
+		value = value[:i]
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("expected a size like 512m or 20g")
+	}
+	return size * multiplier, nil
+}
+
+/*
+splitList function is used to split a comma separated list, empty items are dropped
+*/
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+/*
+envOr function is used to read an environment variable, returns fallback if it is not set
+*/
+func envOr(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+/*
+getInterfaceIPv4 function is used to get the IPv4 address of the network interface whose name contains name
+*/
+func getInterfaceIPv4(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("no network interface name given")
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", fmt.Errorf("failed to get network interfaces: %v", err)
+	}
+
+	for _, iface := range interfaces {
+
+		if strings.Contains(iface.Name, name) {
+			addrs, err := iface.Addrs()
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs {
+				ipNet, ok := addr.(*net.IPNet)
+				if !ok {
+					continue
+				}
+
+				ipv4 := ipNet.IP.To4()
+				if ipv4 != nil {
+					return ipv4.String(), nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("IPv4 address of network interface %q not found", name)
+}
+
+/*
+bindAddress function is used to select the IP the service machine listens on
+The configured address, then the preferred network interface, then all interfaces
+*/
+func bindAddress() string {
+	if serviceConfig.BindAddress != "" {
+		return serviceConfig.BindAddress
+	}
+	if ip, err := getInterfaceIPv4(serviceConfig.Interface); err == nil {
+		return ip
+	}
+	return "0.0.0.0"
+}
+
+/*
+advertiseAddress function is used to select the address printed for the miners
+The configured address, then the preferred network interface, then the first non-loopback IPv4 address
+*/
+func advertiseAddress() (string, error) {
+	if serviceConfig.AdvertiseAddress != "" {
+		return serviceConfig.AdvertiseAddress, nil
+	}
+	if ip, err := getInterfaceIPv4(serviceConfig.Interface); err == nil {
+		return ip, nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", fmt.Errorf("failed to get network interfaces: %v", err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+		if ipv4 := ipNet.IP.To4(); ipv4 != nil {
+			return ipv4.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no IPv4 address found")
+}
+
+/*
+remoteIP function is used to get the IP address a request comes from
+*/
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+/*
+handleWhoAmI function is used to answer a miner with the IP address it connects from as plain text
+*/
+func handleWhoAmI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, remoteIP(r))
+}
@@ -0,0 +1,67 @@
+package main
+
+/*
+This file contains the verification of the ECDSA signatures of the miners, in the format the miners sign transactions:
+the SHA-256 hash of the message signed with the P-256 key of the miner, the signature is the hex of the ASN.1 (R, S) pair
+1. hexToPublicKey function is used to parse the hex of an uncompressed public key
+2. verifySignature function is used to check the signature of a message
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+)
+
+/*
+hexToPublicKey function is used to parse the hex of an uncompressed P-256 public key (0x04, X, Y)
+*/
+func hexToPublicKey(hexStr string) (*ecdsa.PublicKey, error) {
+	pubBytes, err := hex.DecodeString(hexStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex string: %v", err)
+	}
+	if len(pubBytes) != 65 || pubBytes[0] != 0x04 {
+		return nil, fmt.Errorf("invalid public key: expected 65 bytes of an uncompressed key")
+	}
+
+	pubKey := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(pubBytes[1:33]),
+		Y:     new(big.Int).SetBytes(pubBytes[33:65]),
+	}
+	if !pubKey.Curve.IsOnCurve(pubKey.X, pubKey.Y) {
+		return nil, fmt.Errorf("invalid public key: not on the P-256 curve")
+	}
+	return pubKey, nil
+}
+
+/*
+verifySignature function is used to check that signature is the signature of message by the key pubKey
+*/
+func verifySignature(pubKey string, message string, signature string) error {
+	key, err := hexToPublicKey(pubKey)
+	if err != nil {
+		return err
+	}
+	signatureBytes, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(signatureBytes, &sig); err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+
+	hash := sha256.Sum256([]byte(message))
+	if !ecdsa.Verify(key, hash[:], sig.R, sig.S) {
+		return fmt.Errorf("signature verification failed")
+	}
+	return nil
+}
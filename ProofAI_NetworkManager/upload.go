@@ -0,0 +1,536 @@
+package main
+
+/*
+This file contains the resumable upload of datasets and models in chunks.
+An upload session is the directory <upload dir>/<id> holding session.json (the declared files) and files/ (the
+received bytes). The bytes received of a file are the size of its file on disk, so a chunk cut off by the network
+still counts and the client resumes from the progress of the session, even after a restart of the service machine.
+1. POST /upload/session creates a session for a list of files with their path, size and optional SHA-256 hash
+2. GET /upload/session?id= gives the progress of a session
+3. PUT /upload/chunk?id=&path=&offset= writes a chunk of a file, offset must not be past the bytes already received
+4. POST /upload/finalize?id= checks the files, adds them to the content store and answers the CID of the directory
+   with the CID and size of every file, owner=, nonce= and signature= claim the upload for a key (see pins.go)
+5. sanitizeUploadPath function is used to check the paths sent by the clients
+6. expireUploads function is used to remove the sessions not used for uploadSessionTTL
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxUploadSize    = 5 * 1024 << 20   // total size of the files of a session
+	maxUploadFiles   = 10000            // files of a session
+	uploadChunkSize  = 8 << 20          // chunk size advised to the clients
+	maxUploadChunk   = 64 << 20         // largest chunk accepted
+	uploadSessionTTL = 24 * time.Hour   // sessions not used for this long are removed
+	uploadExpiry     = 10 * time.Minute // time between two checks of the TTL of the sessions
+)
+
+/*
+UploadFile struct is used to store a file of an upload session
+Received is computed from the file on disk and is not stored in session.json
+*/
+type UploadFile struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+	Received int64  `json:"received"`
+}
+
+/*
+UploadSession struct is used to store an upload session, it is answered as the progress of the session
+CID and Files are set once the session is finalized
+*/
+type UploadSession struct {
+	ID        string       `json:"id"`
+	ChunkSize int64        `json:"chunkSize"`
+	Size      int64        `json:"size"`
+	Received  int64        `json:"received"`
+	Complete  bool         `json:"complete"`
+	Uploads   []UploadFile `json:"uploads"`
+	CID       string       `json:"cid,omitempty"`
+	Files     []StoredFile `json:"files,omitempty"`
+}
+
+/*
+uploadLock struct is used to serialise the requests of one session
+refs counts the requests holding or waiting for the lock, the lock is removed from uploadLocks when it drops to 0
+*/
+type uploadLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// uploadLocks stores the locks of the sessions with a request in progress
+var (
+	uploadLocksMu sync.Mutex
+	uploadLocks   = map[string]*uploadLock{}
+)
+
+/*
+lockUploadSession function is used to lock a session, the returned function unlocks it
+The ID is checked before a lock is created, so the map only holds valid IDs of sessions in use
+*/
+func lockUploadSession(id string) (func(), error) {
+	if _, ok := sessionDir(id); !ok {
+		return nil, fmt.Errorf("invalid session ID")
+	}
+	uploadLocksMu.Lock()
+	lock, ok := uploadLocks[id]
+	if !ok {
+		lock = &uploadLock{}
+		uploadLocks[id] = lock
+	}
+	lock.refs++
+	uploadLocksMu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+		uploadLocksMu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(uploadLocks, id)
+		}
+		uploadLocksMu.Unlock()
+	}, nil
+}
+
+/*
+sanitizeUploadPath function is used to check a file path sent by a client
+The path must be relative, use / as separator and stay inside the upload, it is returned cleaned
+*/
+func sanitizeUploadPath(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "\\\x00\n:") || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("invalid file path %q", name)
+	}
+	clean := path.Clean(name)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") || !filepath.IsLocal(filepath.FromSlash(clean)) {
+		return "", fmt.Errorf("invalid file path %q", name)
+	}
+	return clean, nil
+}
+
+/*
+uploadDir function is used to get the directory of the upload sessions
+*/
+func uploadDir() string {
+	if serviceConfig.UploadDir != "" {
+		return serviceConfig.UploadDir
+	}
+	return filepath.Join(os.TempDir(), "ProofAI_uploads")
+}
+
+/*
+sessionDir function is used to get the directory of a session, false if the ID is not valid
+*/
+func sessionDir(id string) (string, bool) {
+	if len(id) != 32 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", false
+	}
+	return filepath.Join(uploadDir(), id), true
+}
+
+/*
+loadUploadSession function is used to read a session and the progress of its files
+*/
+func loadUploadSession(id string) (*UploadSession, error) {
+	dir, ok := sessionDir(id)
+	if !ok {
+		return nil, fmt.Errorf("invalid session ID")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "session.json"))
+	if err != nil {
+		return nil, fmt.Errorf("session %s not found", id)
+	}
+	var session UploadSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("session %s is corrupted: %v", id, err)
+	}
+
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+
+	session.Received = 0
+	for i := range session.Uploads {
+		file := &session.Uploads[i]
+		file.Received = 0
+		if info, err := os.Stat(filepath.Join(dir, "files", filepath.FromSlash(file.Path))); err == nil {
+			file.Received = info.Size()
+		}
+		if session.CID != "" {
+			file.Received = file.Size
+		}
+		session.Received += file.Received
+	}
+	session.Complete = session.Received == session.Size
+	return &session, nil
+}
+
+/*
+saveUploadSession function is used to write the session.json of a session
+*/
+func saveUploadSession(session *UploadSession) error {
+	dir, _ := sessionDir(session.ID)
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	temp := filepath.Join(dir, "session.json.tmp")
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, filepath.Join(dir, "session.json"))
+}
+
+/*
+removeExpiredUploads function is used to remove the sessions not used for uploadSessionTTL
+A session is locked while it is removed, so a request in progress finishes first and renews the session
+*/
+func removeExpiredUploads() {
+	entries, err := os.ReadDir(uploadDir())
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		dir, ok := sessionDir(entry.Name())
+		if !ok {
+			continue
+		}
+		unlock, _ := lockUploadSession(entry.Name())
+		info, err := os.Stat(dir)
+		if err == nil && time.Since(info.ModTime()) >= uploadSessionTTL {
+			if err := os.RemoveAll(dir); err == nil {
+				fmt.Printf("Upload session %s expired\n", entry.Name())
+			}
+		}
+		unlock()
+	}
+}
+
+/*
+expireUploads function is used to remove the expired sessions every uploadExpiry
+*/
+func expireUploads() {
+	for {
+		removeExpiredUploads()
+		time.Sleep(uploadExpiry)
+	}
+}
+
+/*
+handleUploadSession function is used to create an upload session (POST) or get its progress (GET)
+*/
+func handleUploadSession(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		session, err := loadUploadSession(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(session)
+	case http.MethodPost:
+		createUploadSession(w, r)
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+createUploadSession function is used to create a session from the JSON list of files {"files": [{"path", "size", "sha256"}]}
+*/
+func createUploadSession(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Files []UploadFile `json:"files"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<20)).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse the list of files: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(request.Files) == 0 || len(request.Files) > maxUploadFiles {
+		http.Error(w, fmt.Sprintf("An upload needs 1 to %d files", maxUploadFiles), http.StatusBadRequest)
+		return
+	}
+
+	session := UploadSession{ChunkSize: uploadChunkSize}
+	seen := map[string]bool{}
+	for _, file := range request.Files {
+		clean, err := sanitizeUploadPath(file.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if seen[clean] || file.Size < 0 {
+			http.Error(w, fmt.Sprintf("Invalid or duplicated file %q", file.Path), http.StatusBadRequest)
+			return
+		}
+		seen[clean] = true
+		if file.SHA256 != "" && !contentIDPattern.MatchString(strings.ToLower(file.SHA256)) {
+			http.Error(w, fmt.Sprintf("Invalid SHA-256 hash of %q", file.Path), http.StatusBadRequest)
+			return
+		}
+		session.Size += file.Size
+		session.Uploads = append(session.Uploads, UploadFile{Path: clean, Size: file.Size, SHA256: strings.ToLower(file.SHA256)})
+	}
+	// a file and a directory cannot have the same path
+	for name := range seen {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if seen[dir] {
+				http.Error(w, fmt.Sprintf("File %q is also a directory", dir), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if session.Size > maxUploadSize {
+		http.Error(w, fmt.Sprintf("Upload is larger than %d bytes", maxUploadSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	session.ID = hex.EncodeToString(id)
+	dir, _ := sessionDir(session.ID)
+	if err := os.MkdirAll(filepath.Join(dir, "files"), 0755); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create the upload session: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := saveUploadSession(&session); err != nil {
+		os.RemoveAll(dir)
+		http.Error(w, fmt.Sprintf("Failed to create the upload session: %v", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("Upload session %s created: %d files, %d bytes\n", session.ID, len(session.Uploads), session.Size)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(session)
+}
+
+/*
+handleUploadChunk function is used to write a chunk of a file of a session at offset
+  - offset must not be past the bytes already received, so a file never has holes
+  - a chunk may rewrite bytes already received, so a retried chunk does no harm
+  - the answer is the progress of the file, 409 Conflict tells the client where to resume
+*/
+func handleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "Only PUT method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	unlock, err := lockUploadSession(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer unlock()
+	session, err := loadUploadSession(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if session.CID != "" {
+		http.Error(w, "Upload session is already finalized", http.StatusConflict)
+		return
+	}
+
+	name, err := sanitizeUploadPath(r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var file *UploadFile
+	for i := range session.Uploads {
+		if session.Uploads[i].Path == name {
+			file = &session.Uploads[i]
+		}
+	}
+	if file == nil {
+		http.Error(w, fmt.Sprintf("File %q is not part of the upload", name), http.StatusNotFound)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+	if offset > file.Received {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(file)
+		return
+	}
+
+	dir, _ := sessionDir(id)
+	target := filepath.Join(dir, "files", filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save %s: %v", name, err), http.StatusInternalServerError)
+		return
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save %s: %v", name, err), http.StatusInternalServerError)
+		return
+	}
+	defer out.Close()
+
+	// the bytes past the size of the file are refused
+	limit := min(file.Size-offset, maxUploadChunk)
+	n, err := io.Copy(io.NewOffsetWriter(out, offset), io.LimitReader(r.Body, limit))
+	if offset+n > file.Received {
+		file.Received = offset + n
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Chunk of %s cut off after %d bytes: %v", name, n, err), http.StatusBadRequest)
+		return
+	}
+	if extra, _ := r.Body.Read(make([]byte, 1)); extra > 0 {
+		http.Error(w, fmt.Sprintf("Chunk of %s is past its size or larger than %d bytes", name, maxUploadChunk), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
+
+/*
+handleUploadFinalize function is used to add the files of a complete session to the content store
+ 1. Every file must be received completely and match its SHA-256 hash when one was given
+ 2. The directory is added to the content store, the files are removed from the session
+ 3. The content is pinned for the owner when the request claims it: owner is a public key and signature its signature
+    of "pin", the session ID and a nonce of /nonce, the quota of the owner must hold the upload
+ 4. The answer is the Response of /upload with the CID of the directory and the CID and size of every file,
+    finalizing again answers the same CID and may claim it
+*/
+func handleUploadFinalize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.FormValue("id")
+	unlock, err := lockUploadSession(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer unlock()
+	session, err := loadUploadSession(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	owner := r.FormValue("owner")
+	if owner != "" {
+		nonce := r.FormValue("nonce")
+		if err := verifySignature(owner, pinMessage("pin", id, nonce), r.FormValue("signature")); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid claim of the upload: %v", err), http.StatusUnauthorized)
+			return
+		}
+		if err := useNonce(owner, nonce); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid claim of the upload: %v", err), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if session.CID == "" {
+		dir, _ := sessionDir(id)
+		for _, file := range session.Uploads {
+			if file.Received != file.Size {
+				http.Error(w, fmt.Sprintf("File %s is incomplete: %d of %d bytes", file.Path, file.Received, file.Size), http.StatusConflict)
+				return
+			}
+			target := filepath.Join(dir, "files", filepath.FromSlash(file.Path))
+			if file.Size == 0 {
+				// empty files get no chunk
+				if err := os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+					f, _ := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+					f.Close()
+				}
+			}
+			if file.SHA256 == "" {
+				continue
+			}
+			sum, err := fileSHA256(target)
+			if err != nil || sum != file.SHA256 {
+				os.Remove(target)
+				http.Error(w, fmt.Sprintf("File %s does not match its SHA-256 hash, upload it again", file.Path), http.StatusConflict)
+				return
+			}
+		}
+
+		if err := pins.checkQuota(owner, session.Size); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := contentStore.Ping(r.Context()); err != nil {
+			http.Error(w, fmt.Sprintf("Content store is not available: %v", err), http.StatusInternalServerError)
+			return
+		}
+		cid, err := contentStore.Add(r.Context(), filepath.Join(dir, "files"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to upload directory to the content store: %v", err), http.StatusInternalServerError)
+			return
+		}
+		files, err := contentStore.List(r.Context(), cid)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list the files of %s: %v", cid, err), http.StatusInternalServerError)
+			return
+		}
+		if _, err := pins.add(cid, owner, session.Size); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		session.CID, session.Files = cid, files
+		if err := saveUploadSession(session); err != nil {
+			fmt.Printf("Error saving upload session %s: %v\n", id, err)
+		}
+		os.RemoveAll(filepath.Join(dir, "files"))
+		fmt.Printf("Upload session %s finalized: %s\n", id, cid)
+	} else if owner != "" {
+		if _, err := pins.add(session.CID, owner, session.Size); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{Success: true, Message: session.CID, Uploaded: session.Files})
+}
+
+/*
+fileSHA256 function is used to get the SHA-256 hash of a file
+*/
+func fileSHA256(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func uploadLockCount() int {
+	uploadLocksMu.Lock()
+	defer uploadLocksMu.Unlock()
+	return len(uploadLocks)
+}
+
+func TestLockUploadSessionRefusesInvalidID(t *testing.T) {
+	for _, id := range []string{"", "../etc", "0123", "zz0123456789abcdef0123456789abcd"} {
+		if _, err := lockUploadSession(id); err == nil {
+			t.Fatalf("lock of %q was accepted", id)
+		}
+	}
+	if n := uploadLockCount(); n != 0 {
+		t.Fatalf("%d locks created for invalid IDs", n)
+	}
+}
+
+func TestLockUploadSessionIsReleased(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef"
+	var wg sync.WaitGroup
+	inside := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := lockUploadSession(id)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			inside++
+			if inside != 1 {
+				t.Error("two requests hold the lock of the session")
+			}
+			inside--
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if n := uploadLockCount(); n != 0 {
+		t.Fatalf("%d locks left after the requests", n)
+	}
+}
+
+func TestRemoveExpiredUploads(t *testing.T) {
+	old := serviceConfig.UploadDir
+	serviceConfig.UploadDir = t.TempDir()
+	defer func() { serviceConfig.UploadDir = old }()
+
+	const expired, fresh = "00000000000000000000000000000001", "00000000000000000000000000000002"
+	for _, id := range []string{expired, fresh, "notes"} {
+		if err := os.MkdirAll(filepath.Join(serviceConfig.UploadDir, id), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().Add(-uploadSessionTTL - time.Hour)
+	os.Chtimes(filepath.Join(serviceConfig.UploadDir, expired), past, past)
+	os.Chtimes(filepath.Join(serviceConfig.UploadDir, "notes"), past, past)
+
+	removeExpiredUploads()
+
+	if _, err := os.Stat(filepath.Join(serviceConfig.UploadDir, expired)); !os.IsNotExist(err) {
+		t.Fatal("expired session was not removed")
+	}
+	for _, name := range []string{fresh, "notes"} {
+		if _, err := os.Stat(filepath.Join(serviceConfig.UploadDir, name)); err != nil {
+			t.Fatalf("%s was removed: %v", name, err)
+		}
+	}
+	if n := uploadLockCount(); n != 0 {
+		t.Fatalf("%d locks left after the expiry", n)
+	}
+}